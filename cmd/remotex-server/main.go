@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"slices"
 	"strconv"
+	"time"
 
 	"github.com/dantecatalfamo/remotex/pkg/server"
 	"golang.org/x/term"
@@ -46,13 +50,43 @@ func main() {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	log.Printf("Server config: %+v", config)
 
 	switch cmd[0] {
 	case "server":
-		log.Printf("Listening on http://%s", config.ListenAddress)
+		slog.SetDefault(server.NewLogger(config, os.Stderr))
+		slog.Info("Server config", "config", config)
+		if err := server.CleanDeletedUserDirs(config); err != nil {
+			slog.Error("Failed to clean up deleted user directories", "err", err)
+		}
+		slog.Info("Listening", "address", fmt.Sprintf("http://%s", config.ListenAddress))
 		if err := server.RunServer(config); err != nil {
-			log.Fatal(err)
+			slog.Error("Server stopped", "err", err)
+			os.Exit(1)
+		}
+	case "doctor":
+		ctx := context.Background()
+		checks := server.CheckHealth(ctx, config).Checks
+		checks = append(checks, server.CheckToolchain(ctx, config)...)
+
+		failed := false
+		for _, check := range checks {
+			status := "ok"
+			if !check.OK {
+				status = "FAIL"
+				failed = true
+			}
+			fmt.Printf("%-4s  %-10s  %s\n", status, check.Name, check.Detail)
+		}
+
+		fmt.Println()
+		if version, err := server.TeXLive.Version(ctx); err != nil {
+			fmt.Printf("TeX Live: %s\n", err)
+		} else {
+			fmt.Printf("TeX Live: %s\n", version)
+		}
+
+		if failed {
+			os.Exit(1)
 		}
 	case "useradd":
 		if len(cmd) < 2 {
@@ -63,6 +97,7 @@ func main() {
 		if err := server.CreateUser(config, user); err != nil {
 			log.Fatal(err)
 		}
+		audit(config, server.AuditAdminUserCreate, user, "")
 		log.Printf("Added user %s", user)
 	case "userdel":
 		if len(cmd) < 2 {
@@ -73,6 +108,7 @@ func main() {
 		if err := server.DeleteUser(config, user); err != nil {
 			log.Fatal(err)
 		}
+		audit(config, server.AuditAdminUserDelete, user, "")
 		log.Printf("Deleted user %s", user)
 	case "passwd":
 		if len(cmd) < 2 {
@@ -104,7 +140,23 @@ func main() {
 		if err := server.SetUserPassword(config, user, password); err != nil {
 			log.Fatal(err)
 		}
+		audit(config, server.AuditAdminPasswordReset, user, "")
 		log.Printf("Password set for %s\n", user)
+	case "useradmin":
+		if len(cmd) < 3 {
+			fmt.Println("usage: remotex-server useradmin <username> <true|false>")
+			os.Exit(1)
+		}
+		user := cmd[1]
+		admin, err := strconv.ParseBool(cmd[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := server.SetUserAdmin(config, user, admin); err != nil {
+			log.Fatal(err)
+		}
+		audit(config, server.AuditAdminUserAdmin, user, fmt.Sprintf("admin=%v", admin))
+		log.Printf("Set admin for %s to %v", user, admin)
 	case "tokenadd":
 		if len(cmd) < 3 {
 			fmt.Println("usage: remotex-server tokenadd <username> <description>")
@@ -116,6 +168,7 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		audit(config, server.AuditTokenCreate, user, desc)
 		fmt.Printf("Token: %s\n", token)
 	case "tokendel":
 		if len(cmd) < 2 {
@@ -123,10 +176,146 @@ func main() {
 			return
 		}
 		token := cmd[1]
+		// Look up who the token belonged to for the audit log, the
+		// token itself is never recorded
+		user, _ := server.GetUserFromToken(config, token)
+		info, _ := server.GetTokenInfo(config, token)
 		if err := server.DeleteUserToken(config, token); err != nil {
 			log.Fatal(err)
 		}
+		audit(config, server.AuditTokenDelete, user, info.Description)
 		log.Println("Token deleted")
+	case "invite":
+		maxUses := 1
+		var validFor time.Duration
+		var description string
+		if len(cmd) > 1 {
+			maxUses, err = strconv.Atoi(cmd[1])
+			if err != nil {
+				fmt.Println("usage: remotex-server invite [uses] [valid-for] [description]")
+				os.Exit(1)
+			}
+		}
+		if len(cmd) > 2 {
+			validFor, err = time.ParseDuration(cmd[2])
+			if err != nil {
+				fmt.Println("usage: remotex-server invite [uses] [valid-for] [description]")
+				os.Exit(1)
+			}
+		}
+		if len(cmd) > 3 {
+			description = cmd[3]
+		}
+		code, err := server.CreateInvitation(config, maxUses, validFor, description)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Invitation code: %s\n", code)
+	case "invites":
+		invitations, err := server.ListInvitations(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write([]string{
+			"Code",
+			"Uses",
+			"Max Uses",
+			"Created At",
+			"Expires At",
+			"Description",
+		})
+		for _, invitation := range invitations {
+			var expiresAt string
+			if invitation.ExpiresAt != nil {
+				expiresAt = invitation.ExpiresAt.Format(time.RFC3339)
+			}
+			if err := writer.Write([]string{
+				invitation.Code,
+				strconv.Itoa(invitation.Uses),
+				strconv.Itoa(invitation.MaxUses),
+				invitation.CreatedAt.Format(time.RFC3339),
+				expiresAt,
+				invitation.Description,
+			}); err != nil {
+				log.Fatal(err)
+			}
+		}
+		writer.Flush()
+	case "invitedel":
+		if len(cmd) < 2 {
+			fmt.Println("usage: remotex-server invitedel <code>")
+			os.Exit(1)
+		}
+		if err := server.DeleteInvitation(config, cmd[1]); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Invitation deleted")
+	case "audit":
+		auditFlags := flag.NewFlagSet("audit", flag.ExitOnError)
+		actor := auditFlags.String("actor", "", "Only events performed by this user")
+		action := auditFlags.String("action", "", "Only events with this action")
+		target := auditFlags.String("target", "", "Only events on this user, user/project or file")
+		ip := auditFlags.String("ip", "", "Only events from this IP address")
+		since := auditFlags.String("since", "", "Only events after this time, RFC3339, date, or duration ago")
+		until := auditFlags.String("until", "", "Only events before this time, RFC3339, date, or duration ago")
+		limit := auditFlags.Int("limit", 0, "Only the most recent events")
+		jsonLines := auditFlags.Bool("json", false, "Output JSON lines instead of CSV")
+		auditFlags.Parse(cmd[1:])
+
+		filter := server.AuditFilter{
+			Actor: *actor,
+			Action: *action,
+			Target: *target,
+			IP: *ip,
+			Limit: *limit,
+		}
+		if filter.Since, err = parseAuditTime(*since); err != nil {
+			log.Fatal(err)
+		}
+		if filter.Until, err = parseAuditTime(*until); err != nil {
+			log.Fatal(err)
+		}
+
+		events, err := server.ListAuditEvents(config, filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if *jsonLines {
+			encoder := json.NewEncoder(os.Stdout)
+			for _, event := range events {
+				if err := encoder.Encode(event); err != nil {
+					log.Fatal(err)
+				}
+			}
+			return
+		}
+
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write([]string{
+			"ID",
+			"Time",
+			"Actor",
+			"IP",
+			"Action",
+			"Target",
+			"Detail",
+		})
+		for _, event := range events {
+			if err := writer.Write([]string{
+				strconv.Itoa(event.ID),
+				event.Time.Format(time.RFC3339),
+				event.Actor,
+				event.IP,
+				event.Action,
+				event.Target,
+				event.Detail,
+			}); err != nil {
+				log.Fatal(err)
+			}
+		}
+		writer.Flush()
 	case "stats":
 		userStats, err := server.GetGlobalStats(config)
 		if err != nil {
@@ -166,18 +355,57 @@ func main() {
 	}
 }
 
+// audit records an action taken from the command line in the audit log.
+// Failing to record it doesn't undo the action, so it's only logged.
+func audit(config server.Config, action, target, detail string) {
+	event := server.AuditEvent{
+		Actor: server.AuditActorCLI,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+	if err := server.RecordAuditEvent(config, event); err != nil {
+		log.Printf("Unable to record audit event: %s", err)
+	}
+}
+
 func usage() {
 	fmt.Println("Usage: remotex-server [options] <command> [args]")
 	flag.PrintDefaults()
 	fmt.Printf(`
   commands:
+    doctor
     newconfig <file>
     server
     stats
     useradd   <username>
     userdel   <username>
     passwd    <username> [password]
+    useradmin <username> <true|false>
     tokenadd  <username>
     tokendel  <token>
+    invite    [uses] [valid-for] [description]
+    invites
+    invitedel <code>
+    audit     [-actor user] [-action action] [-target target] [-ip ip]
+              [-since time] [-until time] [-limit n] [-json]
 `)
 }
+
+// parseAuditTime parses an RFC3339 time, a date, or a duration before
+// now. An empty string is the zero time.
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	if parsed, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return parsed, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time \"%s\", expected RFC3339, YYYY-MM-DD or a duration", value)
+}
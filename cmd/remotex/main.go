@@ -6,9 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dantecatalfamo/remotex/pkg/client"
+	"github.com/dantecatalfamo/remotex/pkg/server"
 	"golang.org/x/term"
 )
 
@@ -40,6 +46,7 @@ func main() {
 			fmt.Println("user         ", globalConfig.User)
 			fmt.Println("token        ", globalConfig.Token)
 			fmt.Println("serverBaseUrl", globalConfig.ServerBaseUrl)
+			fmt.Println("parallelism  ", globalConfig.Parallelism)
 			return
 		}
 		saveConfig := false
@@ -74,6 +81,21 @@ func main() {
 				fmt.Println("Too many arguments")
 				os.Exit(1)
 			}
+		case "parallelism":
+			if len(cmd) == 2 {
+				fmt.Println(globalConfig.Parallelism)
+			} else if len(cmd) == 3 {
+				parallelism, err := strconv.Atoi(cmd[2])
+				if err != nil || parallelism < 0 {
+					fmt.Println("Parallelism must be a number of files, or 0 for the default")
+					os.Exit(1)
+				}
+				globalConfig.Parallelism = parallelism
+				saveConfig = true
+			} else {
+				fmt.Println("Too many arguments")
+				os.Exit(1)
+			}
 		}
 		if saveConfig {
 			if err := client.WriteGlobalConfig(globalConfig); err != nil {
@@ -101,6 +123,23 @@ func main() {
 			globalConfig.ServerBaseUrl = strings.Trim(line, "\n")
 		}
 		fmt.Printf("Login for %s\n", globalConfig.ServerBaseUrl)
+
+		if len(cmd) > 1 && cmd[1] == "--sso" {
+			ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Minute)
+			defer cancel()
+			openUrl := func(loginUrl string) {
+				fmt.Println("Open this URL in your browser to login:")
+				fmt.Println(loginUrl)
+			}
+			link := len(cmd) > 2 && cmd[2] == "--link"
+			if err := client.LoginSSO(ctx, globalConfig, link, openUrl); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Println("Logged in")
+			return
+		}
+
 		var username string
 		fmt.Print("Username: ")
 		fmt.Scanln(&username)
@@ -121,6 +160,45 @@ func main() {
 		return
 	}
 
+	if cmd[0] == "register" {
+		if globalConfig.Token != "" {
+			fmt.Println("Already logged in, logout first")
+			os.Exit(1)
+		}
+		reader := bufio.NewReader(os.Stdin)
+		if globalConfig.ServerBaseUrl == "" {
+			fmt.Print("Server base url: ")
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			globalConfig.ServerBaseUrl = strings.Trim(line, "\n")
+		}
+		fmt.Printf("Register for %s\n", globalConfig.ServerBaseUrl)
+		fmt.Print("Invitation code: ")
+		code, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Print("Username: ")
+		username, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		password := readNewPassword()
+
+		if err := client.Register(globalConfig, strings.TrimSpace(code), strings.TrimSpace(username), password); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Registered and logged in")
+		return
+	}
+
 	validateGlobalConfig(globalConfig)
 
 	switch cmd[0] {
@@ -220,23 +298,288 @@ func main() {
 		fmt.Println("  cleanBuild   ", info.LatestBuild.Options.CleanBuild)
 		fmt.Println("buildOut")
 		fmt.Print(info.LatestBuild.BuildOut)
+	case "visibility":
+		if len(cmd) < 2 || (cmd[1] != "public" && cmd[1] != "private") {
+			fmt.Println("usage: remotex visibility <public|private>")
+			os.Exit(1)
+		}
+		projectRoot := findRoot()
+		projectConfig := readProjectConfig(projectRoot)
+		ctx := context.Background()
+		if err := client.SetProjectVisibility(ctx, globalConfig, projectConfig.ProjectName, cmd[1] == "public"); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Project %s is now %s\n", projectConfig.ProjectName, cmd[1])
+	case "history":
+		if len(cmd) < 2 || len(cmd) > 4 {
+			fmt.Println("usage: remotex history <file> [rev] [to-rev]")
+			os.Exit(1)
+		}
+		projectRoot := findRoot()
+		projectConfig := readProjectConfig(projectRoot)
+		filePath := srcPath(projectRoot, cmd[1])
+		ctx := context.Background()
+		var revs []int
+		for _, arg := range cmd[2:] {
+			rev, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Println("usage: remotex history <file> [rev] [to-rev]")
+				os.Exit(1)
+			}
+			revs = append(revs, rev)
+		}
+		switch len(revs) {
+		case 0:
+			revisions, err := client.ListFileRevisions(ctx, globalConfig, projectConfig, filePath)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			for _, revision := range revisions {
+				fmt.Printf("%d\t%s\t%d bytes\t%s\t%s\n", revision.Revision, revision.CreatedAt.Local().Format(time.DateTime), revision.Size, revision.Sha256Sum[:12], revision.TokenDescription)
+			}
+		case 1:
+			if err := client.FetchFileRevision(ctx, globalConfig, projectConfig, filePath, revs[0], os.Stdout); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		case 2:
+			diff, err := client.DiffFileRevisions(ctx, globalConfig, projectConfig, filePath, revs[0], revs[1])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Print(diff)
+		}
+	case "restore":
+		if len(cmd) != 3 {
+			fmt.Println("usage: remotex restore <file> <rev>")
+			os.Exit(1)
+		}
+		rev, err := strconv.Atoi(cmd[2])
+		if err != nil {
+			fmt.Println("usage: remotex restore <file> <rev>")
+			os.Exit(1)
+		}
+		projectRoot := findRoot()
+		projectConfig := readProjectConfig(projectRoot)
+		filePath := srcPath(projectRoot, cmd[1])
+		ctx := context.Background()
+		if err := client.RestoreFileRevision(ctx, globalConfig, projectConfig, projectRoot, filePath, rev); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored %s to revision %d\n", filePath, rev)
+	case "mv":
+		if len(cmd) != 3 {
+			fmt.Println("usage: remotex mv <from> <to>")
+			os.Exit(1)
+		}
+		projectRoot := findRoot()
+		projectConfig := readProjectConfig(projectRoot)
+		from := srcPath(projectRoot, cmd[1])
+		to := srcPath(projectRoot, cmd[2])
+		ctx := context.Background()
+		if err := client.MoveProjectFile(ctx, globalConfig, projectConfig, projectRoot, from, to); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Moved %s to %s\n", from, to)
 	case "build":
+		options, quiet := parseSyncOptions(cmd[1:], "usage: remotex build " + syncFlagsUsage, false)
 		projectRoot := findRoot()
 		projectConfig := readProjectConfig(projectRoot)
 		ctx := context.Background()
-		buildOut, err := client.BuildAndSyncProject(ctx, globalConfig, projectConfig, projectRoot)
+		if options.DryRun {
+			plan, err := client.PushProjectFilesChanges(ctx, globalConfig, projectConfig, projectRoot, "src", options)
+			printSyncPlan("src", plan, true)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Println("Would build the project and pull its output")
+			return
+		}
+		stopProgress := startProgress(&options, quiet)
+		buildOut, err := client.BuildAndSyncProject(ctx, globalConfig, projectConfig, projectRoot, options)
+		stopProgress()
 		if err != nil {
 			fmt.Println("Error:", err)
+			if errors.Is(err, client.ErrSyncConflict) {
+				fmt.Println(`Run "remotex sync" to see and resolve the conflicts`)
+			}
 		}
 		fmt.Print(buildOut)
+	case "builds":
+		if len(cmd) > 4 {
+			fmt.Println("usage: remotex builds [id] [file] [destination]")
+			os.Exit(1)
+		}
+		projectRoot := findRoot()
+		projectConfig := readProjectConfig(projectRoot)
+		ctx := context.Background()
+		if len(cmd) == 1 {
+			builds, err := client.ListBuilds(ctx, globalConfig, projectConfig, 20)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			for _, build := range builds {
+				fmt.Printf("%d\t%s\t%.1fs\t%s\t%d files\n", build.ID, build.BuildStart.Local().Format(time.DateTime), build.BuildTime, build.Status, len(build.Artifacts))
+			}
+			return
+		}
+		buildId, err := strconv.Atoi(cmd[1])
+		if err != nil {
+			fmt.Println("usage: remotex builds [id] [file] [destination]")
+			os.Exit(1)
+		}
+		if len(cmd) == 2 {
+			build, err := client.FetchBuild(ctx, globalConfig, projectConfig, buildId)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Printf("Build %d, %s, %s in %.1fs\n", build.ID, build.BuildStart.Local().Format(time.DateTime), build.Status, build.BuildTime)
+			if len(build.Artifacts) > 0 {
+				fmt.Println("Output:")
+			}
+			for _, artifact := range build.Artifacts {
+				fmt.Printf("  %s\t%d bytes\n", artifact.Path, artifact.Size)
+			}
+			if len(build.Manifest) > 0 {
+				fmt.Println("Sources:")
+			}
+			for _, file := range build.Manifest {
+				fmt.Printf("  %s\t%d bytes\t%s\n", file.Path, file.Size, file.Sha256Sum[:12])
+			}
+			return
+		}
+		destination := path.Base(cmd[2])
+		if len(cmd) == 4 {
+			destination = cmd[3]
+		}
+		file, err := os.Create(destination)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := client.FetchBuildFile(ctx, globalConfig, projectConfig, buildId, cmd[2], file); err != nil {
+			file.Close()
+			os.Remove(destination)
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := file.Close(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Saved %s from build %d to %s\n", cmd[2], buildId, destination)
+	case "push":
+		options, quiet := parseSyncOptions(cmd[1:], "usage: remotex push " + syncFlagsUsage, false)
+		projectRoot := findRoot()
+		projectConfig := readProjectConfig(projectRoot)
+		ctx := context.Background()
+		stopProgress := startProgress(&options, quiet)
+		plan, err := client.PushProjectFilesChanges(ctx, globalConfig, projectConfig, projectRoot, "src", options)
+		stopProgress()
+		if !quiet {
+			printSyncPlan("src", plan, options.DryRun)
+		}
+		if err != nil {
+			fmt.Println(err)
+			if errors.Is(err, client.ErrSyncConflict) {
+				fmt.Println(`Run "remotex sync" to see and resolve the conflicts`)
+			}
+			os.Exit(1)
+		}
 	case "pull":
+		options, quiet := parseSyncOptions(cmd[1:], "usage: remotex pull " + syncFlagsUsage, false)
+		projectRoot := findRoot()
+		projectConfig := readProjectConfig(projectRoot)
+		ctx := context.Background()
+		stopProgress := startProgress(&options, quiet)
+		plans, err := client.PullAllProjectFiles(ctx, globalConfig, projectConfig, projectRoot, options)
+		stopProgress()
+		if !quiet {
+			for _, plan := range plans {
+				printSyncPlan(plan.Subdir, plan.SyncPlan, options.DryRun)
+			}
+		}
+		if err != nil {
+			fmt.Println(err)
+			if errors.Is(err, client.ErrSyncConflict) {
+				fmt.Println(`Run "remotex sync" to see and resolve the conflicts`)
+			}
+			os.Exit(1)
+		}
+	case "status":
+		projectRoot := findRoot()
+		projectConfig := readProjectConfig(projectRoot)
+		ctx := context.Background()
+		status, err := client.FetchProjectStatus(ctx, globalConfig, projectConfig, projectRoot)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if status.Local.Empty() && status.Remote.Empty() && len(status.Conflicts) == 0 {
+			fmt.Println("Up to date with the server")
+			return
+		}
+		if !status.Local.Empty() {
+			fmt.Println("Local changes, pushed by the next build or sync:")
+			printFileChanges(status.Local)
+		}
+		if !status.Remote.Empty() {
+			fmt.Println("Remote changes, pulled by the next pull or sync:")
+			printFileChanges(status.Remote)
+		}
+		if len(status.Conflicts) > 0 {
+			fmt.Println("Conflicts, resolve them with sync:")
+			for _, conflict := range status.Conflicts {
+				fmt.Printf("  %s\n", conflict)
+			}
+		}
+	case "diff":
+		if len(cmd) > 2 {
+			fmt.Println("usage: remotex diff [path]")
+			os.Exit(1)
+		}
 		projectRoot := findRoot()
 		projectConfig := readProjectConfig(projectRoot)
+		var filePath string
+		if len(cmd) == 2 {
+			filePath = srcPath(projectRoot, cmd[1])
+		}
 		ctx := context.Background()
-		if err := client.PullAllProjectFiles(ctx, globalConfig, projectConfig, projectRoot); err != nil {
+		diff, err := client.DiffProjectFiles(ctx, globalConfig, projectConfig, projectRoot, filePath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Print(diff)
+	case "sync":
+		options, quiet := parseSyncOptions(cmd[1:], "usage: remotex sync [--keep-local|--keep-remote] " + syncFlagsUsage, true)
+		options.Mode = client.SyncBoth
+		projectRoot := findRoot()
+		projectConfig := readProjectConfig(projectRoot)
+		ctx := context.Background()
+		stopProgress := startProgress(&options, quiet)
+		plan, err := client.SyncProjectFiles(ctx, globalConfig, projectConfig, projectRoot, "src", options)
+		stopProgress()
+		if !quiet {
+			printSyncPlan("src", plan, options.DryRun)
+		}
+		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
+		if len(plan.Conflicts) > 0 {
+			fmt.Println("Conflicts were left alone, merge them and run \"remotex sync --keep-local\",")
+			fmt.Println("or run \"remotex sync --keep-remote\" to discard the local changes")
+			os.Exit(1)
+		}
 	case "user":
 		ctx := context.Background()
 		userInfo, err := client.FetchUserInfo(ctx, globalConfig)
@@ -256,17 +599,30 @@ func main() {
 			fmt.Printf("- %s\n  public: %v,\n  build: %s\n", project.Name, project.Public, project.LatestBuild.Status)
 		}
 	case "clone":
-		if len(cmd) < 2 {
-			fmt.Println("No project name")
+		var args, flags []string
+		for _, arg := range cmd[1:] {
+			if strings.HasPrefix(arg, "--") {
+				flags = append(flags, arg)
+			} else {
+				args = append(args, arg)
+			}
+		}
+		cloneUsage := "usage: remotex clone <project> [path] [--quiet] [--parallel=N]"
+		options, quiet := parseSyncOptions(flags, cloneUsage, false)
+		if len(args) < 1 || len(args) > 2 || options.DryRun || options.NoDelete {
+			fmt.Println(cloneUsage)
 			os.Exit(1)
 		}
-		projectName := cmd[1]
+		projectName := args[0]
 		path := projectName
-		if len(cmd) > 2 {
-			path = cmd[2]
+		if len(args) > 1 {
+			path = args[1]
 		}
 		ctx := context.Background()
-		if err := client.CloneProject(ctx, globalConfig, projectName, path); err != nil {
+		stopProgress := startProgress(&options, quiet)
+		err := client.CloneProject(ctx, globalConfig, projectName, path, options)
+		stopProgress()
+		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -276,6 +632,48 @@ func main() {
 			os.Exit(1)
 		}
 		fmt.Println("Logged out")
+	case "admin":
+		adminCommand(globalConfig, cmd[1:])
+	case "trash":
+		trashCommand(globalConfig, cmd[1:])
+	case "passwd":
+		fmt.Print("Current password: ")
+		currentPassword, err := term.ReadPassword(int(os.Stdin.Fd()))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println()
+		newPassword := readNewPassword()
+		ctx := context.Background()
+		if err := client.ChangePassword(ctx, globalConfig, string(currentPassword), newPassword); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Password changed, all other clients have been logged out")
+	case "account":
+		if len(cmd) < 2 || cmd[1] != "delete" {
+			fmt.Println("usage: remotex account delete")
+			os.Exit(1)
+		}
+		fmt.Printf("This will permanently delete the account %s and all of its projects.\n", globalConfig.User)
+		fmt.Print("Type your username to confirm: ")
+		confirm, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		confirm = strings.TrimSpace(confirm)
+		if confirm != globalConfig.User {
+			fmt.Println("Username does not match, not deleting")
+			os.Exit(1)
+		}
+		ctx := context.Background()
+		if err := client.DeleteAccount(ctx, globalConfig, confirm); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Account deleted")
 	case "logoutall":
 		if err := client.LogoutAll(globalConfig); err != nil {
 			fmt.Println(err)
@@ -291,22 +689,125 @@ func main() {
 func usage() {
 	fmt.Print(`Usage: remotex <command> [args]
 commands:
-  login        Login to remotex server
+  account      Manage your account, "account delete" to delete it
+  admin        Manage users, tokens and projects (admins only)
+  login        Login to remotex server, --sso for single sign-on, --sso --link to link it to your account
   logout       Logout of the remotex server
   logoutall    Logout all clients connected to the account
   build        Build the current project
+  builds       List builds, show one, or download a file from one
   clone        Clone an existing project to your local machien
+  diff         Show how local source files differ from the server's
   files        List the current project's local files
   filesremote  List the current project's remote files
   global       Read or write global config
+  history      List a file's revisions, show one, or diff two
   init         Create a new project
   listprojects List all remote projects
+  mv           Move or rename a source file or directory
+  passwd       Change your password
   project      Read or write project config
-  pull         Pull any missing files from project remote
+  pull         Pull remote changes, --dry-run to only list them
+  push         Push local source changes, --dry-run to only list them
+  register     Create an account with an invitation code
+  restore      Restore a file to an earlier revision
+  status       List local and remote changes since the last sync
+  sync         Push local and pull remote changes, stopping at conflicts
+  trash        List, restore or purge deleted projects and files
   user         Read user info from remote
+  visibility   Make the current project public or private
 `)
 }
 
+// printFileChanges prints the changes on one side of a project
+func printFileChanges(changes client.FileChanges) {
+	for _, path := range changes.Added {
+		fmt.Printf("  added:    %s\n", path)
+	}
+	for _, path := range changes.Modified {
+		fmt.Printf("  modified: %s\n", path)
+	}
+	for _, path := range changes.Deleted {
+		fmt.Printf("  deleted:  %s\n", path)
+	}
+	for _, moved := range changes.Moved {
+		fmt.Printf("  moved:    %s -> %s\n", moved.From.Path, moved.To.Path)
+	}
+}
+
+// syncFlagsUsage lists the flags shared by the commands that sync files
+const syncFlagsUsage = "[--dry-run] [--no-delete] [--quiet] [--parallel=N]"
+
+// parseSyncOptions parses the flags shared by the commands that sync
+// files, printing usageLine and exiting on anything else. The conflict
+// resolution flags are only accepted by sync. Quiet is set if nothing
+// but errors should be printed.
+func parseSyncOptions(args []string, usageLine string, resolution bool) (options client.SyncOptions, quiet bool) {
+	for _, arg := range args {
+		switch {
+		case arg == "--dry-run":
+			options.DryRun = true
+		case arg == "--no-delete":
+			options.NoDelete = true
+		case arg == "--quiet":
+			quiet = true
+		case strings.HasPrefix(arg, "--parallel="):
+			parallelism, err := strconv.Atoi(strings.TrimPrefix(arg, "--parallel="))
+			if err != nil || parallelism < 1 {
+				fmt.Println(usageLine)
+				os.Exit(1)
+			}
+			options.Parallelism = parallelism
+		case arg == "--keep-local" && resolution && options.Resolution == client.ResolveNone:
+			options.Resolution = client.ResolveKeepLocal
+		case arg == "--keep-remote" && resolution && options.Resolution == client.ResolveNone:
+			options.Resolution = client.ResolveKeepRemote
+		default:
+			fmt.Println(usageLine)
+			os.Exit(1)
+		}
+	}
+	return options, quiet
+}
+
+// printSyncPlan prints the changes a sync made to each side of a subdir
+// and the conflicts it found, or would make if it's a dry run. Paths
+// outside of src are printed with their subdir.
+func printSyncPlan(subdir string, plan client.SyncPlan, dryRun bool) {
+	name := func(path string) string {
+		if subdir == "src" {
+			return path
+		}
+		return subdir + "/" + path
+	}
+	prefix := ""
+	if dryRun {
+		prefix = "would "
+	}
+
+	for _, moved := range plan.Push.Moved {
+		fmt.Printf("%spush   %s -> %s\n", prefix, name(moved.From.Path), name(moved.To.Path))
+	}
+	for _, added := range plan.Push.Added {
+		fmt.Printf("%spush   %s\n", prefix, name(added.Path))
+	}
+	for _, removed := range plan.Push.Removed {
+		fmt.Printf("%spush   delete %s\n", prefix, name(removed.Path))
+	}
+	for _, moved := range plan.Pull.Moved {
+		fmt.Printf("%spull   %s -> %s\n", prefix, name(moved.From.Path), name(moved.To.Path))
+	}
+	for _, added := range plan.Pull.Added {
+		fmt.Printf("%spull   %s\n", prefix, name(added.Path))
+	}
+	for _, removed := range plan.Pull.Removed {
+		fmt.Printf("%spull   delete %s\n", prefix, name(removed.Path))
+	}
+	for _, conflict := range plan.Conflicts {
+		fmt.Printf("CONFLICT %s\n", conflict)
+	}
+}
+
 func findRoot() string {
 	projectRoot, err := client.FindProjectRoot()
 	if err != nil {
@@ -316,6 +817,21 @@ func findRoot() string {
 	return projectRoot
 }
 
+// srcPath turns a path to a file in the project's src directory,
+// relative to the working directory, into a path relative to src.
+// Paths outside of src are assumed to already be relative to it.
+func srcPath(projectRoot, path string) string {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	relPath, err := filepath.Rel(filepath.Join(projectRoot, "src"), absPath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".." + string(filepath.Separator)) {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(relPath)
+}
+
 func readProjectConfig(root string) client.ProjectConfig {
 	config, err := client.ReadProjectConfig(root)
 	if err != nil {
@@ -341,3 +857,183 @@ func validateGlobalConfig(globalConfig client.GlobalConfig) {
 		os.Exit(1)
 	}
 }
+
+func adminUsage() {
+	fmt.Print(`Usage: remotex admin <command> [args]
+commands:
+  users                       List all users
+  useradd  <username> [admin] Create a new user, optionally as an admin
+  userdel  <username>         Delete a user and all of their projects
+  disable  <username>         Prevent a user from logging in
+  enable   <username>         Re-enable a disabled user
+  passwd   <username>         Reset a user's password
+  tokens   <username>         List a user's tokens
+  tokendel <username> [id]    Revoke one or all of a user's tokens
+  projects                    List all projects
+  cancel   <user> <project>   Cancel a project's running build
+`)
+}
+
+func adminCommand(globalConfig client.GlobalConfig, cmd []string) {
+	if len(cmd) < 1 {
+		adminUsage()
+		os.Exit(1)
+	}
+
+	// Every command except users and projects takes a username
+	if len(cmd) < 2 && cmd[0] != "users" && cmd[0] != "projects" {
+		adminUsage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	var err error
+
+	switch cmd[0] {
+	case "users":
+		var accounts []server.UserAccount
+		accounts, err = client.AdminListUsers(ctx, globalConfig)
+		for _, account := range accounts {
+			fmt.Printf("- %s\n  admin: %v\n  disabled: %v\n", account.Name, account.Admin, account.Disabled)
+		}
+	case "useradd":
+		admin := len(cmd) > 2 && cmd[2] == "admin"
+		password := readNewPassword()
+		err = client.AdminCreateUser(ctx, globalConfig, cmd[1], password, admin)
+	case "userdel":
+		err = client.AdminDeleteUser(ctx, globalConfig, cmd[1])
+	case "disable":
+		err = client.AdminSetUserDisabled(ctx, globalConfig, cmd[1], true)
+	case "enable":
+		err = client.AdminSetUserDisabled(ctx, globalConfig, cmd[1], false)
+	case "passwd":
+		password := readNewPassword()
+		err = client.AdminResetPassword(ctx, globalConfig, cmd[1], password)
+	case "tokens":
+		var tokens []server.TokenInfo
+		tokens, err = client.AdminListTokens(ctx, globalConfig, cmd[1])
+		for _, token := range tokens {
+			fmt.Printf("%d\t%s\t%s\n", token.ID, token.CreatedAt, token.Description)
+		}
+	case "tokendel":
+		if len(cmd) > 2 {
+			tokenId, convErr := strconv.Atoi(cmd[2])
+			if convErr != nil {
+				fmt.Println("Invalid token id:", cmd[2])
+				os.Exit(1)
+			}
+			err = client.AdminRevokeToken(ctx, globalConfig, cmd[1], tokenId)
+		} else {
+			err = client.AdminRevokeAllTokens(ctx, globalConfig, cmd[1])
+		}
+	case "projects":
+		var userInfos []server.UserInfo
+		userInfos, err = client.AdminListProjects(ctx, globalConfig)
+		for _, userInfo := range userInfos {
+			for _, project := range userInfo.Projects {
+				fmt.Printf("- %s/%s\n  public: %v,\n  build: %s\n", userInfo.Name, project.Name, project.Public, project.LatestBuild.Status)
+			}
+		}
+	case "cancel":
+		if len(cmd) < 3 {
+			fmt.Println("usage: remotex admin cancel <user> <project>")
+			os.Exit(1)
+		}
+		err = client.AdminCancelBuild(ctx, globalConfig, cmd[1], cmd[2])
+	default:
+		adminUsage()
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func trashUsage() {
+	fmt.Print(`Usage: remotex trash [command] [args]
+commands:
+  list              List deleted projects and files (default)
+  restore <id>      Restore a deleted project or file
+  purge   [id]      Permanently delete one or all entries
+`)
+}
+
+func trashCommand(globalConfig client.GlobalConfig, cmd []string) {
+	ctx := context.Background()
+
+	if len(cmd) == 0 || cmd[0] == "list" {
+		entries, err := client.ListTrash(ctx, globalConfig)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, entry := range entries {
+			name := entry.Project
+			if entry.Kind == server.TrashKindFile {
+				name = fmt.Sprintf("%s/%s/%s", entry.Project, entry.Subdir, entry.Path)
+			}
+			fmt.Printf("%d\t%s\t%s\tdeleted %s\texpires %s\n", entry.ID, entry.Kind, name, entry.DeletedAt.Local().Format(time.DateTime), entry.ExpiresAt.Local().Format(time.DateTime))
+		}
+		return
+	}
+
+	var id int
+	if len(cmd) > 1 {
+		var err error
+		id, err = strconv.Atoi(cmd[1])
+		if err != nil {
+			trashUsage()
+			os.Exit(1)
+		}
+	}
+
+	var err error
+	switch cmd[0] {
+	case "restore":
+		if len(cmd) < 2 {
+			trashUsage()
+			os.Exit(1)
+		}
+		err = client.RestoreTrash(ctx, globalConfig, id)
+	case "purge":
+		if len(cmd) < 2 {
+			err = client.PurgeAllTrash(ctx, globalConfig)
+		} else {
+			err = client.PurgeTrash(ctx, globalConfig, id)
+		}
+	default:
+		trashUsage()
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// readNewPassword prompts for a new password twice and exits if they
+// don't match
+func readNewPassword() string {
+	fmt.Print("Enter new password: ")
+	passwd, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println()
+	fmt.Print("Enter password again: ")
+	passwd2, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println()
+	if !slices.Equal(passwd, passwd2) {
+		fmt.Println("Passwords are not the same")
+		os.Exit(1)
+	}
+	return string(passwd)
+}
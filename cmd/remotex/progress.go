@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/dantecatalfamo/remotex/pkg/client"
+	"golang.org/x/term"
+)
+
+// progressDisplay keeps a line on a terminal up to date with how a
+// sync's file transfers are going
+type progressDisplay struct {
+	out *os.File
+	started time.Time
+	files atomic.Int64
+	filesDone atomic.Int64
+	bytes atomic.Int64
+	bytesDone atomic.Int64
+	stop chan struct{}
+	stopped chan struct{}
+}
+
+func newProgressDisplay(out *os.File) *progressDisplay {
+	display := &progressDisplay{
+		out: out,
+		started: time.Now(),
+		stop: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go display.run()
+	return display
+}
+
+func (d *progressDisplay) Queued(files int, bytes int64) {
+	d.files.Add(int64(files))
+	d.bytes.Add(bytes)
+}
+
+func (d *progressDisplay) Transferred(bytes int64) {
+	d.bytesDone.Add(bytes)
+}
+
+func (d *progressDisplay) Finished(path string) {
+	d.filesDone.Add(1)
+}
+
+func (d *progressDisplay) run() {
+	defer close(d.stopped)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.draw()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+func (d *progressDisplay) draw() {
+	files := d.files.Load()
+	if files == 0 {
+		return
+	}
+	bytesDone := d.bytesDone.Load()
+	rate := float64(bytesDone) / time.Since(d.started).Seconds()
+	fmt.Fprintf(d.out, "\r%d/%d files  %s/%s  %s/s\x1b[K", d.filesDone.Load(), files, formatBytes(float64(bytesDone)), formatBytes(float64(d.bytes.Load())), formatBytes(rate))
+}
+
+// Close draws the final progress and moves past it, if anything was
+// transferred
+func (d *progressDisplay) Close() {
+	close(d.stop)
+	<-d.stopped
+	if d.files.Load() > 0 {
+		d.draw()
+		fmt.Fprintln(d.out)
+	}
+}
+
+// formatBytes formats a number of bytes with a binary unit
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units) - 1 {
+		bytes /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
+
+// startProgress shows the progress of the sync options' transfers on
+// stderr, unless it isn't a terminal or quiet is set. The returned
+// function stops showing it.
+func startProgress(options *client.SyncOptions, quiet bool) func() {
+	if quiet || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return func() {}
+	}
+	display := newProgressDisplay(os.Stderr)
+	options.Progress = display
+	return display.Close
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var ErrIncorrectPassword = errors.New("incorrect password")
+var ErrNotLoggedIn = errors.New("not logged in")
+
+// ChangePassword changes the user's password. The server logs out
+// every other session, the client's token stays logged in.
+func (c *Client) ChangePassword(ctx context.Context, currentPassword, newPassword string) error {
+	err := c.sendEmpty(ctx, request{
+		method: http.MethodPost,
+		path: []string{"account", "password"},
+		form: url.Values{
+			"current_password": { currentPassword },
+			"new_password": { newPassword },
+		},
+		errors: map[int]error{
+			http.StatusForbidden: ErrIncorrectPassword,
+			http.StatusUnauthorized: ErrNotLoggedIn,
+			http.StatusBadRequest: errServerMessage,
+			http.StatusConflict: errServerMessage,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("ChangePassword: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteAccount permanently deletes the user and all of their
+// projects. confirmUsername must match the user.
+func (c *Client) DeleteAccount(ctx context.Context, confirmUsername string) error {
+	err := c.sendEmpty(ctx, request{
+		method: http.MethodDelete,
+		path: []string{"account/"},
+		query: url.Values{ "confirm": { confirmUsername } },
+		errors: map[int]error{
+			http.StatusUnauthorized: ErrNotLoggedIn,
+			http.StatusBadRequest: errServerMessage,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteAccount: %w", err)
+	}
+
+	return nil
+}
+
+// ChangePassword changes the logged in user's password. The server
+// logs out every other session, this one stays logged in.
+func ChangePassword(ctx context.Context, globalConfig GlobalConfig, currentPassword, newPassword string) error {
+	return globalConfig.Client().ChangePassword(ctx, currentPassword, newPassword)
+}
+
+// DeleteAccount permanently deletes the logged in user and all of
+// their projects, then clears the saved login. confirmUsername must
+// match the logged in user.
+func DeleteAccount(ctx context.Context, globalConfig GlobalConfig, confirmUsername string) error {
+	if err := globalConfig.Client().DeleteAccount(ctx, confirmUsername); err != nil {
+		return err
+	}
+
+	globalConfig.Token = ""
+	globalConfig.User = ""
+
+	if err := WriteGlobalConfig(globalConfig); err != nil {
+		return fmt.Errorf("DeleteAccount write global config: %w", err)
+	}
+
+	return nil
+}
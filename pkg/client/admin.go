@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
+)
+
+var ErrNotAdmin = errors.New("not an administrator")
+var ErrAdminNotFound = errors.New("user, token or project does not exist")
+var ErrNoBuildRunning = server.ErrNoBuildRunning
+
+// adminRequest is a request to an admin endpoint
+func adminRequest(method string, form url.Values, path ...string) request {
+	return request{
+		method: method,
+		path: append([]string{"admin"}, path...),
+		form: form,
+		errors: map[int]error{
+			http.StatusForbidden: ErrNotAdmin,
+			http.StatusUnauthorized: ErrNotAdmin,
+			http.StatusNotFound: ErrAdminNotFound,
+			http.StatusConflict: ErrNoBuildRunning,
+		},
+	}
+}
+
+// AdminListUsers returns every user account on the server
+func (c *Client) AdminListUsers(ctx context.Context) ([]server.UserAccount, error) {
+	var accounts []server.UserAccount
+	if err := c.sendJSON(ctx, adminRequest(http.MethodGet, nil, "users"), &accounts); err != nil {
+		return nil, fmt.Errorf("AdminListUsers: %w", err)
+	}
+
+	return accounts, nil
+}
+
+// AdminCreateUser creates a user account, an administrator if admin is
+// set
+func (c *Client) AdminCreateUser(ctx context.Context, username, password string, admin bool) error {
+	form := url.Values{}
+	form["username"] = []string{username}
+	form["password"] = []string{password}
+	if admin {
+		form["admin"] = []string{"true"}
+	}
+
+	if err := c.sendEmpty(ctx, adminRequest(http.MethodPost, form, "users")); err != nil {
+		return fmt.Errorf("AdminCreateUser: %w", err)
+	}
+
+	return nil
+}
+
+// AdminDeleteUser deletes a user account and all of its projects
+func (c *Client) AdminDeleteUser(ctx context.Context, username string) error {
+	if err := c.sendEmpty(ctx, adminRequest(http.MethodDelete, nil, "users", username)); err != nil {
+		return fmt.Errorf("AdminDeleteUser: %w", err)
+	}
+
+	return nil
+}
+
+// AdminSetUserDisabled disables or enables a user account
+func (c *Client) AdminSetUserDisabled(ctx context.Context, username string, disabled bool) error {
+	action := "enable"
+	if disabled {
+		action = "disable"
+	}
+
+	if err := c.sendEmpty(ctx, adminRequest(http.MethodPost, url.Values{}, "users", username, action)); err != nil {
+		return fmt.Errorf("AdminSetUserDisabled: %w", err)
+	}
+
+	return nil
+}
+
+// AdminResetPassword sets a user's password
+func (c *Client) AdminResetPassword(ctx context.Context, username, password string) error {
+	form := url.Values{}
+	form["password"] = []string{password}
+
+	if err := c.sendEmpty(ctx, adminRequest(http.MethodPost, form, "users", username, "password")); err != nil {
+		return fmt.Errorf("AdminResetPassword: %w", err)
+	}
+
+	return nil
+}
+
+// AdminListTokens returns a user's login tokens
+func (c *Client) AdminListTokens(ctx context.Context, username string) ([]server.TokenInfo, error) {
+	var tokens []server.TokenInfo
+	if err := c.sendJSON(ctx, adminRequest(http.MethodGet, nil, "users", username, "tokens"), &tokens); err != nil {
+		return nil, fmt.Errorf("AdminListTokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// AdminRevokeAllTokens logs a user out everywhere
+func (c *Client) AdminRevokeAllTokens(ctx context.Context, username string) error {
+	if err := c.sendEmpty(ctx, adminRequest(http.MethodDelete, nil, "users", username, "tokens")); err != nil {
+		return fmt.Errorf("AdminRevokeAllTokens: %w", err)
+	}
+
+	return nil
+}
+
+// AdminRevokeToken revokes one of a user's login tokens
+func (c *Client) AdminRevokeToken(ctx context.Context, username string, tokenId int) error {
+	if err := c.sendEmpty(ctx, adminRequest(http.MethodDelete, nil, "users", username, "tokens", strconv.Itoa(tokenId))); err != nil {
+		return fmt.Errorf("AdminRevokeToken: %w", err)
+	}
+
+	return nil
+}
+
+// AdminListProjects returns every user with their projects
+func (c *Client) AdminListProjects(ctx context.Context) ([]server.UserInfo, error) {
+	var userInfos []server.UserInfo
+	if err := c.sendJSON(ctx, adminRequest(http.MethodGet, nil, "projects"), &userInfos); err != nil {
+		return nil, fmt.Errorf("AdminListProjects: %w", err)
+	}
+
+	return userInfos, nil
+}
+
+// AdminCancelBuild cancels the build running for a user's project
+func (c *Client) AdminCancelBuild(ctx context.Context, username, projectName string) error {
+	if err := c.sendEmpty(ctx, adminRequest(http.MethodPost, url.Values{}, "projects", username, projectName, "cancel")); err != nil {
+		return fmt.Errorf("AdminCancelBuild: %w", err)
+	}
+
+	return nil
+}
+
+func AdminListUsers(ctx context.Context, globalConfig GlobalConfig) ([]server.UserAccount, error) {
+	return globalConfig.Client().AdminListUsers(ctx)
+}
+
+func AdminCreateUser(ctx context.Context, globalConfig GlobalConfig, username, password string, admin bool) error {
+	return globalConfig.Client().AdminCreateUser(ctx, username, password, admin)
+}
+
+func AdminDeleteUser(ctx context.Context, globalConfig GlobalConfig, username string) error {
+	return globalConfig.Client().AdminDeleteUser(ctx, username)
+}
+
+func AdminSetUserDisabled(ctx context.Context, globalConfig GlobalConfig, username string, disabled bool) error {
+	return globalConfig.Client().AdminSetUserDisabled(ctx, username, disabled)
+}
+
+func AdminResetPassword(ctx context.Context, globalConfig GlobalConfig, username, password string) error {
+	return globalConfig.Client().AdminResetPassword(ctx, username, password)
+}
+
+func AdminListTokens(ctx context.Context, globalConfig GlobalConfig, username string) ([]server.TokenInfo, error) {
+	return globalConfig.Client().AdminListTokens(ctx, username)
+}
+
+func AdminRevokeAllTokens(ctx context.Context, globalConfig GlobalConfig, username string) error {
+	return globalConfig.Client().AdminRevokeAllTokens(ctx, username)
+}
+
+func AdminRevokeToken(ctx context.Context, globalConfig GlobalConfig, username string, tokenId int) error {
+	return globalConfig.Client().AdminRevokeToken(ctx, username, tokenId)
+}
+
+func AdminListProjects(ctx context.Context, globalConfig GlobalConfig) ([]server.UserInfo, error) {
+	return globalConfig.Client().AdminListProjects(ctx)
+}
+
+func AdminCancelBuild(ctx context.Context, globalConfig GlobalConfig, username, projectName string) error {
+	return globalConfig.Client().AdminCancelBuild(ctx, username, projectName)
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
+)
+
+var ErrBuildNotFound = server.ErrBuildNotFound
+var ErrBuildFailure = errors.New("build failure")
+var ErrBuildInProgress = server.ErrBuildInProgress
+
+// buildRequest is a request for one of a project's builds
+func (c *Client) buildRequest(projectName string, query url.Values, path ...string) request {
+	return request{
+		method: http.MethodGet,
+		path: append([]string{ c.user, projectName, "builds" }, path...),
+		query: query,
+		errors: map[int]error{ http.StatusNotFound: ErrBuildNotFound },
+	}
+}
+
+// Build builds a project and returns the build's output. A build that
+// fails returns its output along with ErrBuildFailure.
+func (c *Client) Build(ctx context.Context, projectName string, options server.ProjectBuildOptions) (string, error) {
+	// XXX keep up to date with build options!
+	query := url.Values{}
+
+	if options.CleanBuild {
+		query.Add("cleanBuild", "true")
+	}
+
+	if options.Dependents {
+		query.Add("dependents", "true")
+	}
+
+	if options.Document != "" {
+		query.Add("document", options.Document)
+	}
+
+	if options.Engine != "" {
+		query.Add("engine", string(options.Engine))
+	}
+
+	if options.FileLineError {
+		query.Add("fileLineError", "true")
+	}
+
+	if options.Force {
+		query.Add("force", "true")
+	}
+
+	resp, err := c.send(ctx, request{
+		method: http.MethodPost,
+		path: []string{ c.user, projectName, "build" },
+		query: query,
+		accept: []int{ http.StatusUnprocessableEntity },
+		errors: map[int]error{ http.StatusConflict: ErrBuildInProgress },
+	})
+	if err != nil {
+		return "", fmt.Errorf("Build: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var outBuf bytes.Buffer
+	if _, err := io.Copy(&outBuf, resp.Body); err != nil {
+		return "", fmt.Errorf("Build copy buffer: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		return outBuf.String(), ErrBuildFailure
+	}
+
+	return outBuf.String(), nil
+}
+
+// ListBuilds returns up to limit of a project's most recent builds,
+// newest first
+func (c *Client) ListBuilds(ctx context.Context, projectName string, limit int) ([]server.BuildInfo, error) {
+	var builds []server.BuildInfo
+	if err := c.sendJSON(ctx, c.buildRequest(projectName, url.Values{ "limit": { strconv.Itoa(limit) } }), &builds); err != nil {
+		return nil, fmt.Errorf("ListBuilds: %w", err)
+	}
+
+	return builds, nil
+}
+
+// FetchBuild returns a build of a project with its output and the
+// output files kept from it
+func (c *Client) FetchBuild(ctx context.Context, projectName string, buildId int) (server.BuildInfo, error) {
+	var build server.BuildInfo
+	if err := c.sendJSON(ctx, c.buildRequest(projectName, nil, strconv.Itoa(buildId)), &build); err != nil {
+		return server.BuildInfo{}, fmt.Errorf("FetchBuild: %w", err)
+	}
+
+	return build, nil
+}
+
+// ListBuildFiles returns the output files kept from a build
+func (c *Client) ListBuildFiles(ctx context.Context, projectName string, buildId int) ([]server.BuildArtifact, error) {
+	var artifacts []server.BuildArtifact
+	if err := c.sendJSON(ctx, c.buildRequest(projectName, nil, strconv.Itoa(buildId), "out"), &artifacts); err != nil {
+		return nil, fmt.Errorf("ListBuildFiles: %w", err)
+	}
+
+	return artifacts, nil
+}
+
+// FetchBuildFile copies an output file kept from a build to writer
+func (c *Client) FetchBuildFile(ctx context.Context, projectName string, buildId int, filePath string, writer io.Writer) error {
+	if err := c.sendCopy(ctx, c.buildRequest(projectName, nil, strconv.Itoa(buildId), "out", filePath), writer); err != nil {
+		return fmt.Errorf("FetchBuildFile: %w", err)
+	}
+
+	return nil
+}
+
+// FetchBuildSrcFile copies a src file, as it was when a build ran, to
+// writer
+func (c *Client) FetchBuildSrcFile(ctx context.Context, projectName string, buildId int, filePath string, writer io.Writer) error {
+	if err := c.sendCopy(ctx, c.buildRequest(projectName, nil, strconv.Itoa(buildId), "src", filePath), writer); err != nil {
+		return fmt.Errorf("FetchBuildSrcFile: %w", err)
+	}
+
+	return nil
+}
+
+func BuildProject(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig) (string, error) {
+	return globalConfig.Client().Build(ctx, projectConfig.ProjectName, projectConfig.BuildOptions)
+}
+
+// ListBuilds returns up to limit of the project's most recent builds,
+// newest first
+func ListBuilds(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, limit int) ([]server.BuildInfo, error) {
+	return globalConfig.Client().ListBuilds(ctx, projectConfig.ProjectName, limit)
+}
+
+// FetchBuild returns a build of the project with its output and the
+// output files kept from it
+func FetchBuild(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, buildId int) (server.BuildInfo, error) {
+	return globalConfig.Client().FetchBuild(ctx, projectConfig.ProjectName, buildId)
+}
+
+// FetchBuildFile copies an output file kept from a build to writer
+func FetchBuildFile(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, buildId int, filePath string, writer io.Writer) error {
+	return globalConfig.Client().FetchBuildFile(ctx, projectConfig.ProjectName, buildId, filePath, writer)
+}
@@ -0,0 +1,199 @@
+// Package client talks to a RemoTeX server. Client covers the server's
+// API on its own, the rest of the package keeps local projects in sync
+// with the server using the global and project configs.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Client sends requests to a RemoTeX server as one user. Its methods
+// cover the server's API and return the server's own types, without
+// touching any local project or config. It's safe to use from several
+// goroutines at once.
+type Client struct {
+	baseUrl string
+	user string
+	token string
+	http *HTTPClient
+}
+
+// ClientOption changes how a Client sends requests
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	httpClient *http.Client
+	httpOptions HTTPOptions
+}
+
+// WithHTTPClient sends requests through httpClient. Failed idempotent
+// requests are still retried.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(o *clientOptions) {
+		o.httpClient = httpClient
+	}
+}
+
+// WithHTTPOptions sets the timeouts and retries requests are sent with.
+// Only the retry settings apply to a client set with WithHTTPClient.
+func WithHTTPOptions(httpOptions HTTPOptions) ClientOption {
+	return func(o *clientOptions) {
+		o.httpOptions = httpOptions
+	}
+}
+
+// NewClient returns a client for the server at baseUrl, authenticated
+// as user with token. The token can be empty to call the endpoints
+// that don't need one, like Login.
+func NewClient(baseUrl, user, token string, options ...ClientOption) *Client {
+	o := clientOptions{ httpOptions: DefaultHTTPOptions() }
+	for _, option := range options {
+		option(&o)
+	}
+
+	var httpClient *HTTPClient
+	if o.httpClient != nil {
+		httpClient = WrapHTTPClient(o.httpClient, o.httpOptions)
+	} else {
+		httpClient = NewHTTPClient(o.httpOptions)
+	}
+
+	return &Client{
+		baseUrl: baseUrl,
+		user: user,
+		token: token,
+		http: httpClient,
+	}
+}
+
+// Client returns a client for the server and user in the global config,
+// sending requests with the options from SetHTTPOptions
+func (g GlobalConfig) Client() *Client {
+	return &Client{
+		baseUrl: g.ServerBaseUrl,
+		user: g.User,
+		token: g.Token,
+		http: httpClient,
+	}
+}
+
+// User returns the user the client is authenticated as
+func (c *Client) User() string {
+	return c.user
+}
+
+// request is one request to the server's API
+type request struct {
+	method string
+	path []string
+	query url.Values
+	form url.Values // Sent as the body if set
+	body io.Reader
+	header http.Header
+	accept []int // Status codes other than 200 to return the response for
+	errors map[int]error // Errors to return for status codes
+}
+
+// errServerMessage in a request's errors returns the response body as
+// the error, for status codes the server explains
+var errServerMessage = errors.New("server message")
+
+// send sends an authenticated request and returns the response if its
+// status code is 200 or accepted. The caller closes the body.
+func (c *Client) send(ctx context.Context, r request) (*http.Response, error) {
+	requestUrl, err := url.JoinPath(c.baseUrl, r.path...)
+	if err != nil {
+		return nil, fmt.Errorf("send join url: %w", err)
+	}
+	if len(r.query) > 0 {
+		requestUrl += "?" + r.query.Encode()
+	}
+
+	body := r.body
+	if r.form != nil {
+		body = strings.NewReader(r.form.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.method, requestUrl, body)
+	if err != nil {
+		return nil, fmt.Errorf("send create request: %w", err)
+	}
+	for key, values := range r.header {
+		req.Header[key] = values
+	}
+	if r.form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK || slices.Contains(r.accept, resp.StatusCode) {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if err, ok := r.errors[resp.StatusCode]; ok {
+		if err == errServerMessage {
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			return nil, errors.New(strings.TrimSpace(string(message)))
+		}
+		return nil, err
+	}
+
+	return nil, newStatusError(resp)
+}
+
+// sendJSON sends a request and decodes its JSON response into v
+func (c *Client) sendJSON(ctx context.Context, r request, v any) error {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("sendJSON decode: %w", err)
+	}
+
+	return nil
+}
+
+// sendEmpty sends a request whose response has nothing worth reading
+func (c *Client) sendEmpty(ctx context.Context, r request) error {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// sendCopy sends a request and copies its response to writer
+func (c *Client) sendCopy(ctx context.Context, r request, writer io.Writer) error {
+	resp, err := c.send(ctx, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(writer, resp.Body); err != nil {
+		return fmt.Errorf("sendCopy: %w", err)
+	}
+
+	return nil
+}
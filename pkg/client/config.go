@@ -14,6 +14,7 @@ type GlobalConfig struct {
 	User string `json:"user"`
 	ServerBaseUrl string `json:"serverBaseUrl"`
 	Token string `json:"token"`
+	Parallelism int `json:"parallelism,omitempty"`
 }
 
 type ProjectConfig struct {
@@ -0,0 +1,272 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
+)
+
+var ErrFileTooLarge = server.ErrFileTooLarge
+var ErrUploadMismatch = server.ErrUploadMismatch
+
+// ErrNotModified is returned by OpenFile when the server's copy of a
+// file has the sum it was given
+var ErrNotModified = errors.New("file not modified")
+
+// uploadAttempts is how many times a file is sent before giving up,
+// when the server says it didn't arrive intact
+const uploadAttempts = 3
+
+// ListFiles returns the files in one of a project's subdirs, src, aux
+// or out
+func (c *Client) ListFiles(ctx context.Context, projectName, subdir string) ([]server.FileInfo, error) {
+	var fileInfos []server.FileInfo
+	err := c.sendJSON(ctx, request{
+		method: http.MethodGet,
+		path: []string{ c.user, projectName, subdir },
+		errors: map[int]error{ http.StatusNotFound: ErrProjectNotExist },
+	}, &fileInfos)
+	if err != nil {
+		return nil, fmt.Errorf("ListFiles: %w", err)
+	}
+
+	return fileInfos, nil
+}
+
+// OpenFile returns the contents of a file in one of a project's
+// subdirs. If sha256Sum isn't empty and the server's copy has that
+// sum, ErrNotModified is returned instead. The caller closes the
+// contents.
+func (c *Client) OpenFile(ctx context.Context, projectName, subdir, filePath, sha256Sum string) (io.ReadCloser, error) {
+	// The server uses the sum of a file as its ETag
+	header := http.Header{}
+	if sha256Sum != "" {
+		header.Set("If-None-Match", fmt.Sprintf("\"%s\"", sha256Sum))
+	}
+
+	resp, err := c.send(ctx, request{
+		method: http.MethodGet,
+		path: []string{ c.user, projectName, subdir, filePath },
+		header: header,
+		accept: []int{ http.StatusNotModified },
+	})
+	if err != nil {
+		return nil, fmt.Errorf("OpenFile: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, ErrNotModified
+	}
+
+	return resp.Body, nil
+}
+
+// FetchFile copies a file in one of a project's subdirs to writer
+func (c *Client) FetchFile(ctx context.Context, projectName, subdir, filePath string, writer io.Writer) error {
+	contents, err := c.OpenFile(ctx, projectName, subdir, filePath, "")
+	if err != nil {
+		return fmt.Errorf("FetchFile: %w", err)
+	}
+	defer contents.Close()
+
+	if _, err := io.Copy(writer, contents); err != nil {
+		return fmt.Errorf("FetchFile copy: %w", err)
+	}
+
+	return nil
+}
+
+// UploadFile uploads a src file, if the file it replaces on the server
+// matches precondition, and returns its size. The file is read more
+// than once, and sent again if it doesn't arrive intact.
+func (c *Client) UploadFile(ctx context.Context, projectName, filePath string, file io.ReadSeeker, precondition server.FilePrecondition) (int64, error) {
+	return c.uploadFile(ctx, projectName, filePath, file, precondition, nil)
+}
+
+// uploadFile uploads a src file, telling progress about the bytes sent
+// if it isn't nil
+func (c *Client) uploadFile(ctx context.Context, projectName, filePath string, file io.ReadSeeker, precondition server.FilePrecondition, progress Progress) (int64, error) {
+	for attempt := 1; ; attempt++ {
+		size, err := c.uploadAttempt(ctx, projectName, filePath, file, precondition, progress)
+		if errors.Is(err, ErrUploadMismatch) && attempt < uploadAttempts {
+			log.Printf("%s did not arrive intact, sending it again", filePath)
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("UploadFile: %w", err)
+		}
+		return size, nil
+	}
+}
+
+// uploadAttempt makes one attempt at uploading a file. The server is
+// sent the file's size and sum, which it checks before replacing its
+// copy.
+func (c *Client) uploadAttempt(ctx context.Context, projectName, filePath string, file io.ReadSeeker, precondition server.FilePrecondition, progress Progress) (int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("uploadAttempt seek file: %w", err)
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return 0, fmt.Errorf("uploadAttempt hash file: %w", err)
+	}
+	digest := fmt.Sprintf("%x", hasher.Sum(nil))
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("uploadAttempt seek file: %w", err)
+	}
+
+	// Enough of the file to tell what it is, for compression
+	head := make([]byte, 512)
+	headSize, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("uploadAttempt read file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("uploadAttempt seek file: %w", err)
+	}
+
+	// Only compress if the server has said it accepts compressed
+	// uploads, and the file isn't compressed already
+	encoding := c.http.requestEncoding(c.baseUrl)
+	if !isCompressibleFile(filePath, head[:headSize]) {
+		encoding = ""
+	}
+
+	// The form is streamed to the server as it's read from the file,
+	// so it's never held in memory
+	bodyReader, bodyWriter := io.Pipe()
+
+	var formWriter io.Writer = bodyWriter
+	var encoder io.WriteCloser
+	if encoding != "" {
+		encoder, err = newBodyEncoder(encoding, bodyWriter)
+		if err != nil {
+			return 0, fmt.Errorf("uploadAttempt: %w", err)
+		}
+		formWriter = encoder
+	}
+	form := multipart.NewWriter(formWriter)
+
+	// The file is read again if this attempt fails, so it has to be
+	// finished with before returning
+	written := make(chan struct{})
+	go func() {
+		bodyWriter.CloseWithError(writeUploadForm(form, encoder, filePath, withProgress(file, progress)))
+		close(written)
+	}()
+	defer func() {
+		bodyReader.Close()
+		<-written
+	}()
+
+	header := http.Header{}
+	header.Set("Content-Type", form.FormDataContentType())
+	header.Set(server.FileSizeHeader, strconv.FormatInt(size, 10))
+	header.Set(server.FileSha256Header, digest)
+	precondition.SetHeader(header)
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+
+	err = c.sendEmpty(ctx, request{
+		method: http.MethodPost,
+		path: []string{ c.user, projectName, "src" },
+		body: bodyReader,
+		header: header,
+		errors: map[int]error{
+			http.StatusRequestEntityTooLarge: ErrFileTooLarge,
+			http.StatusUnprocessableEntity: ErrUploadMismatch,
+			http.StatusPreconditionFailed: ErrRemoteChanged,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// writeUploadForm writes a file upload form, then closes the encoder
+// it's written through, if there is one. The path is written before
+// the file, so the server knows where to put the file as it arrives.
+func writeUploadForm(form *multipart.Writer, encoder io.Closer, filePath string, file io.Reader) error {
+	if err := form.WriteField("path", filePath); err != nil {
+		return fmt.Errorf("writeUploadForm write path: %w", err)
+	}
+
+	part, err := form.CreateFormFile("file", filepath.Base(filePath))
+	if err != nil {
+		return fmt.Errorf("writeUploadForm create form file: %w", err)
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return fmt.Errorf("writeUploadForm write form file: %w", err)
+	}
+
+	if err := form.Close(); err != nil {
+		return fmt.Errorf("writeUploadForm close form: %w", err)
+	}
+
+	if encoder != nil {
+		if err := encoder.Close(); err != nil {
+			return fmt.Errorf("writeUploadForm close encoder: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteFile deletes a src file, if it matches precondition
+func (c *Client) DeleteFile(ctx context.Context, projectName, filePath string, precondition server.FilePrecondition) error {
+	header := http.Header{}
+	precondition.SetHeader(header)
+
+	err := c.sendEmpty(ctx, request{
+		method: http.MethodDelete,
+		path: []string{ c.user, projectName, "src", filePath },
+		header: header,
+		errors: map[int]error{ http.StatusPreconditionFailed: ErrRemoteChanged },
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteFile: %w", err)
+	}
+
+	return nil
+}
+
+// MoveFile moves or renames a src file or directory without uploading
+// it again, if the file being moved matches precondition
+func (c *Client) MoveFile(ctx context.Context, projectName, from, to string, precondition server.FilePrecondition) error {
+	header := http.Header{}
+	precondition.SetHeader(header)
+
+	err := c.sendEmpty(ctx, request{
+		method: http.MethodPost,
+		path: []string{ c.user, projectName, "move" },
+		form: url.Values{ "from": { from }, "to": { to } },
+		header: header,
+		errors: map[int]error{
+			http.StatusNotFound: ErrFileNotFound,
+			http.StatusConflict: ErrFileExists,
+			http.StatusPreconditionFailed: ErrRemoteChanged,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("MoveFile: %w", err)
+	}
+
+	return nil
+}
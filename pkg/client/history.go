@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
+)
+
+var ErrRevisionNotFound = server.ErrRevisionNotFound
+var ErrRevisionNotText = server.ErrRevisionNotText
+
+// historyRequest is a request for a project file's history
+func (c *Client) historyRequest(method, projectName string, path ...string) request {
+	return request{
+		method: method,
+		path: append([]string{ c.user, projectName }, path...),
+		errors: map[int]error{
+			http.StatusNotFound: ErrRevisionNotFound,
+			http.StatusUnprocessableEntity: ErrRevisionNotText,
+		},
+	}
+}
+
+// ListFileRevisions returns every revision of a src file, oldest first
+func (c *Client) ListFileRevisions(ctx context.Context, projectName, filePath string) ([]server.FileRevision, error) {
+	var revisions []server.FileRevision
+	if err := c.sendJSON(ctx, c.historyRequest(http.MethodGet, projectName, "history", filePath), &revisions); err != nil {
+		return nil, fmt.Errorf("ListFileRevisions: %w", err)
+	}
+
+	return revisions, nil
+}
+
+// FetchFileRevision copies the contents of one revision of a src file
+// to writer
+func (c *Client) FetchFileRevision(ctx context.Context, projectName, filePath string, rev int, writer io.Writer) error {
+	if err := c.sendCopy(ctx, c.historyRequest(http.MethodGet, projectName, "revision", strconv.Itoa(rev), filePath), writer); err != nil {
+		return fmt.Errorf("FetchFileRevision: %w", err)
+	}
+
+	return nil
+}
+
+// DiffFileRevisions returns a unified diff between two revisions of a
+// text src file
+func (c *Client) DiffFileRevisions(ctx context.Context, projectName, filePath string, from, to int) (string, error) {
+	resp, err := c.send(ctx, c.historyRequest(http.MethodGet, projectName, "diff", strconv.Itoa(from), strconv.Itoa(to), filePath))
+	if err != nil {
+		return "", fmt.Errorf("DiffFileRevisions: %w", err)
+	}
+	defer resp.Body.Close()
+
+	diff, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("DiffFileRevisions read body: %w", err)
+	}
+
+	return string(diff), nil
+}
+
+// RestoreFileRevision makes an earlier revision of a src file current
+func (c *Client) RestoreFileRevision(ctx context.Context, projectName, filePath string, rev int) error {
+	if err := c.sendEmpty(ctx, c.historyRequest(http.MethodPost, projectName, "restore", strconv.Itoa(rev), filePath)); err != nil {
+		return fmt.Errorf("RestoreFileRevision: %w", err)
+	}
+
+	return nil
+}
+
+// ListFileRevisions returns every revision of a src file, oldest first
+func ListFileRevisions(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, filePath string) ([]server.FileRevision, error) {
+	return globalConfig.Client().ListFileRevisions(ctx, projectConfig.ProjectName, filePath)
+}
+
+// FetchFileRevision copies the contents of one revision of a src file
+// to writer
+func FetchFileRevision(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, filePath string, rev int, writer io.Writer) error {
+	return globalConfig.Client().FetchFileRevision(ctx, projectConfig.ProjectName, filePath, rev, writer)
+}
+
+// DiffFileRevisions returns a unified diff between two revisions of a
+// text src file
+func DiffFileRevisions(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, filePath string, from, to int) (string, error) {
+	return globalConfig.Client().DiffFileRevisions(ctx, projectConfig.ProjectName, filePath, from, to)
+}
+
+// RestoreFileRevision makes an earlier revision of a src file current
+// on the server and pulls it into the local project
+func RestoreFileRevision(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, filePath string, rev int) error {
+	if err := globalConfig.Client().RestoreFileRevision(ctx, projectConfig.ProjectName, filePath, rev); err != nil {
+		return err
+	}
+
+	if _, err := PullProjectFile(ctx, globalConfig, projectConfig, projectRoot, "src", filePath); err != nil {
+		return fmt.Errorf("RestoreFileRevision: %w", err)
+	}
+
+	return nil
+}
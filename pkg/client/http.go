@@ -0,0 +1,266 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPOptions configures how requests are sent to the server. A zero
+// timeout means no timeout.
+type HTTPOptions struct {
+	ConnectTimeout time.Duration // Dialing and the TLS handshake
+	ResponseHeaderTimeout time.Duration // Waiting for a response once the request is sent
+	Timeout time.Duration // A whole request, including reading the response
+	MaxRetries int // How many times a failed idempotent request is sent again
+	RetryBackoff time.Duration // The wait before the first retry, doubled for each one after
+	MaxRetryBackoff time.Duration // The longest wait between retries
+}
+
+// DefaultHTTPOptions returns the options requests are sent with unless
+// they're changed. Builds can run for a long time before the server
+// responds, so only connecting has a timeout.
+func DefaultHTTPOptions() HTTPOptions {
+	return HTTPOptions{
+		ConnectTimeout: 10 * time.Second,
+		MaxRetries: 3,
+		RetryBackoff: 250 * time.Millisecond,
+		MaxRetryBackoff: 8 * time.Second,
+	}
+}
+
+// StatusError is returned when the server answers a request with a
+// status code it wasn't expected to
+type StatusError struct {
+	StatusCode int
+	Message string // The start of the response body, if it had one
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected status code %d: %s", e.StatusCode, e.Message)
+}
+
+// Temporary reports whether the same request might succeed later
+func (e *StatusError) Temporary() bool {
+	return isTransientStatus(e.StatusCode)
+}
+
+// newStatusError reads the start of a response's body into a
+// StatusError. The caller still closes the body.
+func newStatusError(resp *http.Response) *StatusError {
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Message: strings.TrimSpace(string(message)),
+	}
+}
+
+// ConnectionError is returned when a request couldn't get a response
+// from the server, after any retries
+type ConnectionError struct {
+	Attempts int
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("connection failed after %d attempts: %s", e.Attempts, e.Err)
+	}
+	return fmt.Sprintf("connection failed: %s", e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPClient sends requests to the server, decompressing responses and
+// retrying idempotent requests that fail in ways that might not last
+type HTTPClient struct {
+	client *http.Client
+	transport *compressionTransport
+	options HTTPOptions
+}
+
+// NewHTTPClient returns a client that sends requests with options,
+// through any proxy set in the environment
+func NewHTTPClient(options HTTPOptions) *HTTPClient {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.Proxy = http.ProxyFromEnvironment
+	base.DialContext = (&net.Dialer{
+		Timeout: options.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	base.TLSHandshakeTimeout = options.ConnectTimeout
+	base.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+
+	return WrapHTTPClient(&http.Client{ Transport: base, Timeout: options.Timeout }, options)
+}
+
+// WrapHTTPClient returns a client that sends requests through client,
+// retrying them as options say. Only options' retry settings are
+// used, client's own transport and timeout are kept. client isn't
+// changed.
+func WrapHTTPClient(client *http.Client, options HTTPOptions) *HTTPClient {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	transport := &compressionTransport{
+		base: base,
+		requestEncodings: make(map[string]string),
+	}
+
+	wrapped := *client
+	wrapped.Transport = transport
+
+	return &HTTPClient{
+		client: &wrapped,
+		transport: transport,
+		options: options,
+	}
+}
+
+// httpClient is used for all requests to the server
+var httpClient = NewHTTPClient(DefaultHTTPOptions())
+
+// SetHTTPOptions changes the options all later requests are sent with.
+// It isn't safe to call while requests are being sent.
+func SetHTTPOptions(options HTTPOptions) {
+	httpClient = NewHTTPClient(options)
+}
+
+// Do sends a request. Idempotent requests whose bodies can be sent
+// again are retried with exponential backoff when the connection fails
+// or the server is briefly unavailable. Conditional changes are only
+// retried when the server refused them, since one that was applied
+// before its response was lost would fail its precondition when sent
+// again. Errors reaching the server are returned as a ConnectionError.
+func (c *HTTPClient) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	retryable := isIdempotent(req.Method) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+	conditional := isConditionalChange(req)
+
+	for attempt := 1; ; attempt++ {
+		resp, err := c.client.Do(req)
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, fmt.Errorf("HTTPClient do: %w", ctx.Err())
+		}
+
+		transient := err != nil || isTransientStatus(resp.StatusCode)
+		if conditional {
+			transient = err == nil && isRefusedStatus(resp.StatusCode)
+		}
+		if !retryable || !transient || attempt > c.options.MaxRetries {
+			if err != nil {
+				return nil, &ConnectionError{ Attempts: attempt, Err: err }
+			}
+			return resp, nil
+		}
+
+		wait := c.backoff(attempt)
+		if resp != nil {
+			if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && retryAfter >= 0 {
+				wait = min(time.Duration(retryAfter) * time.Second, c.options.MaxRetryBackoff)
+			}
+			// Reading the rest of the body lets the connection be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("HTTPClient do: %w", ctx.Err())
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("HTTPClient get body: %w", err)
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// requestEncoding returns the coding to compress request bodies sent
+// to a URL with, or an empty string if its server isn't known to
+// accept any
+func (c *HTTPClient) requestEncoding(rawUrl string) string {
+	return c.transport.requestEncoding(rawUrl)
+}
+
+// backoff returns how long to wait before a retry, doubling for each
+// attempt up to the maximum, with jitter so clients that failed
+// together don't retry together
+func (c *HTTPClient) backoff(attempt int) time.Duration {
+	wait := c.options.RetryBackoff
+	for i := 1; i < attempt && wait < c.options.MaxRetryBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, c.options.MaxRetryBackoff)
+	if wait <= 0 {
+		return 0
+	}
+	return wait / 2 + time.Duration(rand.Int63n(int64(wait / 2) + 1))
+}
+
+// isIdempotent reports whether a request with method can be sent more
+// than once with the same effect as sending it once
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isConditionalChange reports whether a request changes something only
+// if it matches a precondition
+func isConditionalChange(req *http.Request) bool {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return false
+	}
+	return req.Header.Get("If-Match") != "" || req.Header.Get("If-None-Match") != ""
+}
+
+// isRefusedStatus reports whether a status code means the server
+// refused a request without handling it, unlike a gateway error, which
+// can come after the server handled it
+func isRefusedStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// isTransientStatus reports whether a status code means the server
+// couldn't handle a request right now, but might later
+func isTransientStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// IsTemporary reports whether an error from a request to the server
+// might not happen if the request is tried again later
+func IsTemporary(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+	var connErr *ConnectionError
+	return errors.As(err, &connErr)
+}
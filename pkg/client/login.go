@@ -1,52 +1,198 @@
 package client
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
 	"strings"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
 )
 
-func Login(globalConfig GlobalConfig, username, password string) error {
-	loginUrl, err := url.JoinPath(globalConfig.ServerBaseUrl, "login")
+var ErrIncorrectLogin = errors.New("incorrect username or password")
+var ErrSSONotAvailable = errors.New("single sign-on is not available on this server")
+var ErrRegistrationDisabled = errors.New("registration is disabled on this server")
+
+// readToken reads a token from a response body
+func readToken(resp *http.Response) (string, error) {
+	token, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("Login create path: %w", err)
+		return "", fmt.Errorf("readToken: %w", err)
 	}
 
-	hostname, err := os.Hostname()
+	return strings.Trim(string(token), "\n"), nil
+}
+
+// Login exchanges a username and password for a new token, described
+// as description in the user's list of tokens
+func (c *Client) Login(ctx context.Context, username, password, description string) (string, error) {
+	resp, err := c.send(ctx, request{
+		method: http.MethodPost,
+		path: []string{"login"},
+		form: url.Values{
+			"username": { username },
+			"password": { password },
+			"description": { description },
+		},
+		errors: map[int]error{ http.StatusUnauthorized: ErrIncorrectLogin },
+	})
+	if err != nil {
+		return "", fmt.Errorf("Login: %w", err)
+	}
+	defer resp.Body.Close()
+
+	token, err := readToken(resp)
 	if err != nil {
-		fmt.Errorf("Login get hostname: %w", err)
+		return "", fmt.Errorf("Login: %w", err)
 	}
 
-	form := url.Values{}
-	form["username"] = []string{ username }
-	form["password"] = []string{ password }
-	form["description"] = []string{ fmt.Sprintf("%s - %s", runtime.GOOS, hostname) }
+	return token, nil
+}
 
-	resp, err := http.PostForm(loginUrl, form)
+// Register creates a new account using an invitation code, and
+// returns a token for it
+func (c *Client) Register(ctx context.Context, code, username, password, description string) (string, error) {
+	resp, err := c.send(ctx, request{
+		method: http.MethodPost,
+		path: []string{"register"},
+		form: url.Values{
+			"code": { code },
+			"username": { username },
+			"password": { password },
+			"description": { description },
+		},
+		errors: map[int]error{
+			http.StatusNotFound: ErrRegistrationDisabled,
+			http.StatusBadRequest: errServerMessage,
+			http.StatusForbidden: errServerMessage,
+			http.StatusConflict: errServerMessage,
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("Login post form: %w", err)
+		return "", fmt.Errorf("Register: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusUnauthorized {
-		return ErrIncorrectLogin
+	token, err := readToken(resp)
+	if err != nil {
+		return "", fmt.Errorf("Register: %w", err)
+	}
+
+	return token, nil
+}
+
+// SSOLoginURL returns the URL to open in a browser to login through the
+// server's single sign-on provider. Once logged in, the browser is
+// redirected to redirectUri with state and a code for ExchangeSSOCode.
+// If link is set, it's a link from SSOLink, and the identity logged in
+// with is linked to the client's user.
+func (c *Client) SSOLoginURL(redirectUri, state, description, link string) (string, error) {
+	loginUrl, err := url.JoinPath(c.baseUrl, "sso", "login")
+	if err != nil {
+		return "", fmt.Errorf("SSOLoginURL create path: %w", err)
+	}
+	query := url.Values{}
+	query.Set("redirect_uri", redirectUri)
+	query.Set("state", state)
+	query.Set("description", description)
+	if link != "" {
+		query.Set("link", link)
 	}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Login unexpected status code %d", resp.StatusCode)
+	return loginUrl + "?" + query.Encode(), nil
+}
+
+// SSOLink asks the server to link the identity of the next single
+// sign-on login to the client's user
+func (c *Client) SSOLink(ctx context.Context) (string, error) {
+	var link server.SSOLink
+	err := c.sendJSON(ctx, request{
+		method: http.MethodPost,
+		path: []string{"sso", "link"},
+		errors: map[int]error{ http.StatusNotFound: ErrSSONotAvailable },
+	}, &link)
+	if err != nil {
+		return "", fmt.Errorf("SSOLink: %w", err)
 	}
 
-	token, err := io.ReadAll(resp.Body)
+	return link.Link, nil
+}
+
+// ExchangeSSOCode exchanges a single sign-on login code for a token
+// and the user it belongs to
+func (c *Client) ExchangeSSOCode(ctx context.Context, code string) (server.SSOToken, error) {
+	var ssoToken server.SSOToken
+	err := c.sendJSON(ctx, request{
+		method: http.MethodPost,
+		path: []string{"sso", "token"},
+		form: url.Values{ "code": { code } },
+		errors: map[int]error{ http.StatusNotFound: ErrSSONotAvailable },
+	}, &ssoToken)
+	if err != nil {
+		return server.SSOToken{}, fmt.Errorf("ExchangeSSOCode: %w", err)
+	}
+
+	return ssoToken, nil
+}
+
+// Logout revokes the client's token. A token that's already invalid
+// isn't an error.
+func (c *Client) Logout(ctx context.Context) error {
+	err := c.sendEmpty(ctx, request{
+		method: http.MethodPost,
+		path: []string{"logout"},
+		accept: []int{ http.StatusUnauthorized },
+	})
+	if err != nil {
+		return fmt.Errorf("Logout: %w", err)
+	}
+
+	return nil
+}
+
+// LogoutAll revokes every one of the user's tokens
+func (c *Client) LogoutAll(ctx context.Context) error {
+	err := c.sendEmpty(ctx, request{
+		method: http.MethodPost,
+		path: []string{"logout_all"},
+		accept: []int{ http.StatusUnauthorized },
+	})
+	if err != nil {
+		return fmt.Errorf("LogoutAll: %w", err)
+	}
+
+	return nil
+}
+
+// tokenDescription describes a token created on this machine
+func tokenDescription() (string, error) {
+	hostname, err := os.Hostname()
 	if err != nil {
-		return fmt.Errorf("Login read body: %w", err)
+		return "", fmt.Errorf("tokenDescription get hostname: %w", err)
 	}
 
-	globalConfig.Token = strings.Trim(string(token), "\n")
+	return fmt.Sprintf("%s - %s", runtime.GOOS, hostname), nil
+}
+
+func Login(globalConfig GlobalConfig, username, password string) error {
+	description, err := tokenDescription()
+	if err != nil {
+		return fmt.Errorf("Login: %w", err)
+	}
+
+	token, err := globalConfig.Client().Login(context.Background(), username, password, description)
+	if err != nil {
+		return err
+	}
+
+	globalConfig.Token = token
 	globalConfig.User = username
 
 	if err := WriteGlobalConfig(globalConfig); err != nil {
@@ -56,62 +202,129 @@ func Login(globalConfig GlobalConfig, username, password string) error {
 	return nil
 }
 
-var ErrIncorrectLogin = errors.New("incorrect username or password")
-
-func Logout(globalConfig GlobalConfig) error {
-	logoutUrl, err := url.JoinPath(globalConfig.ServerBaseUrl, "logout")
+// LoginSSO logs in through the server's single sign-on provider. It
+// listens on a loopback address, calls openUrl with the URL the user
+// needs to open in their browser, and waits for the browser to be
+// redirected back with a login code. The code is exchanged for a
+// token which is saved to the global config. If link is true, the
+// identity logged in with is linked to the user that's logged in.
+func LoginSSO(ctx context.Context, globalConfig GlobalConfig, link bool, openUrl func(string)) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		return fmt.Errorf("Logout create url: %w", err)
+		return fmt.Errorf("LoginSSO listen: %w", err)
+	}
+	defer listener.Close()
+
+	stateBytes := make([]byte, 16)
+	if _, err := rand.Read(stateBytes); err != nil {
+		return fmt.Errorf("LoginSSO read random: %w", err)
 	}
+	state := fmt.Sprintf("%x", stateBytes)
 
-	req, err := http.NewRequest(http.MethodPost, logoutUrl, nil)
+	description, err := tokenDescription()
 	if err != nil {
-		return fmt.Errorf("Logout create request: %w", err)
+		return fmt.Errorf("LoginSSO: %w", err)
+	}
+
+	redirectUri := fmt.Sprintf("http://%s/callback", listener.Addr().String())
+
+	apiClient := globalConfig.Client()
+
+	var linkCode string
+	if link {
+		linkCode, err = apiClient.SSOLink(ctx)
+		if err != nil {
+			return fmt.Errorf("LoginSSO: %w", err)
+		}
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", globalConfig.Token))
 
-	resp, err := http.DefaultClient.Do(req)
+	loginUrl, err := apiClient.SSOLoginURL(redirectUri, state, description + " (sso)", linkCode)
 	if err != nil {
-		return fmt.Errorf("Logout do request: %w", err)
+		return fmt.Errorf("LoginSSO: %w", err)
 	}
-	defer resp.Body.Close()
 
-	// Unauthorized is invalid auth token, we can clear it and return success
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
-		return fmt.Errorf("Logout unexpected status code %d", resp.StatusCode)
+	codes := make(chan string, 1)
+	srv := http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/callback" || r.URL.Query().Get("state") != state {
+				http.Error(w, "invalid login callback", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintln(w, "Logged in, you can close this window and return to the terminal.")
+			select {
+			case codes <- r.URL.Query().Get("code"):
+			default:
+			}
+		}),
 	}
+	go srv.Serve(listener)
+	defer srv.Close()
 
-	globalConfig.Token = ""
-	globalConfig.User = ""
+	openUrl(loginUrl)
+
+	var code string
+	select {
+	case code = <-codes:
+	case <-ctx.Done():
+		return fmt.Errorf("LoginSSO waiting for browser: %w", ctx.Err())
+	}
+
+	ssoToken, err := apiClient.ExchangeSSOCode(ctx, code)
+	if err != nil {
+		return fmt.Errorf("LoginSSO: %w", err)
+	}
+
+	globalConfig.Token = ssoToken.Token
+	globalConfig.User = ssoToken.Username
 
 	if err := WriteGlobalConfig(globalConfig); err != nil {
-		return fmt.Errorf("Logout write global config: %w", err)
+		return fmt.Errorf("LoginSSO write config: %w", err)
 	}
 
 	return nil
 }
 
-func LogoutAll(globalConfig GlobalConfig) error {
-	logoutUrl, err := url.JoinPath(globalConfig.ServerBaseUrl, "logout_all")
+// Register creates a new account using an invitation code and saves
+// the returned token to the global config, logging the user in
+func Register(globalConfig GlobalConfig, code, username, password string) error {
+	description, err := tokenDescription()
 	if err != nil {
-		return fmt.Errorf("LogoutAll create url: %w", err)
+		return fmt.Errorf("Register: %w", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, logoutUrl, nil)
+	token, err := globalConfig.Client().Register(context.Background(), code, username, password, description)
 	if err != nil {
-		return fmt.Errorf("LogoutAll create request: %w", err)
+		return err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", globalConfig.Token))
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("LogoutAll do request: %w", err)
+	globalConfig.Token = token
+	globalConfig.User = username
+
+	if err := WriteGlobalConfig(globalConfig); err != nil {
+		return fmt.Errorf("Register write config: %w", err)
+	}
+
+	return nil
+}
+
+func Logout(globalConfig GlobalConfig) error {
+	if err := globalConfig.Client().Logout(context.Background()); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
 
-	// Unauthorized is invalid auth token, we can clear it and return success
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
-		return fmt.Errorf("LogoutAll unexpected status code %d", resp.StatusCode)
+	globalConfig.Token = ""
+	globalConfig.User = ""
+
+	if err := WriteGlobalConfig(globalConfig); err != nil {
+		return fmt.Errorf("Logout write global config: %w", err)
+	}
+
+	return nil
+}
+
+func LogoutAll(globalConfig GlobalConfig) error {
+	if err := globalConfig.Client().LogoutAll(context.Background()); err != nil {
+		return err
 	}
 
 	globalConfig.Token = ""
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
+)
+
+var ErrFileNotFound = server.ErrFileNotFound
+var ErrFileExists = server.ErrFileExists
+
+// MoveRemoteProjectFile moves or renames a src file or directory on the
+// server without uploading it again, if the file being moved matches
+// precondition
+func MoveRemoteProjectFile(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, from, to string, precondition server.FilePrecondition) error {
+	return globalConfig.Client().MoveFile(ctx, projectConfig.ProjectName, from, to, precondition)
+}
+
+// MoveLocalProjectFile moves or renames a file or directory within a
+// project subdir, removing any directories it leaves empty
+func MoveLocalProjectFile(projectRoot, subdir, from, to string) error {
+	if strings.Contains(from, "../") || strings.Contains(to, "../") {
+		return errors.New("path contains parent directory traversal")
+	}
+
+	topDirPath := filepath.Join(projectRoot, subdir)
+	fromPath := filepath.Join(topDirPath, filepath.FromSlash(from))
+	toPath := filepath.Join(topDirPath, filepath.FromSlash(to))
+
+	if fromPath == topDirPath || toPath == topDirPath {
+		return errors.New("path is just the top level directory")
+	}
+
+	if _, err := os.Lstat(fromPath); errors.Is(err, fs.ErrNotExist) {
+		return ErrFileNotFound
+	}
+	if _, err := os.Lstat(toPath); err == nil {
+		return ErrFileExists
+	}
+
+	if err := os.MkdirAll(filepath.Dir(toPath), 0700); err != nil {
+		return fmt.Errorf("MoveLocalProjectFile MkdirAll: %w", err)
+	}
+
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return fmt.Errorf("MoveLocalProjectFile rename: %w", err)
+	}
+
+	if err := server.RemoveEmptyDirs(filepath.Dir(fromPath), topDirPath); err != nil {
+		return fmt.Errorf("MoveLocalProjectFile: %w", err)
+	}
+
+	return nil
+}
+
+// MoveProjectFile moves or renames a src file or directory on the
+// server, then the local copy if there is one
+func MoveProjectFile(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, from, to string) error {
+	if err := MoveRemoteProjectFile(ctx, globalConfig, projectConfig, from, to, server.FilePrecondition{}); err != nil {
+		return fmt.Errorf("MoveProjectFile: %w", err)
+	}
+
+	err := MoveLocalProjectFile(projectRoot, "src", from, to)
+	if err != nil && !errors.Is(err, ErrFileNotFound) {
+		return fmt.Errorf("MoveProjectFile: %w", err)
+	}
+
+	return nil
+}
@@ -1,21 +1,19 @@
 package client
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/dantecatalfamo/remotex/pkg/server"
@@ -58,68 +56,55 @@ func NewProject(ctx context.Context, globalConfig GlobalConfig, projectName, pro
 	return nil
 }
 
-func CreateRemoteProject(ctx context.Context, globalConfig GlobalConfig, projectName string) error {
-	userUrl, err := url.JoinPath(globalConfig.ServerBaseUrl, globalConfig.User)
-	if err != nil {
-		return fmt.Errorf("CreateRemoteProject join url: %w", err)
-	}
-
-	form := url.Values{}
-	form["project"] = []string{projectName}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, userUrl, strings.NewReader(form.Encode()))
-	if err != nil {
-		return fmt.Errorf("CreateRemoteProject create request: %w", err)
-	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", globalConfig.Token))
-
-	resp, err := http.DefaultClient.Do(req)
+// CreateProject creates an empty project
+func (c *Client) CreateProject(ctx context.Context, projectName string) error {
+	err := c.sendEmpty(ctx, request{
+		method: http.MethodPost,
+		path: []string{ c.user },
+		form: url.Values{ "project": { projectName } },
+	})
 	if err != nil {
-		return fmt.Errorf("CreateRemoteProject do request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("CreateRemoteProject unexpected status code %d", resp.StatusCode)
+		return fmt.Errorf("CreateProject: %w", err)
 	}
 
 	return nil
 }
 
-func FetchProjectInfo(ctx context.Context, globalConfig GlobalConfig, projectName string) (server.ProjectInfo, error) {
-	projectUrl, err := url.JoinPath(globalConfig.ServerBaseUrl, globalConfig.User, projectName)
-	if err != nil {
-		return server.ProjectInfo{}, fmt.Errorf("FetchProjectInfo path join: %w", err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, projectUrl, nil)
-	if err != nil {
-		return server.ProjectInfo{}, fmt.Errorf("FetchProjectInfo create request: %w", err)
-	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", globalConfig.Token))
+func CreateRemoteProject(ctx context.Context, globalConfig GlobalConfig, projectName string) error {
+	return globalConfig.Client().CreateProject(ctx, projectName)
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// ProjectInfo returns a project's settings and latest build
+func (c *Client) ProjectInfo(ctx context.Context, projectName string) (server.ProjectInfo, error) {
+	var projectInfo server.ProjectInfo
+	err := c.sendJSON(ctx, request{
+		method: http.MethodGet,
+		path: []string{ c.user, projectName },
+		errors: map[int]error{ http.StatusNotFound: ErrProjectNotExist },
+	}, &projectInfo)
 	if err != nil {
-		return server.ProjectInfo{}, fmt.Errorf("FetchProjectInfo http get: %w", err)
+		return server.ProjectInfo{}, fmt.Errorf("ProjectInfo: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == 404 {
-		return server.ProjectInfo{}, ErrProjectNotExist
-	}
+	return projectInfo, nil
+}
 
-	if resp.StatusCode != 200 {
-		return server.ProjectInfo{}, fmt.Errorf("unecpected status code %d", resp.StatusCode)
+// DeleteProject moves a project to the trash
+func (c *Client) DeleteProject(ctx context.Context, projectName string) error {
+	err := c.sendEmpty(ctx, request{
+		method: http.MethodDelete,
+		path: []string{ c.user, projectName },
+		errors: map[int]error{ http.StatusNotFound: ErrProjectNotExist },
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteProject: %w", err)
 	}
 
-	var projectInfo server.ProjectInfo
-
-	if err := json.NewDecoder(resp.Body).Decode(&projectInfo); err != nil {
-		return server.ProjectInfo{}, fmt.Errorf("FetchProjectInfo decode json: %w", err)
-	}
+	return nil
+}
 
-	return projectInfo, nil
+func FetchProjectInfo(ctx context.Context, globalConfig GlobalConfig, projectName string) (server.ProjectInfo, error) {
+	return globalConfig.Client().ProjectInfo(ctx, projectName)
 }
 
 var ErrProjectExists = errors.New("project already exists")
@@ -201,148 +186,77 @@ func ScanProjectFiles(projectRoot, subdir string) ([]server.FileInfo, error) {
 }
 
 func FetchProjectFileList(ctx context.Context, globalConfig GlobalConfig, projectName, subdir string) ([]server.FileInfo, error) {
-	filesUrl, err := url.JoinPath(globalConfig.ServerBaseUrl, globalConfig.User, projectName, subdir)
-	if err != nil {
-		return nil, fmt.Errorf("FetchProjectFileList join path: %w", err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, filesUrl, nil)
-	if err != nil {
-		return nil, fmt.Errorf("FetchProjectFileList create request: %w", err)
-	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", globalConfig.Token))
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("FetchProjectFileList http get: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == 404 {
-		return nil, ErrProjectNotExist
-	}
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("FetchProjectFileList unecpected status code %d", resp.StatusCode)
-	}
-
-	var fileInfos []server.FileInfo
-
-	if err := json.NewDecoder(resp.Body).Decode(&fileInfos); err != nil {
-		return nil, fmt.Errorf("FetchProjectFileList decode json: %w", err)
-	}
-
-	return fileInfos, nil
+	return globalConfig.Client().ListFiles(ctx, projectName, subdir)
 }
 
 func PullProjectFile(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir, filePath string) (int64, error) {
-	fileUrl, err := url.JoinPath(globalConfig.ServerBaseUrl, globalConfig.User, projectConfig.ProjectName, subdir, filePath)
-	if err != nil {
-		return 0, fmt.Errorf("PullProjectFile join url: %w", err)
-	}
+	return pullProjectFile(ctx, globalConfig, projectConfig, projectRoot, subdir, filePath, nil)
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileUrl, nil)
-	if err != nil {
-		return 0, fmt.Errorf("PullProjectFile create request object: %w", err)
+// pullProjectFile downloads a file, telling progress about the bytes
+// received if it isn't nil
+func pullProjectFile(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir, filePath string, progress Progress) (int64, error) {
+	// There's nothing to download if the local copy is already up to
+	// date
+	var localSum string
+	localPath := filepath.Join(projectRoot, subdir, filePath)
+	if localData, err := os.ReadFile(localPath); err == nil {
+		localSum = fmt.Sprintf("%x", sha256.Sum256(localData))
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", globalConfig.Token))
 
-	resp, err := http.DefaultClient.Do(req)
+	contents, err := globalConfig.Client().OpenFile(ctx, projectConfig.ProjectName, subdir, filePath, localSum)
+	if errors.Is(err, ErrNotModified) {
+		return 0, nil
+	}
 	if err != nil {
-		return 0, fmt.Errorf("PullProjectFile do request: %w", err)
+		return 0, fmt.Errorf("pullProjectFile: %w", err)
 	}
-	defer resp.Body.Close()
+	defer contents.Close()
 
-	if resp.StatusCode != 200 {
-		return 0, fmt.Errorf("PullProjectFile unexpected error code %d", resp.StatusCode)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0700); err != nil {
+		return 0, fmt.Errorf("pullProjectFile create dirs: %w", err)
 	}
-
-	localPath := filepath.Join(projectRoot, subdir, filePath)
 	file, err := os.Create(localPath)
 	if err != nil {
-		return 0, fmt.Errorf("PullProjectFile create file: %w", err)
+		return 0, fmt.Errorf("pullProjectFile create file: %w", err)
 	}
 	defer file.Close()
 
-	size, err := io.Copy(file, resp.Body)
+	size, err := io.Copy(file, withProgress(contents, progress))
 	if err != nil {
-		return 0, fmt.Errorf("PullProjectFile write file: %w", err)
+		return 0, fmt.Errorf("pullProjectFile write file: %w", err)
 	}
 
 	return size, nil
 }
 
-func PushProjectFile(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir, filePath string) (int64, error) {
-	subdirUrl, err := url.JoinPath(globalConfig.ServerBaseUrl, globalConfig.User, projectConfig.ProjectName, subdir)
-	if err != nil {
-		return 0, fmt.Errorf("PushProjectFile join url: %w", err)
+// PushProjectFile uploads a file, if the file it replaces on the server
+// matches precondition
+func PushProjectFile(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir, filePath string, precondition server.FilePrecondition) (int64, error) {
+	return uploadProjectFile(ctx, globalConfig, projectConfig, projectRoot, subdir, filePath, precondition, nil)
+}
+
+// uploadProjectFile uploads a file, telling progress about the bytes
+// sent if it isn't nil
+func uploadProjectFile(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir, filePath string, precondition server.FilePrecondition, progress Progress) (int64, error) {
+	if subdir != "src" {
+		return 0, fmt.Errorf("uploadProjectFile can't upload to %s", subdir)
 	}
 
 	localPath := filepath.Join(projectRoot, subdir, filePath)
 	file, err := os.Open(localPath)
 	if err != nil {
-		return 0, fmt.Errorf("PushProjectFile open file: %w", err)
+		return 0, fmt.Errorf("uploadProjectFile open file: %w", err)
 	}
 	defer file.Close()
 
-	body := new(bytes.Buffer)
-	form := multipart.NewWriter(body)
-	part, err := form.CreateFormFile("file", filepath.Base(filePath))
-	if err != nil {
-		return 0, fmt.Errorf("PushProjectFile create form file: %w", err)
-	}
-	size, err := io.Copy(part, file)
-	if err != nil {
-		return 0, fmt.Errorf("PushProjectFile write form file: %w", err)
-	}
-	pathWriter, err := form.CreateFormField("path")
-	if err != nil {
-		return 0, fmt.Errorf("PushProjectFile create form path: %w", err)
-	}
-	if _, err := fmt.Fprint(pathWriter, filePath); err != nil {
-		return 0, fmt.Errorf("PushProjectFile write form path: %w", err)
-	}
-	form.Close()
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subdirUrl, body)
-	req.Header.Add("Content-Type", form.FormDataContentType())
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", globalConfig.Token))
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return 0, fmt.Errorf("PushProjectFile send post request: %w", err)
-	}
-
-	if resp.StatusCode != 200 {
-		return 0, fmt.Errorf("PushProjectFile unexpected status code %d", resp.StatusCode)
-	}
-
-	return size, nil
+	return globalConfig.Client().uploadFile(ctx, projectConfig.ProjectName, filePath, file, precondition, progress)
 }
 
-func DeleteRemoteProjectFile(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, subdir, filePath string) error {
-	fileUrl, err := url.JoinPath(globalConfig.ServerBaseUrl, globalConfig.User, projectConfig.ProjectName, subdir, filePath)
-	if err != nil {
-		return fmt.Errorf("DeleteRemoteProjectFile join url: %w", err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fileUrl, nil)
-	if err != nil {
-		return fmt.Errorf("DeleteRemoteProjectFile create request: %w", err)
-	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", globalConfig.Token))
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("DeleteRemoteProjectFile do request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Unexpected status code: %d", resp.StatusCode)
-	}
-
-	return nil
+// DeleteRemoteProjectFile deletes a src file on the server, if it
+// matches precondition
+func DeleteRemoteProjectFile(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, filePath string, precondition server.FilePrecondition) error {
+	return globalConfig.Client().DeleteFile(ctx, projectConfig.ProjectName, filePath, precondition)
 }
 
 func DeleteLocalProjectFile(projectRoot, subdir, filePath string) error {
@@ -395,52 +309,78 @@ func DeleteLocalProjectFile(projectRoot, subdir, filePath string) error {
 	return nil
 }
 
-func PushProjectFilesChanges(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir string) error {
-	localFiles, err := ScanProjectFiles(projectRoot, subdir)
-	if err != nil {
-		return fmt.Errorf("PushProjectFilesChanges scan local files: %w", err)
-	}
-	remoteFiles, err := FetchProjectFileList(ctx, globalConfig, projectConfig.ProjectName, subdir)
+// PushProjectFilesChanges sends the local changes to a subdir since the
+// last sync to the server, and returns what was sent. Remote changes
+// are left for a later pull or sync, and conflicting changes are
+// returned as an error.
+func PushProjectFilesChanges(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir string, options SyncOptions) (SyncPlan, error) {
+	options.Mode = SyncPush
+	plan, err := SyncProjectFiles(ctx, globalConfig, projectConfig, projectRoot, subdir, options)
 	if err != nil {
-		return fmt.Errorf("PushProjectFilesChanges scan remote files: %w", err)
+		return plan, fmt.Errorf("PushProjectFilesChanges: %w", err)
 	}
-	diff := DiffFileInfoLists(remoteFiles, localFiles)
-	for _, deleted := range diff.Removed {
-		if err := DeleteRemoteProjectFile(ctx, globalConfig, projectConfig, subdir, deleted.Path); err != nil {
-			return fmt.Errorf("PushProjectFilesChanges delete remote file %s: %w", deleted.Path, err)
-		}
-	}
-	for _, added := range diff.Added {
-		if _, err := PushProjectFile(ctx, globalConfig, projectConfig, projectRoot, subdir, added.Path); err != nil {
-			return fmt.Errorf("PushProjectFilesChanges upload file %s: %w", added.Path, err)
-		}
+
+	if len(plan.Conflicts) > 0 {
+		return plan, fmt.Errorf("PushProjectFilesChanges: %w", SyncConflictsError(plan.Conflicts))
 	}
 
-	return nil
+	return plan, nil
 }
 
-func PullProjectFilesChanges(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir string) error {
+// PullProjectFilesChanges makes a local subdir the same as the
+// server's, and returns what was changed. Only the server changes aux
+// and out, so unlike src there's nothing to push or conflict with.
+func PullProjectFilesChanges(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir string, options SyncOptions) (FileInfoDiff, error) {
 	localFiles, err := ScanProjectFiles(projectRoot, subdir)
 	if err != nil {
-		return fmt.Errorf("PullProjectFilesChanges scan local files: %w", err)
+		return FileInfoDiff{}, fmt.Errorf("PullProjectFilesChanges scan local files: %w", err)
 	}
 	remoteFiles, err := FetchProjectFileList(ctx, globalConfig, projectConfig.ProjectName, subdir)
 	if err != nil {
-		return fmt.Errorf("PullProjectFilesChanges scan remote files: %w", err)
+		return FileInfoDiff{}, fmt.Errorf("PullProjectFilesChanges scan remote files: %w", err)
 	}
 	diff := DiffFileInfoLists(localFiles, remoteFiles)
+
+	// Changed files are overwritten when they're pulled, only files
+	// missing remotely are deleted
+	pulled := make(map[string]bool)
+	for _, added := range diff.Added {
+		pulled[added.Path] = true
+	}
+	var deleted []server.FileInfo
+	for _, removed := range diff.Removed {
+		if !pulled[removed.Path] && !options.NoDelete {
+			deleted = append(deleted, removed)
+		}
+	}
+	diff.Removed = deleted
+	diff.Same = nil
+
+	if options.DryRun {
+		return diff, nil
+	}
+
+	for _, moved := range diff.Moved {
+		if err := MoveLocalProjectFile(projectRoot, subdir, moved.From.Path, moved.To.Path); err != nil {
+			return diff, fmt.Errorf("PullProjectFilesChanges move local file %s: %w", moved.From.Path, err)
+		}
+	}
 	for _, deleted := range diff.Removed {
 		if err := DeleteLocalProjectFile(projectRoot, subdir, deleted.Path); err != nil {
-			return fmt.Errorf("PullProjectFilesChanges delete local file %s: %w", deleted.Path, err)
+			return diff, fmt.Errorf("PullProjectFilesChanges delete local file %s: %w", deleted.Path, err)
 		}
 	}
-	for _, added := range diff.Added {
-		if _, err := PullProjectFile(ctx, globalConfig, projectConfig, projectRoot, subdir, added.Path); err != nil {
+	err = transferFiles(ctx, options.parallelism(globalConfig), options.Progress, diff.Added, func(ctx context.Context, added server.FileInfo) error {
+		if _, err := pullProjectFile(ctx, globalConfig, projectConfig, projectRoot, subdir, added.Path, options.Progress); err != nil {
 			return fmt.Errorf("PullProjectFilesChanges pull remote file %s: %w", added.Path, err)
 		}
+		return nil
+	})
+	if err != nil {
+		return diff, err
 	}
 
-	return nil
+	return diff, nil
 }
 
 type FileInfoMove struct {
@@ -452,10 +392,10 @@ type FileInfoDiff struct {
 	Removed []server.FileInfo
 	Added []server.FileInfo
 	Same []server.FileInfo
+	Moved []FileInfoMove
 }
 
 func DiffFileInfoLists(original []server.FileInfo, other []server.FileInfo) FileInfoDiff {
-	// TODO doesn't handle moved files, but neither does the server (for now)
 	var removed []server.FileInfo
 	var added []server.FileInfo
 	var same []server.FileInfo
@@ -482,81 +422,88 @@ outerAdded:
 		added = append(added, otherFile)
 	}
 
+	removed, added, moved := findMovedFiles(original, other, removed, added)
+
 	return FileInfoDiff{
 		Removed: removed,
 		Added: added,
 		Same: same,
+		Moved: moved,
 	}
 }
 
-func BuildProject(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig) (string, error) {
-	buildUrl, err := url.JoinPath(globalConfig.ServerBaseUrl, globalConfig.User, projectConfig.ProjectName, "build")
-	if err != nil {
-		return "", fmt.Errorf("BuildProject join url: %w", err)
-	}
-
-	// XXX keep up to date with build options!
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, buildUrl, nil)
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", globalConfig.Token))
-	query := req.URL.Query()
-
-	if projectConfig.BuildOptions.CleanBuild {
-		query.Add("cleanBuild", "true")
-	}
-
-	if projectConfig.BuildOptions.Dependents {
-		query.Add("dependents", "true")
-	}
-
-	if projectConfig.BuildOptions.Document != "" {
-		query.Add("document", projectConfig.BuildOptions.Document)
-	}
-
-	if projectConfig.BuildOptions.Engine != "" {
-		query.Add("engine", string(projectConfig.BuildOptions.Engine))
+// findMovedFiles pairs up removed and added files with the same
+// contents, which were moved rather than deleted and created again.
+// A path in both lists was changed, so it's neither the source nor
+// destination of a move. The removed and added files left over are
+// returned with the moves.
+func findMovedFiles(original, other, removed, added []server.FileInfo) ([]server.FileInfo, []server.FileInfo, []FileInfoMove) {
+	originalPaths := make(map[string]bool)
+	for _, origFile := range original {
+		originalPaths[origFile.Path] = true
 	}
-
-	if projectConfig.BuildOptions.FileLineError {
-		query.Add("fileLineError", "true")
+	otherPaths := make(map[string]bool)
+	for _, otherFile := range other {
+		otherPaths[otherFile.Path] = true
+	}
+
+	var moved []FileInfoMove
+	var stillRemoved []server.FileInfo
+	destinations := make(map[int]bool)
+
+outerMoved:
+	for _, removedFile := range removed {
+		if !otherPaths[removedFile.Path] {
+			for i, addedFile := range added {
+				if destinations[i] || originalPaths[addedFile.Path] || addedFile.Sha256Sum != removedFile.Sha256Sum {
+					continue
+				}
+				destinations[i] = true
+				moved = append(moved, FileInfoMove{ From: removedFile, To: addedFile })
+				continue outerMoved
+			}
+		}
+		stillRemoved = append(stillRemoved, removedFile)
 	}
 
-	if projectConfig.BuildOptions.Force {
-		query.Add("force", "true")
+	var stillAdded []server.FileInfo
+	for i, addedFile := range added {
+		if !destinations[i] {
+			stillAdded = append(stillAdded, addedFile)
+		}
 	}
 
-	req.URL.RawQuery = query.Encode()
+	return stillRemoved, stillAdded, moved
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// SetProjectVisibility makes a project public or private
+func (c *Client) SetProjectVisibility(ctx context.Context, projectName string, public bool) error {
+	err := c.sendEmpty(ctx, request{
+		method: http.MethodPost,
+		path: []string{ c.user, projectName, "visibility" },
+		form: url.Values{ "public": { strconv.FormatBool(public) } },
+	})
 	if err != nil {
-		return "", fmt.Errorf("BuildProject http do: %w", err)
+		return fmt.Errorf("SetProjectVisibility: %w", err)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnprocessableEntity {
-		// something wrong
-		return "", fmt.Errorf("BuildProject unexpected http status code: %d", resp.StatusCode)
-	}
-
-	var outBuf bytes.Buffer
-	if _, err := io.Copy(&outBuf, resp.Body); err != nil {
-		return "", fmt.Errorf("BuildProject copy buffer: %w", err)
- 	}
 
-	if resp.StatusCode == http.StatusUnprocessableEntity {
-		return outBuf.String(), ErrBuildFailure
-	} else if resp.StatusCode == http.StatusConflict {
-		return "", ErrBuildInProgress
-	}
+	return nil
+}
 
-	return outBuf.String(), nil
+// SetProjectVisibility makes a remote project public or private
+func SetProjectVisibility(ctx context.Context, globalConfig GlobalConfig, projectName string, public bool) error {
+	return globalConfig.Client().SetProjectVisibility(ctx, projectName, public)
 }
 
-var ErrBuildFailure = errors.New("build failure")
-var ErrBuildInProgress = server.ErrBuildInProgress
+// BuildAndSyncProject pushes the local src changes, builds the project
+// and pulls its output. Dry runs aren't supported, since what's pulled
+// depends on the build.
+func BuildAndSyncProject(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot string, options SyncOptions) (string, error) {
+	if options.DryRun {
+		return "", errors.New("BuildAndSyncProject can't do a dry run")
+	}
 
-func BuildAndSyncProject(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot string) (string, error) {
-	if err := PushProjectFilesChanges(ctx, globalConfig, projectConfig, projectRoot, "src"); err != nil {
+	if _, err := PushProjectFilesChanges(ctx, globalConfig, projectConfig, projectRoot, "src", options); err != nil {
 		return "", fmt.Errorf("BuildAndSyncProject push src: %w", err)
 	}
 
@@ -569,33 +516,48 @@ func BuildAndSyncProject(ctx context.Context, globalConfig GlobalConfig, project
 	}
 
 	if projectConfig.SaveAuxFiles {
-		if err := PullProjectFilesChanges(ctx, globalConfig, projectConfig, projectRoot, "aux"); err != nil {
+		if _, err := PullProjectFilesChanges(ctx, globalConfig, projectConfig, projectRoot, "aux", options); err != nil {
 			return buildOut, fmt.Errorf("BuildAndSyncProject sync aux: %w", err)
 		}
 	}
 
-	if err := PullProjectFilesChanges(ctx, globalConfig, projectConfig, projectRoot, "out"); err != nil {
+	if _, err := PullProjectFilesChanges(ctx, globalConfig, projectConfig, projectRoot, "out", options); err != nil {
 		return buildOut, fmt.Errorf("BuildAndSyncPrject sync out: %w", err)
 	}
 
 	return buildOut, nil
 }
 
-func PullAllProjectFiles(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot string) error {
-	subdirs := []string{"src", "out"}
+// PullAllProjectFiles pulls the remote changes to every subdir, and
+// returns what was changed in each
+func PullAllProjectFiles(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot string, options SyncOptions) ([]SubdirPlan, error) {
+	// src can be changed locally, so only remote changes are pulled
+	options.Mode = SyncPull
+	plan, err := SyncProjectFiles(ctx, globalConfig, projectConfig, projectRoot, "src", options)
+	plans := []SubdirPlan{ { Subdir: "src", SyncPlan: plan } }
+	if err != nil {
+		return plans, fmt.Errorf("PullAllProjectFiles: %w", err)
+	}
+	if len(plan.Conflicts) > 0 {
+		return plans, fmt.Errorf("PullAllProjectFiles: %w", SyncConflictsError(plan.Conflicts))
+	}
+
+	subdirs := []string{"out"}
 	if projectConfig.SaveAuxFiles {
 		subdirs = append(subdirs, "aux")
 	}
 
 	for _, subdir := range subdirs {
-		if err := PullProjectFilesChanges(ctx, globalConfig, projectConfig, projectRoot, subdir); err != nil {
-			return fmt.Errorf("PullAllProjectFiles: %w", err)
+		diff, err := PullProjectFilesChanges(ctx, globalConfig, projectConfig, projectRoot, subdir, options)
+		plans = append(plans, SubdirPlan{ Subdir: subdir, SyncPlan: SyncPlan{ Pull: diff } })
+		if err != nil {
+			return plans, fmt.Errorf("PullAllProjectFiles: %w", err)
 		}
 	}
-	return nil
+	return plans, nil
 }
 
-func CloneProject(ctx context.Context, globalConfig GlobalConfig, projectName, path string) error {
+func CloneProject(ctx context.Context, globalConfig GlobalConfig, projectName, path string, options SyncOptions) error {
 	projectInfo, err := FetchProjectInfo(ctx, globalConfig, projectName)
 	if err != nil {
 		return fmt.Errorf("CloneProject fetch project info: %w", err)
@@ -634,39 +596,23 @@ func CloneProject(ctx context.Context, globalConfig GlobalConfig, projectName, p
 		return fmt.Errorf("CloneProject write config: %w", err)
 	}
 
-	if err := PullAllProjectFiles(ctx, globalConfig, projectConfig, projectRoot); err != nil {
+	if _, err := PullAllProjectFiles(ctx, globalConfig, projectConfig, projectRoot, options); err != nil {
 		return fmt.Errorf("CloneProject pull files: %w", err)
 	}
 
 	return nil
 }
 
-func FetchUserInfo(ctx context.Context, globalConfig GlobalConfig) (server.UserInfo, error) {
-	userUrl, err := url.JoinPath(globalConfig.ServerBaseUrl, globalConfig.User)
-	if err != nil {
-		return server.UserInfo{}, fmt.Errorf("FetchUserInfo path join: %w", err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, userUrl, nil)
-	if err != nil {
-		return server.UserInfo{}, fmt.Errorf("FetchUserInfo create request: %w", err)
-	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", globalConfig.Token))
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return server.UserInfo{}, fmt.Errorf("FetchUserInfo http get: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return server.UserInfo{}, fmt.Errorf("FetchUserInfo unexpected status code: %d", resp.StatusCode)
-	}
-
+// ListProjects returns the user with their projects
+func (c *Client) ListProjects(ctx context.Context) (server.UserInfo, error) {
 	var userInfo server.UserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		return server.UserInfo{}, fmt.Errorf("FetchUserInfo decode: %w", err)
+	if err := c.sendJSON(ctx, request{ method: http.MethodGet, path: []string{ c.user } }, &userInfo); err != nil {
+		return server.UserInfo{}, fmt.Errorf("ListProjects: %w", err)
 	}
 
 	return userInfo, nil
 }
+
+func FetchUserInfo(ctx context.Context, globalConfig GlobalConfig) (server.UserInfo, error) {
+	return globalConfig.Client().ListProjects(ctx)
+}
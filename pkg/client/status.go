@@ -0,0 +1,169 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
+)
+
+// FileChanges is a diff grouped into the files added, modified, deleted
+// and moved on one side
+type FileChanges struct {
+	Added []string
+	Modified []string
+	Deleted []string
+	Moved []FileInfoMove
+}
+
+// Empty returns true if nothing changed
+func (c FileChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Modified) == 0 && len(c.Deleted) == 0 && len(c.Moved) == 0
+}
+
+// groupChanges groups a diff of other against original. A file added
+// at a path original already has was modified.
+func groupChanges(diff FileInfoDiff, original []server.FileInfo) FileChanges {
+	originalPaths := make(map[string]bool)
+	for _, file := range original {
+		originalPaths[file.Path] = true
+	}
+	addedPaths := make(map[string]bool)
+
+	var changes FileChanges
+	for _, file := range diff.Added {
+		addedPaths[file.Path] = true
+		if originalPaths[file.Path] {
+			changes.Modified = append(changes.Modified, file.Path)
+		} else {
+			changes.Added = append(changes.Added, file.Path)
+		}
+	}
+	for _, file := range diff.Removed {
+		if !addedPaths[file.Path] {
+			changes.Deleted = append(changes.Deleted, file.Path)
+		}
+	}
+	changes.Moved = diff.Moved
+
+	return changes
+}
+
+// ProjectStatus is how a project's local src files differ from the
+// server's. Local changes are what the next build or sync pushes,
+// remote changes are what the next pull or sync brings down.
+type ProjectStatus struct {
+	Local FileChanges
+	Remote FileChanges
+	Conflicts []SyncConflict
+}
+
+// FetchProjectStatus compares the local and remote src files against
+// the last sync, without changing either side
+func FetchProjectStatus(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot string) (ProjectStatus, error) {
+	state, err := ReadSyncState(projectRoot)
+	if err != nil {
+		return ProjectStatus{}, fmt.Errorf("FetchProjectStatus: %w", err)
+	}
+	localFiles, err := ScanProjectFiles(projectRoot, "src")
+	if err != nil {
+		return ProjectStatus{}, fmt.Errorf("FetchProjectStatus scan local files: %w", err)
+	}
+	remoteFiles, err := FetchProjectFileList(ctx, globalConfig, projectConfig.ProjectName, "src")
+	if err != nil {
+		return ProjectStatus{}, fmt.Errorf("FetchProjectStatus scan remote files: %w", err)
+	}
+
+	plan := PlanSync(state.Subdirs["src"], localFiles, remoteFiles)
+
+	return ProjectStatus{
+		Local: groupChanges(plan.Push, remoteFiles),
+		Remote: groupChanges(plan.Pull, localFiles),
+		Conflicts: plan.Conflicts,
+	}, nil
+}
+
+// FetchProjectFile copies the server's copy of a project file to writer
+func FetchProjectFile(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, subdir, filePath string, writer io.Writer) error {
+	return globalConfig.Client().FetchFile(ctx, projectConfig.ProjectName, subdir, filePath, writer)
+}
+
+// DiffProjectFiles returns a unified diff from the remote src files to
+// the local ones, for the files under path that differ, or all of them
+// if path is empty. Files missing on one side are diffed against
+// nothing, and files that aren't text or are too large to diff are
+// only named.
+func DiffProjectFiles(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, path string) (string, error) {
+	localFiles, err := ScanProjectFiles(projectRoot, "src")
+	if err != nil {
+		return "", fmt.Errorf("DiffProjectFiles scan local files: %w", err)
+	}
+	remoteFiles, err := FetchProjectFileList(ctx, globalConfig, projectConfig.ProjectName, "src")
+	if err != nil {
+		return "", fmt.Errorf("DiffProjectFiles scan remote files: %w", err)
+	}
+
+	local := fileInfoMap(localFiles)
+	remote := fileInfoMap(remoteFiles)
+
+	differing := make(map[string]bool)
+	for _, files := range []map[string]*server.FileInfo{ local, remote } {
+		for filePath := range files {
+			if path != "" && filePath != path && !strings.HasPrefix(filePath, strings.TrimSuffix(path, "/") + "/") {
+				continue
+			}
+			if !sameFileInfo(local[filePath], remote[filePath]) {
+				differing[filePath] = true
+			}
+		}
+	}
+	paths := make([]string, 0, len(differing))
+	for filePath := range differing {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+
+	var diff strings.Builder
+
+	for _, filePath := range paths {
+		fromName, toName := "/dev/null", "/dev/null"
+		var from, to []byte
+
+		if remote[filePath] != nil {
+			fromName = "remote/" + filePath
+			var buf bytes.Buffer
+			if err := FetchProjectFile(ctx, globalConfig, projectConfig, "src", filePath, &buf); err != nil {
+				return "", fmt.Errorf("DiffProjectFiles %s: %w", filePath, err)
+			}
+			from = buf.Bytes()
+		}
+
+		if local[filePath] != nil {
+			toName = "local/" + filePath
+			to, err = os.ReadFile(filepath.Join(projectRoot, "src", filepath.FromSlash(filePath)))
+			if err != nil {
+				return "", fmt.Errorf("DiffProjectFiles read local file: %w", err)
+			}
+		}
+
+		if !server.IsText(from) || !server.IsText(to) {
+			fmt.Fprintf(&diff, "Binary files %s and %s differ\n", fromName, toName)
+			continue
+		}
+
+		if server.CheckDiffSize(from) != nil || server.CheckDiffSize(to) != nil {
+			fmt.Fprintf(&diff, "Files %s and %s differ, but are too large to diff\n", fromName, toName)
+			continue
+		}
+
+		diff.WriteString(server.UnifiedDiff(fromName, toName, string(from), string(to), 3))
+	}
+
+	return diff.String(), nil
+}
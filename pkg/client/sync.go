@@ -0,0 +1,510 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
+)
+
+// A project can be edited on more than one machine. Each keeps the
+// files as they were on both sides after its last sync, its base. A
+// file that differs from the base locally but not remotely was changed
+// here and is pushed, one that differs remotely but not locally was
+// changed elsewhere and is pulled. One that differs on both sides is a
+// conflict, and is left alone until it's resolved. Changes to remote
+// files are only made if the file is still what it was when the plan
+// was made, so a push from another machine in between isn't lost.
+
+const SyncStateName = ".remotex-sync.json"
+
+var ErrRemoteChanged = server.ErrPreconditionFailed
+var ErrSyncConflict = errors.New("local and remote changes conflict")
+
+// SyncState is the base of each synced subdir
+type SyncState struct {
+	Subdirs map[string][]server.FileInfo `json:"subdirs"`
+}
+
+// ReadSyncState reads a project's sync state. A project that has never
+// been synced has no base for any subdir.
+func ReadSyncState(projectRoot string) (SyncState, error) {
+	state := SyncState{ Subdirs: make(map[string][]server.FileInfo) }
+
+	file, err := os.Open(filepath.Join(projectRoot, SyncStateName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return SyncState{}, fmt.Errorf("ReadSyncState open file: %w", err)
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(&state); err != nil {
+		return SyncState{}, fmt.Errorf("ReadSyncState decode json: %w", err)
+	}
+	if state.Subdirs == nil {
+		state.Subdirs = make(map[string][]server.FileInfo)
+	}
+
+	return state, nil
+}
+
+// subdirBase returns the base of a subdir for a sync in mode. A
+// checkout from before the base was kept has none, so it's seeded with
+// the files on both sides: a file on only one side is sent to the
+// other, never deleted. A file that differs is taken as changed on the
+// side the sync applies, so a first push sends the local copy and a
+// first pull brings down the remote one. A sync both ways can't tell
+// which side changed it, and finds it to be a conflict.
+func (s SyncState) subdirBase(subdir string, mode SyncMode, local, remote []server.FileInfo) []server.FileInfo {
+	if base, ok := s.Subdirs[subdir]; ok {
+		return base
+	}
+
+	remoteFiles := fileInfoMap(remote)
+	base := []server.FileInfo{}
+	for _, localFile := range local {
+		remoteFile := remoteFiles[localFile.Path]
+		if remoteFile == nil {
+			continue
+		}
+		switch mode {
+		case SyncPush:
+			base = append(base, *remoteFile)
+		case SyncPull:
+			base = append(base, localFile)
+		default:
+			// Matches neither side, unless they're the same
+			base = append(base, server.FileInfo{ Path: localFile.Path })
+		}
+	}
+	return base
+}
+
+// WriteSyncState replaces a project's sync state
+func WriteSyncState(projectRoot string, state SyncState) error {
+	file, err := os.CreateTemp(projectRoot, SyncStateName + ".*")
+	if err != nil {
+		return fmt.Errorf("WriteSyncState create file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(state); err != nil {
+		return fmt.Errorf("WriteSyncState encode: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("WriteSyncState close file: %w", err)
+	}
+
+	if err := os.Rename(file.Name(), filepath.Join(projectRoot, SyncStateName)); err != nil {
+		return fmt.Errorf("WriteSyncState rename: %w", err)
+	}
+
+	return nil
+}
+
+// SyncMode is which side's changes a sync applies
+type SyncMode int
+
+const (
+	SyncPush SyncMode = 1 << iota // Send local changes to the server
+	SyncPull // Apply remote changes locally
+	SyncBoth = SyncPush | SyncPull
+)
+
+// ConflictResolution is what a sync does with conflicting files
+type ConflictResolution int
+
+const (
+	ResolveNone ConflictResolution = iota // Leave both sides alone
+	ResolveKeepLocal // Overwrite the remote file with the local one
+	ResolveKeepRemote // Overwrite the local file with the remote one
+)
+
+// SyncOptions changes what a sync does
+type SyncOptions struct {
+	Mode SyncMode
+	Resolution ConflictResolution
+	DryRun bool // Only plan the changes, make none of them
+	NoDelete bool // Never delete files on either side, moves are still made
+	Parallelism int // How many files to transfer at once, or 0 for the default
+	Progress Progress // Told about file transfers, if not nil
+}
+
+// SyncConflict is a file that was changed on both sides since the last
+// sync. Local or Remote is nil if the file was deleted on that side.
+type SyncConflict struct {
+	Path string
+	Reason string
+	Local *server.FileInfo
+	Remote *server.FileInfo
+}
+
+func (c SyncConflict) String() string {
+	return fmt.Sprintf("%s: %s", c.Path, c.Reason)
+}
+
+// SyncPlan is what a sync does to each side. Push is relative to the
+// remote files and Pull to the local ones.
+type SyncPlan struct {
+	Push FileInfoDiff
+	Pull FileInfoDiff
+	Conflicts []SyncConflict
+}
+
+// PlanSync compares the local and remote files to the base from the
+// last sync to work out which side changed each file
+func PlanSync(base, local, remote []server.FileInfo) SyncPlan {
+	baseFiles := fileInfoMap(base)
+	localFiles := fileInfoMap(local)
+	remoteFiles := fileInfoMap(remote)
+
+	paths := make(map[string]bool)
+	for _, files := range []map[string]*server.FileInfo{ baseFiles, localFiles, remoteFiles } {
+		for path := range files {
+			paths[path] = true
+		}
+	}
+	sortedPaths := make([]string, 0, len(paths))
+	for path := range paths {
+		sortedPaths = append(sortedPaths, path)
+	}
+	sort.Strings(sortedPaths)
+
+	var plan SyncPlan
+
+	for _, path := range sortedPaths {
+		baseFile, localFile, remoteFile := baseFiles[path], localFiles[path], remoteFiles[path]
+
+		switch {
+		case sameFileInfo(localFile, remoteFile):
+			continue
+		case sameFileInfo(localFile, baseFile):
+			if remoteFile == nil {
+				plan.Pull.Removed = append(plan.Pull.Removed, *localFile)
+			} else {
+				plan.Pull.Added = append(plan.Pull.Added, *remoteFile)
+			}
+		case sameFileInfo(remoteFile, baseFile):
+			if localFile == nil {
+				plan.Push.Removed = append(plan.Push.Removed, *remoteFile)
+			} else {
+				plan.Push.Added = append(plan.Push.Added, *localFile)
+			}
+		default:
+			plan.Conflicts = append(plan.Conflicts, SyncConflict{
+				Path: path,
+				Reason: conflictReason(baseFile, localFile, remoteFile),
+				Local: localFile,
+				Remote: remoteFile,
+			})
+		}
+	}
+
+	plan.findMoves(local, remote)
+
+	return plan
+}
+
+// resolve turns conflicts into pushes or pulls
+func (p *SyncPlan) resolve(resolution ConflictResolution) {
+	if resolution == ResolveNone {
+		return
+	}
+
+	for _, conflict := range p.Conflicts {
+		if resolution == ResolveKeepLocal {
+			if conflict.Local == nil {
+				p.Push.Removed = append(p.Push.Removed, *conflict.Remote)
+			} else {
+				p.Push.Added = append(p.Push.Added, *conflict.Local)
+			}
+		} else {
+			if conflict.Remote == nil {
+				p.Pull.Removed = append(p.Pull.Removed, *conflict.Local)
+			} else {
+				p.Pull.Added = append(p.Pull.Added, *conflict.Remote)
+			}
+		}
+	}
+	p.Conflicts = nil
+}
+
+// findMoves turns files deleted from one path and added at another on
+// the same side into moves
+func (p *SyncPlan) findMoves(local, remote []server.FileInfo) {
+	p.Push.Removed, p.Push.Added, p.Push.Moved = findMovedFiles(remote, local, p.Push.Removed, p.Push.Added)
+	p.Pull.Removed, p.Pull.Added, p.Pull.Moved = findMovedFiles(local, remote, p.Pull.Removed, p.Pull.Added)
+}
+
+// SubdirPlan is a sync's plan for one project subdir
+type SubdirPlan struct {
+	Subdir string
+	SyncPlan
+}
+
+func conflictReason(base, local, remote *server.FileInfo) string {
+	switch {
+	case local == nil:
+		return "deleted locally, changed remotely"
+	case remote == nil:
+		return "changed locally, deleted remotely"
+	case base == nil:
+		return "added locally and remotely"
+	default:
+		return "changed locally and remotely"
+	}
+}
+
+func fileInfoMap(files []server.FileInfo) map[string]*server.FileInfo {
+	fileMap := make(map[string]*server.FileInfo, len(files))
+	for i := range files {
+		fileMap[files[i].Path] = &files[i]
+	}
+	return fileMap
+}
+
+// sameFileInfo returns true if both files are missing, or both exist
+// with the same contents
+func sameFileInfo(a, b *server.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Sha256Sum == b.Sha256Sum
+}
+
+// SyncConflictsError returns an error listing conflicting files
+func SyncConflictsError(conflicts []SyncConflict) error {
+	descriptions := make([]string, len(conflicts))
+	for i, conflict := range conflicts {
+		descriptions[i] = conflict.String()
+	}
+	return fmt.Errorf("%w: %s", ErrSyncConflict, strings.Join(descriptions, "; "))
+}
+
+// SyncProjectFiles applies the changes made to a subdir on either side
+// since the last sync, as allowed by the options' mode, and records the
+// new base. Conflicts are resolved as the options say, or returned in
+// the plan if they're left alone. A file changed remotely after the
+// plan was made is also returned as a conflict. A dry run returns the
+// plan without changing anything.
+func SyncProjectFiles(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir string, options SyncOptions) (SyncPlan, error) {
+	state, err := ReadSyncState(projectRoot)
+	if err != nil {
+		return SyncPlan{}, fmt.Errorf("SyncProjectFiles: %w", err)
+	}
+	localFiles, err := ScanProjectFiles(projectRoot, subdir)
+	if err != nil {
+		return SyncPlan{}, fmt.Errorf("SyncProjectFiles scan local files: %w", err)
+	}
+	remoteFiles, err := FetchProjectFileList(ctx, globalConfig, projectConfig.ProjectName, subdir)
+	if err != nil {
+		return SyncPlan{}, fmt.Errorf("SyncProjectFiles scan remote files: %w", err)
+	}
+
+	state.Subdirs[subdir] = state.subdirBase(subdir, options.Mode, localFiles, remoteFiles)
+	plan := planSubdirSync(state.Subdirs[subdir], localFiles, remoteFiles, options)
+
+	if options.DryRun {
+		if options.Mode & SyncPush == 0 {
+			plan.Push = FileInfoDiff{}
+		}
+		if options.Mode & SyncPull == 0 {
+			plan.Pull = FileInfoDiff{}
+		}
+		return plan, nil
+	}
+
+	applyErr := applySyncPlan(ctx, globalConfig, projectConfig, projectRoot, subdir, options, &plan, remoteFiles)
+
+	// Whatever was applied is recorded, even if the sync failed part way
+	if err := updateSyncState(ctx, globalConfig, projectConfig, projectRoot, subdir, state); err != nil {
+		return plan, fmt.Errorf("SyncProjectFiles: %w", err)
+	}
+
+	if applyErr != nil {
+		return plan, fmt.Errorf("SyncProjectFiles: %w", applyErr)
+	}
+
+	return plan, nil
+}
+
+// planSubdirSync plans a sync from a subdir's base, with conflicts
+// resolved and deletions left out as the options say
+func planSubdirSync(base, local, remote []server.FileInfo, options SyncOptions) SyncPlan {
+	plan := PlanSync(base, local, remote)
+	plan.resolve(options.Resolution)
+	if options.NoDelete {
+		plan.Push.Removed = nil
+		plan.Pull.Removed = nil
+	}
+	return plan
+}
+
+// applySyncPlan makes the changes in a plan, and leaves only the ones
+// it made in the plan. Remote changes are only made if the remote file
+// is still as it was listed, otherwise the file is added to the plan's
+// conflicts.
+func applySyncPlan(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir string, options SyncOptions, plan *SyncPlan, remoteFiles []server.FileInfo) error {
+	remote := fileInfoMap(remoteFiles)
+
+	remoteChanged := func(path string, local *server.FileInfo) {
+		plan.Conflicts = append(plan.Conflicts, SyncConflict{
+			Path: path,
+			Reason: "changed remotely during sync",
+			Local: local,
+		})
+	}
+
+	if options.Mode & SyncPush != 0 {
+		// Only what was pushed is left in the plan
+		var moves []FileInfoMove
+		var removed, added []server.FileInfo
+
+		for _, moved := range plan.Push.Moved {
+			precondition := server.IfFileMatches(moved.From.Sha256Sum)
+			err := MoveRemoteProjectFile(ctx, globalConfig, projectConfig, moved.From.Path, moved.To.Path, precondition)
+			if errors.Is(err, ErrRemoteChanged) || errors.Is(err, ErrFileExists) {
+				remoteChanged(moved.From.Path, nil)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("applySyncPlan move remote file %s: %w", moved.From.Path, err)
+			}
+			moves = append(moves, moved)
+		}
+		for _, deleted := range plan.Push.Removed {
+			precondition := server.IfFileMatches(deleted.Sha256Sum)
+			err := DeleteRemoteProjectFile(ctx, globalConfig, projectConfig, deleted.Path, precondition)
+			if errors.Is(err, ErrRemoteChanged) {
+				remoteChanged(deleted.Path, nil)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("applySyncPlan delete remote file %s: %w", deleted.Path, err)
+			}
+			removed = append(removed, deleted)
+		}
+
+		// Uploads finish in any order, so they're put back in the plan's
+		pushed := make([]bool, len(plan.Push.Added))
+		index := make(map[string]int)
+		for i, file := range plan.Push.Added {
+			index[file.Path] = i
+		}
+		var mu sync.Mutex
+
+		err := transferFiles(ctx, options.parallelism(globalConfig), options.Progress, plan.Push.Added, func(ctx context.Context, file server.FileInfo) error {
+			// Changed files are overwritten so the server keeps their history
+			precondition := server.IfFileAbsent()
+			if remoteFile, ok := remote[file.Path]; ok {
+				precondition = server.IfFileMatches(remoteFile.Sha256Sum)
+			}
+			_, err := uploadProjectFile(ctx, globalConfig, projectConfig, projectRoot, subdir, file.Path, precondition, options.Progress)
+			if errors.Is(err, ErrRemoteChanged) {
+				local := file
+				mu.Lock()
+				remoteChanged(file.Path, &local)
+				mu.Unlock()
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("applySyncPlan upload file %s: %w", file.Path, err)
+			}
+			mu.Lock()
+			pushed[index[file.Path]] = true
+			mu.Unlock()
+			return nil
+		})
+		for i, file := range plan.Push.Added {
+			if pushed[i] {
+				added = append(added, file)
+			}
+		}
+		plan.Push = FileInfoDiff{ Moved: moves, Removed: removed, Added: added }
+		if err != nil {
+			return err
+		}
+	} else {
+		plan.Push = FileInfoDiff{}
+	}
+
+	if options.Mode & SyncPull != 0 {
+		for _, moved := range plan.Pull.Moved {
+			if err := MoveLocalProjectFile(projectRoot, subdir, moved.From.Path, moved.To.Path); err != nil {
+				return fmt.Errorf("applySyncPlan move local file %s: %w", moved.From.Path, err)
+			}
+		}
+		for _, deleted := range plan.Pull.Removed {
+			if err := DeleteLocalProjectFile(projectRoot, subdir, deleted.Path); err != nil {
+				return fmt.Errorf("applySyncPlan delete local file %s: %w", deleted.Path, err)
+			}
+		}
+		err := transferFiles(ctx, options.parallelism(globalConfig), options.Progress, plan.Pull.Added, func(ctx context.Context, added server.FileInfo) error {
+			if _, err := pullProjectFile(ctx, globalConfig, projectConfig, projectRoot, subdir, added.Path, options.Progress); err != nil {
+				return fmt.Errorf("applySyncPlan pull remote file %s: %w", added.Path, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		plan.Pull = FileInfoDiff{}
+	}
+
+	return nil
+}
+
+// updateSyncState records a subdir's new base. Files that are the same
+// on both sides are in sync, the rest keep their old base until a
+// sync applies or resolves them.
+func updateSyncState(ctx context.Context, globalConfig GlobalConfig, projectConfig ProjectConfig, projectRoot, subdir string, state SyncState) error {
+	localFiles, err := ScanProjectFiles(projectRoot, subdir)
+	if err != nil {
+		return fmt.Errorf("updateSyncState scan local files: %w", err)
+	}
+	remoteFiles, err := FetchProjectFileList(ctx, globalConfig, projectConfig.ProjectName, subdir)
+	if err != nil {
+		return fmt.Errorf("updateSyncState scan remote files: %w", err)
+	}
+
+	baseFiles := fileInfoMap(state.Subdirs[subdir])
+	remote := fileInfoMap(remoteFiles)
+	local := fileInfoMap(localFiles)
+
+	base := []server.FileInfo{}
+	for _, localFile := range localFiles {
+		if sameFileInfo(&localFile, remote[localFile.Path]) {
+			base = append(base, localFile)
+		} else if baseFile, ok := baseFiles[localFile.Path]; ok {
+			base = append(base, *baseFile)
+		}
+	}
+	// Files deleted locally but not remotely haven't been synced
+	for _, baseFile := range state.Subdirs[subdir] {
+		if local[baseFile.Path] == nil && remote[baseFile.Path] != nil {
+			base = append(base, baseFile)
+		}
+	}
+	sort.Slice(base, func(i, j int) bool { return base[i].Path < base[j].Path })
+
+	state.Subdirs[subdir] = base
+	if err := WriteSyncState(projectRoot, state); err != nil {
+		return fmt.Errorf("updateSyncState: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
+)
+
+// files builds a file list from path=sum pairs
+func files(pairs ...string) []server.FileInfo {
+	list := []server.FileInfo{}
+	for _, pair := range pairs {
+		path, sum, _ := strings.Cut(pair, "=")
+		list = append(list, server.FileInfo{ Path: path, Sha256Sum: sum })
+	}
+	return list
+}
+
+// describePlan lists what a sync in mode would do with a plan
+func describePlan(plan SyncPlan, mode SyncMode) []string {
+	var actions []string
+	sides := []struct {
+		name string
+		mode SyncMode
+		diff FileInfoDiff
+	}{
+		{ "push", SyncPush, plan.Push },
+		{ "pull", SyncPull, plan.Pull },
+	}
+	for _, side := range sides {
+		if mode & side.mode == 0 {
+			continue
+		}
+		for _, file := range side.diff.Added {
+			actions = append(actions, fmt.Sprintf("%s %s=%s", side.name, file.Path, file.Sha256Sum))
+		}
+		for _, file := range side.diff.Removed {
+			actions = append(actions, fmt.Sprintf("%s delete %s", side.name, file.Path))
+		}
+		for _, move := range side.diff.Moved {
+			actions = append(actions, fmt.Sprintf("%s move %s %s", side.name, move.From.Path, move.To.Path))
+		}
+	}
+	for _, conflict := range plan.Conflicts {
+		actions = append(actions, "conflict " + conflict.Path)
+	}
+	sort.Strings(actions)
+	return actions
+}
+
+func TestPlanSubdirSync(t *testing.T) {
+	tests := []struct {
+		name string
+		base []server.FileInfo // nil if the subdir has never been synced
+		local []server.FileInfo
+		remote []server.FileInfo
+		options SyncOptions
+		expected []string
+	}{
+		{
+			name: "first pull keeps local only files",
+			local: files("local.tex=l", "both.tex=b"),
+			remote: files("both.tex=b", "remote.tex=r"),
+			options: SyncOptions{ Mode: SyncPull },
+			expected: []string{ "pull remote.tex=r" },
+		},
+		{
+			name: "first pull brings down changed files",
+			local: files("main.tex=old"),
+			remote: files("main.tex=new"),
+			options: SyncOptions{ Mode: SyncPull },
+			expected: []string{ "pull main.tex=new" },
+		},
+		{
+			name: "first push keeps remote only files",
+			local: files("local.tex=l", "both.tex=b"),
+			remote: files("both.tex=b", "remote.tex=r"),
+			options: SyncOptions{ Mode: SyncPush },
+			expected: []string{ "push local.tex=l" },
+		},
+		{
+			name: "first push sends changed files",
+			local: files("main.tex=new"),
+			remote: files("main.tex=old"),
+			options: SyncOptions{ Mode: SyncPush },
+			expected: []string{ "push main.tex=new" },
+		},
+		{
+			name: "first sync copies one sided files both ways",
+			local: files("local.tex=l", "same.tex=s", "main.tex=a"),
+			remote: files("remote.tex=r", "same.tex=s", "main.tex=b"),
+			options: SyncOptions{ Mode: SyncBoth },
+			expected: []string{ "conflict main.tex", "pull remote.tex=r", "push local.tex=l" },
+		},
+		{
+			name: "changes on each side",
+			base: files("a.tex=1", "b.tex=1"),
+			local: files("a.tex=2", "b.tex=1"),
+			remote: files("a.tex=1", "b.tex=2"),
+			options: SyncOptions{ Mode: SyncBoth },
+			expected: []string{ "pull b.tex=2", "push a.tex=2" },
+		},
+		{
+			name: "both sides changed",
+			base: files("main.tex=1"),
+			local: files("main.tex=2"),
+			remote: files("main.tex=3"),
+			options: SyncOptions{ Mode: SyncBoth },
+			expected: []string{ "conflict main.tex" },
+		},
+		{
+			name: "deleted locally and changed remotely",
+			base: files("main.tex=1"),
+			local: files(),
+			remote: files("main.tex=2"),
+			options: SyncOptions{ Mode: SyncBoth },
+			expected: []string{ "conflict main.tex" },
+		},
+		{
+			name: "changed locally and deleted remotely",
+			base: files("main.tex=1"),
+			local: files("main.tex=2"),
+			remote: files(),
+			options: SyncOptions{ Mode: SyncBoth },
+			expected: []string{ "conflict main.tex" },
+		},
+		{
+			name: "deletes on each side",
+			base: files("a.tex=1", "b.tex=1"),
+			local: files("b.tex=1"),
+			remote: files("a.tex=1"),
+			options: SyncOptions{ Mode: SyncBoth },
+			expected: []string{ "pull delete b.tex", "push delete a.tex" },
+		},
+		{
+			name: "no delete",
+			base: files("a.tex=1", "b.tex=1", "c.tex=1"),
+			local: files("b.tex=1", "c.tex=2"),
+			remote: files("a.tex=1", "c.tex=1"),
+			options: SyncOptions{ Mode: SyncBoth, NoDelete: true },
+			expected: []string{ "push c.tex=2" },
+		},
+		{
+			name: "moved locally",
+			base: files("old.tex=1"),
+			local: files("new.tex=1"),
+			remote: files("old.tex=1"),
+			options: SyncOptions{ Mode: SyncBoth },
+			expected: []string{ "push move old.tex new.tex" },
+		},
+		{
+			name: "moved remotely with no delete",
+			base: files("old.tex=1"),
+			local: files("old.tex=1"),
+			remote: files("new.tex=1"),
+			options: SyncOptions{ Mode: SyncBoth, NoDelete: true },
+			expected: []string{ "pull move old.tex new.tex" },
+		},
+		{
+			name: "keep local",
+			base: files("a.tex=1", "b.tex=1"),
+			local: files("a.tex=2"),
+			remote: files("a.tex=3", "b.tex=2"),
+			options: SyncOptions{ Mode: SyncBoth, Resolution: ResolveKeepLocal },
+			expected: []string{ "push a.tex=2", "push delete b.tex" },
+		},
+		{
+			name: "keep remote",
+			base: files("a.tex=1", "b.tex=1"),
+			local: files("a.tex=2"),
+			remote: files("a.tex=3", "b.tex=2"),
+			options: SyncOptions{ Mode: SyncBoth, Resolution: ResolveKeepRemote },
+			expected: []string{ "pull a.tex=3", "pull b.tex=2" },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := SyncState{ Subdirs: make(map[string][]server.FileInfo) }
+			if test.base != nil {
+				state.Subdirs["src"] = test.base
+			}
+
+			base := state.subdirBase("src", test.options.Mode, test.local, test.remote)
+			plan := planSubdirSync(base, test.local, test.remote, test.options)
+
+			actions := describePlan(plan, test.options.Mode)
+			if strings.Join(actions, "\n") != strings.Join(test.expected, "\n") {
+				t.Fatalf("expected %q, got %q", test.expected, actions)
+			}
+		})
+	}
+}
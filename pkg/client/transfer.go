@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
+)
+
+// DefaultParallelism is how many files are transferred at once when
+// neither the sync options nor the global config say
+const DefaultParallelism = 4
+
+// Progress is told how the file transfers of a sync are going. Its
+// methods are called from every transfer at once.
+type Progress interface {
+	// Queued adds files about to be transferred
+	Queued(files int, bytes int64)
+	// Transferred adds bytes sent or received
+	Transferred(bytes int64)
+	// Finished marks a file as transferred
+	Finished(path string)
+}
+
+// parallelism returns how many files a sync transfers at once
+func (o SyncOptions) parallelism(globalConfig GlobalConfig) int {
+	if o.Parallelism > 0 {
+		return o.Parallelism
+	}
+	if globalConfig.Parallelism > 0 {
+		return globalConfig.Parallelism
+	}
+	return DefaultParallelism
+}
+
+// progressReader tells a Progress about the bytes read through it
+type progressReader struct {
+	reader io.Reader
+	progress Progress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.progress.Transferred(int64(n))
+	}
+	return n, err
+}
+
+// withProgress returns a reader that reports to progress, or reader
+// itself if there's no progress to report to
+func withProgress(reader io.Reader, progress Progress) io.Reader {
+	if progress == nil {
+		return reader
+	}
+	return &progressReader{ reader: reader, progress: progress }
+}
+
+// transferFiles calls transfer for each file, with at most parallelism
+// running at once. The first error stops any transfers that haven't
+// started and cancels the context of those that have, and is returned
+// once they've all stopped.
+func transferFiles(ctx context.Context, parallelism int, progress Progress, files []server.FileInfo, transfer func(ctx context.Context, file server.FileInfo) error) error {
+	if progress != nil {
+		var size int64
+		for _, file := range files {
+			size += int64(file.Size)
+		}
+		progress.Queued(len(files), size)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	slots := make(chan struct{}, parallelism)
+
+	for _, file := range files {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(file server.FileInfo) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if err := transfer(ctx, file); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			if progress != nil {
+				progress.Finished(file.Path)
+			}
+		}(file)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionTransport asks servers for compressed responses and
+// decompresses them, and remembers which codings each server accepts
+// for request bodies
+type compressionTransport struct {
+	base http.RoundTripper
+	mutex sync.Mutex
+	requestEncodings map[string]string // Keyed by host
+}
+
+func (t *compressionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", server.SupportedEncodings)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if accepted := resp.Header.Get("Accept-Encoding"); accepted != "" {
+		t.mutex.Lock()
+		t.requestEncodings[req.URL.Host] = server.NegotiateEncoding(accepted)
+		t.mutex.Unlock()
+	}
+
+	var body io.ReadCloser
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case server.EncodingGzip:
+		reader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("compressionTransport gzip response: %w", err)
+		}
+		body = reader
+	case server.EncodingZstd:
+		reader, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("compressionTransport zstd response: %w", err)
+		}
+		body = reader.IOReadCloser()
+	default:
+		return resp, nil
+	}
+
+	resp.Body = &decompressedBody{ decoder: body, body: resp.Body }
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return resp, nil
+}
+
+// requestEncoding returns the coding to compress request bodies sent
+// to a URL with, or an empty string if its server isn't known to
+// accept any
+func (t *compressionTransport) requestEncoding(rawUrl string) string {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.requestEncodings[parsedUrl.Host]
+}
+
+type decompressedBody struct {
+	decoder io.ReadCloser
+	body io.ReadCloser
+}
+
+func (b *decompressedBody) Read(p []byte) (int, error) {
+	return b.decoder.Read(p)
+}
+
+func (b *decompressedBody) Close() error {
+	b.decoder.Close()
+	return b.body.Close()
+}
+
+// isCompressibleFile reports whether a file is worth compressing on
+// upload, by its extension, or by its contents if the extension isn't
+// known
+func isCompressibleFile(path string, contents []byte) bool {
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); contentType != "" {
+		return server.IsCompressibleType(contentType)
+	}
+
+	if len(contents) > 512 {
+		contents = contents[:512]
+	}
+	return server.IsCompressibleType(http.DetectContentType(contents))
+}
+
+// newBodyEncoder returns a writer that compresses a request body with
+// a content coding into w. Closing it finishes the compressed stream
+// but doesn't close w.
+func newBodyEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case server.EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case server.EncodingZstd:
+		encoder, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("newBodyEncoder create zstd writer: %w", err)
+		}
+		return encoder, nil
+	}
+
+	return nil, fmt.Errorf("newBodyEncoder unsupported encoding \"%s\"", encoding)
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dantecatalfamo/remotex/pkg/server"
+)
+
+var ErrTrashNotFound = server.ErrTrashNotFound
+var ErrTrashConflict = server.ErrTrashConflict
+
+// trashRequest is a request to the account's trash
+func trashRequest(method string, path ...string) request {
+	return request{
+		method: method,
+		path: append([]string{"account", "trash"}, path...),
+		errors: map[int]error{
+			http.StatusUnauthorized: ErrNotLoggedIn,
+			http.StatusNotFound: ErrTrashNotFound,
+			http.StatusConflict: ErrTrashConflict,
+		},
+	}
+}
+
+// ListTrash returns the user's deleted projects and files
+func (c *Client) ListTrash(ctx context.Context) ([]server.TrashEntry, error) {
+	var entries []server.TrashEntry
+	if err := c.sendJSON(ctx, trashRequest(http.MethodGet), &entries); err != nil {
+		return nil, fmt.Errorf("ListTrash: %w", err)
+	}
+
+	return entries, nil
+}
+
+// RestoreTrash puts a deleted project or file back where it was
+func (c *Client) RestoreTrash(ctx context.Context, id int) error {
+	if err := c.sendEmpty(ctx, trashRequest(http.MethodPost, strconv.Itoa(id), "restore")); err != nil {
+		return fmt.Errorf("RestoreTrash: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeTrash permanently deletes a deleted project or file
+func (c *Client) PurgeTrash(ctx context.Context, id int) error {
+	if err := c.sendEmpty(ctx, trashRequest(http.MethodDelete, strconv.Itoa(id))); err != nil {
+		return fmt.Errorf("PurgeTrash: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeAllTrash permanently deletes everything in the user's trash
+func (c *Client) PurgeAllTrash(ctx context.Context) error {
+	if err := c.sendEmpty(ctx, trashRequest(http.MethodDelete)); err != nil {
+		return fmt.Errorf("PurgeAllTrash: %w", err)
+	}
+
+	return nil
+}
+
+func ListTrash(ctx context.Context, globalConfig GlobalConfig) ([]server.TrashEntry, error) {
+	return globalConfig.Client().ListTrash(ctx)
+}
+
+func RestoreTrash(ctx context.Context, globalConfig GlobalConfig, id int) error {
+	return globalConfig.Client().RestoreTrash(ctx, id)
+}
+
+func PurgeTrash(ctx context.Context, globalConfig GlobalConfig, id int) error {
+	return globalConfig.Client().PurgeTrash(ctx, id)
+}
+
+func PurgeAllTrash(ctx context.Context, globalConfig GlobalConfig) error {
+	return globalConfig.Client().PurgeAllTrash(ctx)
+}
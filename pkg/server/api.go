@@ -0,0 +1,339 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"gopkg.in/yaml.v3"
+)
+
+// APIPrefix is where the current version of the API is served. The
+// same routes are served from the root for older clients, with form
+// bodies and plain text errors.
+const APIPrefix = "/api/v1"
+
+const ContextAPIVersionKey = "apiVersion"
+
+// ErrorCodeHeader is set on error responses to a code clients can rely
+// on, where the message is only meant for people
+const ErrorCodeHeader = "X-Error-Code"
+
+// Error codes returned by the API. Codes for a status are used unless
+// a more specific one applies.
+const (
+	ErrorCodeInvalidRequest = "invalid_request"
+	ErrorCodeUnauthorized = "unauthorized"
+	ErrorCodeForbidden = "forbidden"
+	ErrorCodeNotFound = "not_found"
+	ErrorCodeMethodNotAllowed = "method_not_allowed"
+	ErrorCodeConflict = "conflict"
+	ErrorCodePreconditionFailed = "precondition_failed"
+	ErrorCodeTooLarge = "too_large"
+	ErrorCodeUnprocessable = "unprocessable"
+	ErrorCodeRangeNotSatisfiable = "range_not_satisfiable"
+	ErrorCodeInternal = "internal_error"
+	ErrorCodeUpstream = "upstream_error"
+	ErrorCodeUnavailable = "unavailable"
+
+	ErrorCodeInvalidCredentials = "invalid_credentials"
+	ErrorCodeInvalidUsername = "invalid_username"
+	ErrorCodeWeakPassword = "weak_password"
+	ErrorCodeUserExists = "user_exists"
+	ErrorCodePasswordManagedExternally = "password_managed_externally"
+	ErrorCodeBuildFailed = "build_failed"
+	ErrorCodeBuildInProgress = "build_in_progress"
+	ErrorCodeBuildCancelled = "build_cancelled"
+	ErrorCodeNoBuildRunning = "no_build_running"
+	ErrorCodeUploadMismatch = "upload_mismatch"
+	ErrorCodeFileExists = "file_exists"
+	ErrorCodeNotText = "not_text"
+	ErrorCodeTrashConflict = "trash_conflict"
+	ErrorCodeShuttingDown = "shutting_down"
+)
+
+// ErrorCodeForStatus returns the code of an error response that doesn't
+// have a more specific one
+func ErrorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrorCodeInvalidRequest
+	case http.StatusUnauthorized:
+		return ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrorCodeForbidden
+	case http.StatusNotFound:
+		return ErrorCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return ErrorCodeMethodNotAllowed
+	case http.StatusConflict:
+		return ErrorCodeConflict
+	case http.StatusPreconditionFailed:
+		return ErrorCodePreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return ErrorCodeTooLarge
+	case http.StatusRequestedRangeNotSatisfiable:
+		return ErrorCodeRangeNotSatisfiable
+	case http.StatusUnprocessableEntity:
+		return ErrorCodeUnprocessable
+	case http.StatusBadGateway:
+		return ErrorCodeUpstream
+	case http.StatusServiceUnavailable:
+		return ErrorCodeUnavailable
+	}
+	if status >= 500 {
+		return ErrorCodeInternal
+	}
+	return ErrorCodeInvalidRequest
+}
+
+// httpError is http.Error with a specific error code
+func httpError(w http.ResponseWriter, message string, code string, status int) {
+	w.Header().Set(ErrorCodeHeader, code)
+	http.Error(w, message, status)
+}
+
+// APIError describes why a request to the API failed
+type APIError struct {
+	Code string `json:"code"`
+	Message string `json:"message"`
+	Status int `json:"status"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// ErrorResponse is the body of every error response from the API
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// TokenResponse is returned by the API when logging in or registering
+type TokenResponse struct {
+	Username string `json:"username"`
+	Token string `json:"token"`
+}
+
+// BuildResult is returned by the API when a build finishes
+type BuildResult struct {
+	Output string `json:"output"`
+}
+
+// maxJSONBodySize is the largest JSON request body the API reads.
+// Files are uploaded as multipart forms, so nothing sent as JSON needs
+// to be big.
+const maxJSONBodySize = 1024 * 1024
+
+// APIMiddleware marks requests as made to the versioned API, reads
+// JSON request bodies as if they were forms, and turns plain text
+// error responses into an ErrorResponse
+func APIMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aw := &apiResponseWriter{ ResponseWriter: w, ctx: r.Context(), requestId: middleware.GetReqID(r.Context()) }
+		defer aw.finish()
+
+		if err := parseJSONForm(w, r); err != nil {
+			httpError(aw, err.Error(), ErrorCodeInvalidRequest, http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid json body", "err", err)
+			return
+		}
+
+		// File paths are part of the URL, and generated clients escape
+		// the slashes in them. Route on the unescaped path so the files
+		// are found.
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && r.URL.RawPath != "" {
+			rctx.RoutePath = strings.TrimPrefix(r.URL.Path, APIPrefix)
+		}
+
+		ctx := context.WithValue(r.Context(), ContextAPIVersionKey, 1)
+		next.ServeHTTP(aw, r.WithContext(ctx))
+	})
+}
+
+// IsAPIRequest reports whether a request was made to the versioned API
+// rather than the routes at the root
+func IsAPIRequest(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	_, ok := ctx.Value(ContextAPIVersionKey).(int)
+	return ok
+}
+
+// parseJSONForm fills in a request's form from its body if it's a JSON
+// object, so handlers read it like any other form. Values must be
+// strings, numbers, booleans or null. A false boolean or null leaves
+// the field out, since some fields are flags that are set by being
+// present.
+func parseJSONForm(w http.ResponseWriter, r *http.Request) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" || r.Body == nil {
+		return nil
+	}
+
+	var fields map[string]any
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodySize))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return fmt.Errorf("invalid json body: %w", err)
+	}
+
+	form := make(url.Values)
+	for name, value := range fields {
+		switch value := value.(type) {
+		case nil:
+		case string:
+			form.Set(name, value)
+		case json.Number:
+			form.Set(name, value.String())
+		case bool:
+			if value {
+				form.Set(name, strconv.FormatBool(value))
+			}
+		default:
+			return fmt.Errorf("invalid json body: field %s must be a string, number or boolean", name)
+		}
+	}
+
+	r.PostForm = form
+	r.Form = r.URL.Query()
+	for name, values := range form {
+		r.Form[name] = append(values, r.Form[name]...)
+	}
+	return nil
+}
+
+// apiResponseWriter holds back plain text error responses, like the
+// ones written by http.Error, and writes them as an ErrorResponse once
+// the handler is done
+type apiResponseWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	requestId string
+	wroteHeader bool
+	status int
+	message bytes.Buffer
+}
+
+func (aw *apiResponseWriter) WriteHeader(status int) {
+	if aw.status != 0 {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(aw.Header().Get("Content-Type"))
+	if !aw.wroteHeader && status >= 400 && mediaType == "text/plain" {
+		aw.status = status
+		return
+	}
+	aw.wroteHeader = true
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *apiResponseWriter) Write(data []byte) (int, error) {
+	if aw.status != 0 {
+		return aw.message.Write(data)
+	}
+	aw.wroteHeader = true
+	return aw.ResponseWriter.Write(data)
+}
+
+func (aw *apiResponseWriter) Flush() {
+	if aw.status != 0 {
+		return
+	}
+	if flusher, ok := aw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (aw *apiResponseWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// finish writes the error response that was held back, if there was
+// one
+func (aw *apiResponseWriter) finish() {
+	if aw.status == 0 {
+		return
+	}
+
+	code := aw.Header().Get(ErrorCodeHeader)
+	if code == "" {
+		code = ErrorCodeForStatus(aw.status)
+	}
+
+	header := aw.Header()
+	header.Set(ErrorCodeHeader, code)
+	header.Set("Content-Type", "application/json")
+	header.Del("Content-Length")
+	aw.ResponseWriter.WriteHeader(aw.status)
+
+	response := ErrorResponse{
+		Error: APIError{
+			Code: code,
+			Message: strings.TrimSpace(aw.message.String()),
+			Status: aw.status,
+			RequestID: aw.requestId,
+		},
+	}
+	if err := json.NewEncoder(aw.ResponseWriter).Encode(response); err != nil {
+		slog.ErrorContext(aw.ctx, "Unable to write error response", "err", err)
+	}
+}
+
+// writeJSON writes a value as the JSON body of a response
+func writeJSON(w http.ResponseWriter, r *http.Request, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
+	}
+}
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// openAPISpecJSON converts the OpenAPI document to JSON the first time
+// it's asked for
+var openAPISpecJSON = sync.OnceValues(func() ([]byte, error) {
+	var spec any
+	if err := yaml.Unmarshal(openAPISpec, &spec); err != nil {
+		return nil, fmt.Errorf("openAPISpecJSON unmarshal: %w", err)
+	}
+	specJSON, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("openAPISpecJSON marshal: %w", err)
+	}
+	return specJSON, nil
+})
+
+// OpenAPIYAML serves the OpenAPI document describing the API
+func OpenAPIYAML(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPISpec)
+}
+
+// OpenAPIJSON serves the OpenAPI document describing the API as JSON
+func OpenAPIJSON(w http.ResponseWriter, r *http.Request) {
+	spec, err := openAPISpecJSON()
+	if err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Unable to convert OpenAPI document", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditLogin = "login"
+	AuditLoginFailed = "login_failed"
+	AuditRegister = "register"
+	AuditTokenCreate = "token_create"
+	AuditTokenDelete = "token_delete"
+	AuditPasswordChange = "password_change"
+	AuditAccountDelete = "account_delete"
+	AuditProjectCreate = "project_create"
+	AuditProjectDelete = "project_delete"
+	AuditProjectVisibility = "project_visibility"
+	AuditFileDelete = "file_delete"
+	AuditFileMove = "file_move"
+	AuditTrashRestore = "trash_restore"
+	AuditTrashPurge = "trash_purge"
+	AuditAdminUserCreate = "admin_user_create"
+	AuditAdminUserDelete = "admin_user_delete"
+	AuditAdminUserDisable = "admin_user_disable"
+	AuditAdminUserEnable = "admin_user_enable"
+	AuditAdminUserAdmin = "admin_user_admin"
+	AuditAdminPasswordReset = "admin_password_reset"
+	AuditAdminTokenDelete = "admin_token_delete"
+	AuditAdminBuildCancel = "admin_build_cancel"
+	AuditSSOLink = "sso_link"
+	AuditFileRestore = "file_restore"
+)
+
+// AuditActorCLI is the actor of actions taken with the server's
+// command line, which runs without a user
+const AuditActorCLI = "cli"
+
+// AuditEvent is a single security relevant or destructive action.
+// Target is a username, or user/project, or user/project/path.
+type AuditEvent struct {
+	ID int `json:"id"`
+	Time time.Time `json:"time"`
+	Actor string `json:"actor"`
+	IP string `json:"ip"`
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// AuditFilter selects audit events. Empty fields match everything.
+type AuditFilter struct {
+	Actor string
+	Action string
+	Target string // Matches the target and everything under it
+	IP string
+	Since time.Time
+	Until time.Time
+	Limit int // Most recent events only
+}
+
+// RecordAuditEvent stores an event in the audit log. If the event has
+// no time, the current time is used.
+func RecordAuditEvent(config Config, event AuditEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if _, err := config.database.conn.Exec(
+		"INSERT INTO audit_events (created_at, actor, ip, action, target, detail) VALUES (?, ?, ?, ?, ?, ?)",
+		event.Time.UTC().Format(SQLiteTime),
+		event.Actor,
+		event.IP,
+		event.Action,
+		event.Target,
+		event.Detail,
+	); err != nil {
+		return fmt.Errorf("RecordAuditEvent insert db: %w", err)
+	}
+
+	return nil
+}
+
+// auditRequest records an action performed by the user authorized for
+// the request
+func auditRequest(config Config, r *http.Request, action, target, detail string) {
+	auditRequestAs(config, r, GetAuthedUser(r.Context()), action, target, detail)
+}
+
+// auditRequestAs records an action performed by actor, for requests
+// where the actor isn't authorized yet, like logins. A failure to
+// record the event is logged but doesn't fail the request.
+func auditRequestAs(config Config, r *http.Request, actor, action, target, detail string) {
+	event := AuditEvent{
+		Actor: actor,
+		IP: requestIP(r),
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+
+	if err := RecordAuditEvent(config, event); err != nil {
+		slog.ErrorContext(r.Context(), "Unable to record audit event", "action", action, "err", err)
+	}
+}
+
+// requestIP returns the client's address without the port.
+// middleware.RealIP has already replaced RemoteAddr with the address
+// from the proxy headers if there were any.
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ListAuditEvents returns the events matching filter, oldest first
+func ListAuditEvents(config Config, filter AuditFilter) ([]AuditEvent, error) {
+	var conditions []string
+	var args []any
+
+	if filter.Actor != "" {
+		conditions = append(conditions, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.Target != "" {
+		conditions = append(conditions, "(target = ? OR substr(target, 1, length(?) + 1) = ? || '/')")
+		args = append(args, filter.Target, filter.Target, filter.Target)
+	}
+	if filter.IP != "" {
+		conditions = append(conditions, "ip = ?")
+		args = append(args, filter.IP)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.Since.UTC().Format(SQLiteTime))
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.Until.UTC().Format(SQLiteTime))
+	}
+
+	stmt := "SELECT id, created_at, COALESCE(actor, ''), COALESCE(ip, ''), action, COALESCE(target, ''), COALESCE(detail, '') FROM audit_events"
+	if len(conditions) > 0 {
+		stmt += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	stmt += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		stmt += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := config.database.conn.Query(stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("ListAuditEvents query: %w", err)
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+
+	for rows.Next() {
+		var event AuditEvent
+		var createdAt string
+		if err := rows.Scan(
+			&event.ID,
+			&createdAt,
+			&event.Actor,
+			&event.IP,
+			&event.Action,
+			&event.Target,
+			&event.Detail,
+		); err != nil {
+			return nil, fmt.Errorf("ListAuditEvents scan: %w", err)
+		}
+
+		event.Time, err = time.Parse(SQLiteTime, createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("ListAuditEvents parse time: %w", err)
+		}
+
+		events = append(events, event)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("ListAuditEvents rows error: %w", rows.Err())
+	}
+
+	// Newest were selected first so the limit keeps the most recent
+	for i, j := 0, len(events) - 1; i < j; i, j = i + 1, j - 1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	return events, nil
+}
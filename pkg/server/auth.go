@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordAuthenticator verifies a user's password. It returns nil if
+// the password is correct, and may create the user if they exist in an
+// external directory but not yet in the database.
+type PasswordAuthenticator interface {
+	Authenticate(config Config, name, password string) error
+}
+
+const (
+	AuthBackendLocal = "local"
+	AuthBackendLDAP = "ldap"
+)
+
+// LocalAuthenticator checks passwords against the bcrypt digests in
+// the users table. This is the default backend.
+type LocalAuthenticator struct{}
+
+func (LocalAuthenticator) Authenticate(config Config, name, password string) error {
+	// TODO Do constant time compare even if the user isn't in the DB.
+	//
+	// Theoretically attacker could tell if the user exusts or
+	// not because the request will return sooner since we don't
+	// compare the password, but it's not very important right now
+
+	row := config.database.conn.QueryRow("SELECT password_digest, disabled FROM users WHERE name = ?", name)
+	if row.Err() != nil {
+		return fmt.Errorf("LocalAuthenticator query: %w", row.Err())
+	}
+
+	var digest string
+	var disabled bool
+	if err := row.Scan(&digest, &disabled); err != nil {
+		return fmt.Errorf("LocalAuthenticator scan: %w", err)
+	}
+
+	if disabled {
+		return ErrUserDisabled
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(digest), []byte(password))
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 )
 
 type Engine string
@@ -39,3 +41,103 @@ func RunBuild(ctx context.Context, options BuildOptions) (string, error) {
 	}
 	return "", fmt.Errorf("invalid build mode \"%s\"", options.BuildMode)
 }
+
+// BuildTracker keeps track of the builds currently running on the
+// server, keyed by project id, so they can be cancelled
+type BuildTracker struct {
+	mutex sync.Mutex
+	running map[int]context.CancelCauseFunc
+	draining bool // New builds are refused while the server stops
+	wg sync.WaitGroup
+}
+
+func NewBuildTracker() *BuildTracker {
+	return &BuildTracker{ running: make(map[int]context.CancelCauseFunc) }
+}
+
+// Start registers a running build for a project. It returns
+// ErrBuildInProgress if the project already has a build running, and
+// ErrServerShuttingDown if the server is draining its builds.
+func (t *BuildTracker) Start(projectId int, cancel context.CancelCauseFunc) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.draining {
+		return ErrServerShuttingDown
+	}
+	if _, ok := t.running[projectId]; ok {
+		return ErrBuildInProgress
+	}
+	t.running[projectId] = cancel
+	t.wg.Add(1)
+	return nil
+}
+
+// Finish removes a project's build from the tracker
+func (t *BuildTracker) Finish(projectId int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.running[projectId]; ok {
+		delete(t.running, projectId)
+		t.wg.Done()
+	}
+}
+
+// Cancel cancels the running build of a project. It returns false if
+// the project has no build running.
+func (t *BuildTracker) Cancel(projectId int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	cancel, ok := t.running[projectId]
+	if !ok {
+		return false
+	}
+	cancel(ErrBuildCancelled)
+	return true
+}
+
+// Draining reports whether the tracker has stopped starting new builds
+func (t *BuildTracker) Draining() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.draining
+}
+
+// Drain stops new builds from starting and waits for the running ones
+// to finish. Builds still running once ctx is done are cancelled, and
+// Drain waits up to grace for them to stop. It returns how many builds
+// were cancelled.
+func (t *BuildTracker) Drain(ctx context.Context, grace time.Duration) (int, error) {
+	t.mutex.Lock()
+	t.draining = true
+	t.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0, nil
+	case <-ctx.Done():
+	}
+
+	t.mutex.Lock()
+	cancelled := len(t.running)
+	for _, cancel := range t.running {
+		cancel(ErrServerShuttingDown)
+	}
+	t.mutex.Unlock()
+
+	select {
+	case <-done:
+		return cancelled, nil
+	case <-time.After(grace):
+		return cancelled, fmt.Errorf("BuildTracker drain: cancelled builds still running after %s", grace)
+	}
+}
@@ -4,13 +4,15 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"os/exec"
-
-	"github.com/go-chi/chi/v5/middleware"
+	"time"
 )
 
+// How long a cancelled build waits for the processes it started to
+// close their output
+const buildWaitDelay = time.Second
+
 func RunBuildNative(ctx context.Context, options BuildOptions) (string, error) {
 	var engineArg string
 	switch options.Engine {
@@ -55,21 +57,18 @@ func RunBuildNative(ctx context.Context, options BuildOptions) (string, error) {
 		args = append(args, "-deps")
 	}
 
-	err := os.Chdir(options.SrcDir)
-	if err != nil {
-		return "", fmt.Errorf("RunBuild: %w", err)
-	}
-
 	cmd := exec.CommandContext(ctx, "latexmk", args...)
+	cmd.Dir = options.SrcDir
+	// latexmk runs the engine as its own process, which keeps the output
+	// open after latexmk is killed. Don't wait for it when the build is
+	// cancelled.
+	cmd.WaitDelay = buildWaitDelay
 
 	cmdOut := new(bytes.Buffer)
 	cmd.Stdout = cmdOut
 	cmd.Stderr = cmdOut
 
-	// HTTP request ID
-	requestId := middleware.GetReqID(ctx)
-
-	log.Printf("[%s] Starting build in %s: %v", requestId, options.SrcDir, args)
+	slog.InfoContext(ctx, "Starting build", "dir", options.SrcDir, "args", args)
 	if err := cmd.Run(); err != nil {
 		// If error is type *ExitError, the cmdOut should be populated
 		// with an error message
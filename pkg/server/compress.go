@@ -0,0 +1,239 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content codings supported for request and response bodies, in order
+// of preference
+const (
+	EncodingZstd = "zstd"
+	EncodingGzip = "gzip"
+)
+
+// SupportedEncodings is advertised in the Accept-Encoding header of
+// every response, so clients know they can compress uploads
+const SupportedEncodings = EncodingZstd + ", " + EncodingGzip
+
+// Responses smaller than this aren't worth compressing
+const minCompressSize = 512
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+var zstdWriters = sync.Pool{
+	New: func() any {
+		writer, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			panic(err)
+		}
+		return writer
+	},
+}
+
+// NegotiateEncoding picks the preferred supported coding from an
+// Accept-Encoding header, or an empty string for no compression
+func NegotiateEncoding(acceptEncoding string) string {
+	best := ""
+	bestQuality := 0.0
+
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if quality <= 0 {
+			continue
+		}
+
+		var candidates []string
+		switch coding {
+		case EncodingZstd, EncodingGzip:
+			candidates = []string{coding}
+		case "*":
+			candidates = []string{EncodingZstd, EncodingGzip}
+		}
+
+		for _, candidate := range candidates {
+			// Ties go to the coding we prefer
+			if quality > bestQuality || (quality == bestQuality && candidate == EncodingZstd) {
+				best = candidate
+				bestQuality = quality
+			}
+		}
+	}
+
+	return best
+}
+
+// CompressMiddleware decompresses gzip and zstd request bodies and
+// compresses responses of compressible types for clients that accept
+// it. Decompressed bodies are limited to the maximum file size, plus
+// room for the rest of a form.
+func CompressMiddleware(config Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Accept-Encoding", SupportedEncodings)
+
+			var decoder io.ReadCloser
+			switch encoding := strings.ToLower(r.Header.Get("Content-Encoding")); encoding {
+			case "", "identity":
+			case EncodingGzip:
+				reader, err := gzip.NewReader(r.Body)
+				if err != nil {
+					http.Error(w, "Invalid gzip request body", http.StatusBadRequest)
+					return
+				}
+				decoder = reader
+			case EncodingZstd:
+				reader, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1))
+				if err != nil {
+					http.Error(w, "Invalid zstd request body", http.StatusBadRequest)
+					return
+				}
+				decoder = reader.IOReadCloser()
+			default:
+				http.Error(w, "Unsupported request content encoding", http.StatusUnsupportedMediaType)
+				return
+			}
+
+			if decoder != nil {
+				defer decoder.Close()
+				r.Body = http.MaxBytesReader(w, decoder, int64(config.MaxFileSize) + 1024 * 1024)
+				r.Header.Del("Content-Encoding")
+				r.Header.Del("Content-Length")
+				r.ContentLength = -1
+			}
+
+			// Ranges refer to the uncompressed content
+			encoding := ""
+			if r.Method != http.MethodHead && r.Header.Get("Range") == "" {
+				encoding = NegotiateEncoding(r.Header.Get("Accept-Encoding"))
+			}
+
+			cw := &compressResponseWriter{ ResponseWriter: w, encoding: encoding }
+			defer cw.close()
+
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// compressResponseWriter compresses the response body if, once the
+// headers are written, it turns out to be worth it
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	encoder io.WriteCloser
+	wroteHeader bool
+}
+
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+
+	header := cw.Header()
+	if !IsCompressibleType(header.Get("Content-Type")) || header.Get("Content-Encoding") != "" {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	header.Add("Vary", "Accept-Encoding")
+
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < minCompressSize {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if cw.encoding == "" || status != http.StatusOK {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", cw.encoding)
+	// The compressed body isn't byte for byte the same as the file the
+	// ETag was made from. Weak ETags still match If-None-Match.
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, "\"") {
+		header.Set("ETag", "W/" + etag)
+	}
+
+	switch cw.encoding {
+	case EncodingGzip:
+		writer := gzipWriters.Get().(*gzip.Writer)
+		writer.Reset(cw.ResponseWriter)
+		cw.encoder = writer
+	case EncodingZstd:
+		writer := zstdWriters.Get().(*zstd.Encoder)
+		writer.Reset(cw.ResponseWriter)
+		cw.encoder = writer
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressResponseWriter) Write(data []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.encoder != nil {
+		return cw.encoder.Write(data)
+	}
+	return cw.ResponseWriter.Write(data)
+}
+
+func (cw *compressResponseWriter) Flush() {
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close finishes the compressed stream and returns the encoder to its
+// pool
+func (cw *compressResponseWriter) close() {
+	if cw.encoder == nil {
+		return
+	}
+
+	cw.encoder.Close()
+
+	switch encoder := cw.encoder.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(encoder)
+	case *zstd.Encoder:
+		zstdWriters.Put(encoder)
+	}
+	cw.encoder = nil
+}
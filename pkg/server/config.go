@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"time"
@@ -12,12 +13,34 @@ import (
 func init() {
 	viper.SetDefault("allowLatexmkrc", false)
 	viper.SetDefault("allowLuaTex", false)
+	viper.SetDefault("allowRegistration", false)
+	viper.SetDefault("authBackend", AuthBackendLocal)
+	viper.SetDefault("buildDrainTimeout", "45s")
 	viper.SetDefault("buildMode", BuildModeNative)
+	viper.SetDefault("buildRetentionAge", "0s")
+	viper.SetDefault("buildRetentionCount", 10)
 	viper.SetDefault("databasePath", "/var/db/remotex/remotex.db")
 	viper.SetDefault("listenAddress", "0.0.0.0:3344")
+	viper.SetDefault("logFormat", LogFormatText)
+	viper.SetDefault("logLevel", "info")
+	viper.SetDefault("ldapAutoCreate", true)
+	viper.SetDefault("ldapBindDN", "")
+	viper.SetDefault("ldapGroupBaseDN", "")
+	viper.SetDefault("ldapGroupFilter", "")
+	viper.SetDefault("ldapUrl", "")
 	viper.SetDefault("maxBuildTime", "45s")
 	viper.SetDefault("maxFileSize", 25 * 1024 * 1024)
+	viper.SetDefault("minFreeSpace", 1024 * 1024 * 1024)
+	viper.SetDefault("minPasswordLength", 10)
+	viper.SetDefault("oidcAutoProvision", false)
+	viper.SetDefault("oidcClientId", "")
+	viper.SetDefault("oidcClientSecret", "")
+	viper.SetDefault("oidcIssuer", "")
+	viper.SetDefault("oidcRedirectUrl", "")
+	viper.SetDefault("oidcScopes", []string{"openid", "profile", "email"})
+	viper.SetDefault("oidcUsernameClaim", "preferred_username")
 	viper.SetDefault("projectsPath", "/var/lib/remotex/")
+	viper.SetDefault("trashRetention", "720h")
 
 	viper.SetConfigName("remotex")
 	viper.SetConfigType("yaml")
@@ -27,13 +50,39 @@ func init() {
 type Config struct {
 	AllowLatexmkrc bool // Allow auto-reading latexmkrc files
 	AllowLuaTex bool // Allow luaTex, possible security issue for some
+	AllowRegistration bool // Allow new users to register with an invitation code
+	AuthBackend string // Password authentication backend, local or ldap. Users with a local password always use it.
+	BuildDrainTimeout time.Duration // How long running builds may finish when the server stops before they're cancelled
 	BuildMode BuildMode // Select between native or containerized builds
+	BuildRetentionAge time.Duration // How long build output snapshots are kept, 0 keeps them forever
+	BuildRetentionCount int // Build output snapshots kept per project, 0 keeps all of them
 	DatabasePath string // Location of the database
+	LDAPAutoCreate bool // Create users on their first LDAP login
+	LDAPBindDN string // DN to bind as, {user} is replaced by the username
+	LDAPGroupBaseDN string // Base DN of the group membership search
+	LDAPGroupFilter string // Filter users must match to log in, {user} and {dn} are replaced
+	LDAPUrl string // ldap:// or ldaps:// URL of the directory server
 	ListenAddress string // Where the server will listen
+	LogFormat string // Format of log lines, text or json
+	LogLevel slog.Level // Least severe level of log lines that are written
 	MaxFileSize uint // Maximum upload size
+	MinFreeSpace uint64 // Free bytes the project directory needs to be healthy, 0 doesn't check
+	MinPasswordLength int // Minimum length of new passwords
+	OIDCAutoProvision bool // Create users on their first single sign-on login
+	OIDCClientId string // Client ID registered with the OIDC issuer
+	OIDCClientSecret string // Client secret registered with the OIDC issuer
+	OIDCIssuer string // OIDC issuer URL, enables single sign-on if set
+	OIDCRedirectUrl string // Public URL of the server's /sso/callback route
+	OIDCScopes []string // Scopes requested from the OIDC issuer
+	OIDCUsernameClaim string // ID token claim used as the username
 	MaxProjectBuildTime time.Duration // Max time a project can build
 	ProjectDir string // Root of all projects
+	TrashRetention time.Duration // How long deleted projects and files are kept
 	database *Database // Database object
+	builds *BuildTracker // Builds currently running
+	fileLocks *ProjectLocks // Held while a project's src files change
+	sso *OIDCProvider // Single sign-on provider, nil if disabled
+	authenticator PasswordAuthenticator // Checks passwords on login
 }
 
 type BuildMode string
@@ -69,6 +118,31 @@ func ReadAndInitializeConfig(path string) (Config, error) {
 		return Config{}, fmt.Errorf("ReadAndInitializeConfig parse max build time: %w", err)
 	}
 
+	buildDrainTimeout, err := time.ParseDuration(viper.GetString("buildDrainTimeout"))
+	if err != nil {
+		return Config{}, fmt.Errorf("ReadAndInitializeConfig parse build drain timeout: %w", err)
+	}
+
+	trashRetention, err := time.ParseDuration(viper.GetString("trashRetention"))
+	if err != nil {
+		return Config{}, fmt.Errorf("ReadAndInitializeConfig parse trash retention: %w", err)
+	}
+
+	buildRetentionAge, err := time.ParseDuration(viper.GetString("buildRetentionAge"))
+	if err != nil {
+		return Config{}, fmt.Errorf("ReadAndInitializeConfig parse build retention age: %w", err)
+	}
+
+	logLevel, err := ParseLogLevel(viper.GetString("logLevel"))
+	if err != nil {
+		return Config{}, fmt.Errorf("ReadAndInitializeConfig parse log level: %w", err)
+	}
+
+	logFormat := viper.GetString("logFormat")
+	if logFormat != LogFormatText && logFormat != LogFormatJSON {
+		return Config{}, fmt.Errorf("ReadAndInitializeConfig invalid log format: %s", logFormat)
+	}
+
 	var buildMode BuildMode
 	switch strMode := viper.GetString("buildMode"); strMode {
 	case string(BuildModeNative):
@@ -81,12 +155,34 @@ func ReadAndInitializeConfig(path string) (Config, error) {
 
 	config.AllowLatexmkrc = viper.GetBool("allowLatexmkrc")
 	config.AllowLuaTex = viper.GetBool("allowLuaTex")
+	config.AllowRegistration = viper.GetBool("allowRegistration")
+	config.AuthBackend = viper.GetString("authBackend")
+	config.BuildDrainTimeout = buildDrainTimeout
 	config.BuildMode = buildMode
+	config.BuildRetentionAge = buildRetentionAge
+	config.BuildRetentionCount = viper.GetInt("buildRetentionCount")
 	config.DatabasePath = viper.GetString("databasePath")
+	config.LDAPAutoCreate = viper.GetBool("ldapAutoCreate")
+	config.LDAPBindDN = viper.GetString("ldapBindDN")
+	config.LDAPGroupBaseDN = viper.GetString("ldapGroupBaseDN")
+	config.LDAPGroupFilter = viper.GetString("ldapGroupFilter")
+	config.LDAPUrl = viper.GetString("ldapUrl")
 	config.ListenAddress = viper.GetString("listenAddress")
+	config.LogFormat = logFormat
+	config.LogLevel = logLevel
 	config.MaxFileSize = viper.GetUint("maxFileSize")
+	config.MinFreeSpace = viper.GetUint64("minFreeSpace")
+	config.MinPasswordLength = viper.GetInt("minPasswordLength")
+	config.OIDCAutoProvision = viper.GetBool("oidcAutoProvision")
+	config.OIDCClientId = viper.GetString("oidcClientId")
+	config.OIDCClientSecret = viper.GetString("oidcClientSecret")
+	config.OIDCIssuer = viper.GetString("oidcIssuer")
+	config.OIDCRedirectUrl = viper.GetString("oidcRedirectUrl")
+	config.OIDCScopes = viper.GetStringSlice("oidcScopes")
+	config.OIDCUsernameClaim = viper.GetString("oidcUsernameClaim")
 	config.MaxProjectBuildTime = maxProjectBuildTime
 	config.ProjectDir = viper.GetString("projectsPath")
+	config.TrashRetention = trashRetention
 
 	if err := os.MkdirAll(config.ProjectDir, os.ModePerm); err != nil {
 		return Config{}, fmt.Errorf("ReadAndInitializeConfig create project dir: %w", err)
@@ -102,6 +198,41 @@ func ReadAndInitializeConfig(path string) (Config, error) {
 	}
 
 	config.database = db
+	config.builds = NewBuildTracker()
+	config.fileLocks = NewProjectLocks()
+
+	switch config.AuthBackend {
+	case AuthBackendLocal:
+		config.authenticator = LocalAuthenticator{}
+	case AuthBackendLDAP:
+		if config.LDAPUrl == "" || config.LDAPBindDN == "" {
+			return Config{}, fmt.Errorf("ReadAndInitializeConfig: ldapUrl and ldapBindDN are required with the ldap auth backend")
+		}
+		config.authenticator = LDAPAuthenticator{
+			Url: config.LDAPUrl,
+			BindDNTemplate: config.LDAPBindDN,
+			GroupBaseDN: config.LDAPGroupBaseDN,
+			GroupFilter: config.LDAPGroupFilter,
+			AutoCreate: config.LDAPAutoCreate,
+		}
+	default:
+		return Config{}, fmt.Errorf("ReadAndInitializeConfig invalid auth backend: %s", config.AuthBackend)
+	}
+
+	if config.OIDCIssuer != "" {
+		if config.OIDCClientId == "" || config.OIDCRedirectUrl == "" {
+			return Config{}, fmt.Errorf("ReadAndInitializeConfig: oidcClientId and oidcRedirectUrl are required with oidcIssuer")
+		}
+		config.sso = NewOIDCProvider(
+			config.OIDCIssuer,
+			config.OIDCClientId,
+			config.OIDCClientSecret,
+			config.OIDCRedirectUrl,
+			config.OIDCUsernameClaim,
+			config.OIDCScopes,
+			config.OIDCAutoProvision,
+		)
+	}
 
 	return config, nil
 }
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// newTestConfig returns a config with a fresh database and project
+// directory, both removed when the test is done
+func newTestConfig(t *testing.T) Config {
+	t.Helper()
+
+	dir := t.TempDir()
+	config := Config{
+		DatabasePath: filepath.Join(dir, "remotex.db"),
+		ProjectDir: dir,
+		builds: NewBuildTracker(),
+		fileLocks: NewProjectLocks(),
+	}
+
+	db, err := NewDatabse(config.DatabasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.conn.Close() })
+	config.database = db
+
+	return config
+}
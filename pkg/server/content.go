@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Types of files latex projects are made of that aren't known to the
+// mime package
+var contentTypes = map[string]string{
+	".aux": "text/plain; charset=utf-8",
+	".bbl": "text/x-tex; charset=utf-8",
+	".bib": "text/x-bibtex; charset=utf-8",
+	".bst": "text/plain; charset=utf-8",
+	".cls": "text/x-tex; charset=utf-8",
+	".fls": "text/plain; charset=utf-8",
+	".log": "text/plain; charset=utf-8",
+	".sty": "text/x-tex; charset=utf-8",
+	".synctex": "application/x-synctex",
+	".tex": "text/x-tex; charset=utf-8",
+}
+
+func init() {
+	for extension, contentType := range contentTypes {
+		if err := mime.AddExtensionType(extension, contentType); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// serveContent writes a file to the response with its content type,
+// ETag and modification time, and answers conditional and range
+// requests. digest is the file's sha256 sum, and is left out of the
+// response if it's unknown. Immutable content, like old revisions,
+// can be cached forever, everything else has to be revalidated.
+func serveContent(w http.ResponseWriter, r *http.Request, name string, modTime time.Time, content io.ReadSeeker, digest string, immutable bool) {
+	if digest != "" {
+		w.Header().Set("ETag", fmt.Sprintf("\"%s\"", digest))
+	}
+
+	if immutable {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+
+	http.ServeContent(w, r, path.Base(name), modTime, content)
+}
+
+// serveFile serves an open file with serveContent, using its
+// modification time
+func serveFile(w http.ResponseWriter, r *http.Request, name string, file *os.File, digest string, immutable bool) {
+	var modTime time.Time
+	if stat, err := file.Stat(); err == nil {
+		modTime = stat.ModTime()
+	}
+
+	serveContent(w, r, name, modTime, file, digest, immutable)
+}
+
+// IsCompressibleType reports whether content of a type is worth
+// compressing for transfer. Formats that are already compressed, like
+// PDFs, images and archives, are not.
+func IsCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+xml") || strings.HasSuffix(mediaType, "+json") {
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/postscript", "application/x-synctex", "image/svg+xml":
+		return true
+	}
+
+	return false
+}
@@ -5,13 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os/exec"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 )
 
 type Controller struct {
@@ -25,7 +24,7 @@ func NewController(config Config) Controller {
 func (c *Controller) Login(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "unable to parse form", http.StatusBadRequest)
-		log.Printf("%s %s: %s", r.Method, r.URL, err)
+		slog.WarnContext(r.Context(), "Unable to parse form", "err", err)
 		return
 	}
 
@@ -34,56 +33,431 @@ func (c *Controller) Login(w http.ResponseWriter, r *http.Request) {
 	description := r.FormValue("description")
 
 	if err := CompareUserPassword(c.config, user, password); err != nil {
-		http.Error(w, "incorrect username or password", http.StatusUnauthorized)
-		log.Printf("%s %s: %s", r.Method, r.URL, err)
+		auditRequestAs(c.config, r, user, AuditLoginFailed, user, "")
+		httpError(w, "incorrect username or password", ErrorCodeInvalidCredentials, http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "Incorrect username or password", "err", err)
 		return
 	}
 
 	token, err := CreateUserToken(c.config, user, description)
 	if err != nil {
 		http.Error(w, "error creating token", http.StatusInternalServerError)
-		log.Printf("%s %s: %s", r.Method, r.URL, err)
+		slog.ErrorContext(r.Context(), "Error creating token", "err", err)
 		return
 	}
 
+	auditRequestAs(c.config, r, user, AuditLogin, user, "password")
+	auditRequestAs(c.config, r, user, AuditTokenCreate, user, description)
+
+	writeToken(w, r, user, token)
+}
+
+// writeToken responds with a new token, as JSON to requests made to the
+// versioned API and as a line of text to the others
+func writeToken(w http.ResponseWriter, r *http.Request, user string, token string) {
+	if IsAPIRequest(r.Context()) {
+		writeJSON(w, r, TokenResponse{ Username: user, Token: token })
+		return
+	}
 	fmt.Fprintln(w, token)
 }
 
+// SSOLogin starts a single sign-on login for a client waiting on a
+// loopback redirect, by sending the browser to the OIDC issuer
+func (c *Controller) SSOLogin(w http.ResponseWriter, r *http.Request) {
+	if c.config.sso == nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	authUrl, err := c.config.sso.AuthCodeURL(r.Context(), query.Get("redirect_uri"), query.Get("state"), query.Get("description"), query.Get("link"))
+	if err != nil {
+		if errors.Is(err, ErrSSOInvalidRedirect) || errors.Is(err, ErrSSOInvalidState) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, ErrSSOBusy) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, "unable to start single sign-on", http.StatusBadGateway)
+		}
+		slog.WarnContext(r.Context(), "Unable to start single sign-on", "err", err)
+		return
+	}
+
+	http.Redirect(w, r, authUrl, http.StatusFound)
+}
+
+// SSOCallback is where the OIDC issuer sends the browser back to
+func (c *Controller) SSOCallback(w http.ResponseWriter, r *http.Request) {
+	if c.config.sso == nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if issuerErr := query.Get("error"); issuerErr != "" {
+		http.Error(w, fmt.Sprintf("single sign-on failed: %s", issuerErr), http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "Single sign-on issuer error", "error", issuerErr, "description", query.Get("error_description"))
+		return
+	}
+
+	result, err := c.config.sso.Callback(r.Context(), c.config, query.Get("state"), query.Get("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrSSOInvalidState):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrSSOUnknownUser), errors.Is(err, ErrUserDisabled), errors.Is(err, ErrInvalidUsername), errors.Is(err, ErrForbiddenUsername):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, ErrSSOAccountExists), errors.Is(err, ErrSSOIdentityLinked):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, ErrSSOBusy):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "single sign-on failed", http.StatusUnauthorized)
+		}
+		auditRequestAs(c.config, r, "", AuditLoginFailed, "", fmt.Sprintf("sso: %s", err))
+		slog.WarnContext(r.Context(), "Single sign-on failed", "err", err)
+		return
+	}
+
+	if result.Linked {
+		slog.InfoContext(r.Context(), "Single sign-on identity linked", "username", result.User)
+		auditRequestAs(c.config, r, result.User, AuditSSOLink, result.User, "")
+	}
+
+	http.Redirect(w, r, result.Redirect, http.StatusFound)
+}
+
+// SSOLink lets a logged in user link the identity they log in with next
+// to their account
+func (c *Controller) SSOLink(w http.ResponseWriter, r *http.Request) {
+	if c.config.sso == nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	user := GetAuthedUser(r.Context())
+	if user == "" {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "Not logged in")
+		return
+	}
+
+	link, err := c.config.sso.StartLink(user)
+	if err != nil {
+		if errors.Is(err, ErrSSOBusy) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, "unable to start single sign-on link", http.StatusInternalServerError)
+		}
+		slog.ErrorContext(r.Context(), "Unable to start single sign-on link", "err", err)
+		return
+	}
+
+	writeJSON(w, r, link)
+}
+
+// SSOToken lets the client exchange the one time code it received on
+// its loopback redirect for a bearer token
+func (c *Controller) SSOToken(w http.ResponseWriter, r *http.Request) {
+	if c.config.sso == nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "unable to parse form", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Unable to parse form", "err", err)
+		return
+	}
+
+	ssoToken, err := c.config.sso.CollectToken(c.config, r.FormValue("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrSSOInvalidState):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, ErrUserDisabled):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, "unable to create token", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Single sign-on token exchange failed", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Single sign-on login", "username", ssoToken.Username)
+	auditRequestAs(c.config, r, ssoToken.Username, AuditLogin, ssoToken.Username, "sso")
+	auditRequestAs(c.config, r, ssoToken.Username, AuditTokenCreate, ssoToken.Username, "sso")
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ssoToken); err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
+	}
+}
+
+func (c *Controller) Register(w http.ResponseWriter, r *http.Request) {
+	if !c.config.AllowRegistration {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "unable to parse form", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Unable to parse form", "err", err)
+		return
+	}
+
+	code := r.FormValue("code")
+	user := r.FormValue("username")
+	password := r.FormValue("password")
+	description := r.FormValue("description")
+
+	if err := RegisterUser(c.config, code, user, password); err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidInvitation):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, ErrUserExists):
+			httpError(w, err.Error(), ErrorCodeUserExists, http.StatusConflict)
+		case errors.Is(err, ErrForbiddenUsername), errors.Is(err, ErrInvalidUsername):
+			httpError(w, err.Error(), ErrorCodeInvalidUsername, http.StatusBadRequest)
+		case errors.Is(err, ErrWeakPassword):
+			httpError(w, err.Error(), ErrorCodeWeakPassword, http.StatusBadRequest)
+		default:
+			http.Error(w, "error creating user", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Registration failed", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Registered new user", "username", user)
+	auditRequestAs(c.config, r, user, AuditRegister, user, "")
+
+	token, err := CreateUserToken(c.config, user, description)
+	if err != nil {
+		http.Error(w, "error creating token", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error creating token", "err", err)
+		return
+	}
+
+	auditRequestAs(c.config, r, user, AuditTokenCreate, user, description)
+
+	writeToken(w, r, user, token)
+}
+
 func (c *Controller) Logout(w http.ResponseWriter, r *http.Request) {
 	token := GetAuthToken(r.Context())
 	if token == "" {
 		http.Error(w, "not logged in", http.StatusUnauthorized)
-		log.Printf("%s %s: not logged in", r.Method, r.URL)
+		slog.WarnContext(r.Context(), "Not logged in")
 		return
 	}
 
 	if err := DeleteUserToken(c.config, token); err != nil {
 		http.Error(w, "error deleting token", http.StatusInternalServerError)
-		log.Printf("%s %s: %s", r.Method, r.URL, err)
+		slog.ErrorContext(r.Context(), "Error deleting token", "err", err)
 		return
 	}
+
+	auditRequest(c.config, r, AuditTokenDelete, GetAuthedUser(r.Context()), "logout")
 }
 
 func (c *Controller) LogoutAll(w http.ResponseWriter, r *http.Request) {
 	token := GetAuthToken(r.Context())
 	if token == "" {
 		http.Error(w, "not logged in", http.StatusUnauthorized)
-		log.Printf("%s %s: not logged in", r.Method, r.URL)
+		slog.WarnContext(r.Context(), "Not logged in")
 		return
 	}
 
 	user, err := GetUserFromToken(c.config, token)
 	if err != nil {
 		http.Error(w, "could not get user info", http.StatusInternalServerError)
-		log.Printf("%s %s: %s", r.Method, r.URL, err)
+		slog.ErrorContext(r.Context(), "Could not get user info", "err", err)
 		return
 	}
 
 	if err := DeleteAllUserTokens(c.config, user); err != nil {
 		http.Error(w, "error deleting token", http.StatusInternalServerError)
-		log.Printf("%s %s: %s", r.Method, r.URL, err)
+		slog.ErrorContext(r.Context(), "Error deleting token", "err", err)
+		return
+	}
+
+	auditRequestAs(c.config, r, user, AuditTokenDelete, user, "logout all")
+}
+
+// ChangePassword changes the logged in user's password. All of their
+// other tokens are revoked.
+func (c *Controller) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := GetAuthedUser(r.Context())
+	if user == "" {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "Not logged in")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "unable to parse form", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Unable to parse form", "err", err)
+		return
+	}
+
+	currentPassword := r.FormValue("current_password")
+	newPassword := r.FormValue("new_password")
+
+	if err := ChangeUserPassword(c.config, user, GetAuthToken(r.Context()), currentPassword, newPassword); err != nil {
+		switch {
+		case errors.Is(err, ErrIncorrectPassword), errors.Is(err, ErrUserDisabled):
+			http.Error(w, "incorrect password", http.StatusForbidden)
+		case errors.Is(err, ErrWeakPassword):
+			httpError(w, err.Error(), ErrorCodeWeakPassword, http.StatusBadRequest)
+		case errors.Is(err, ErrPasswordManagedExternally):
+			httpError(w, err.Error(), ErrorCodePasswordManagedExternally, http.StatusConflict)
+		default:
+			http.Error(w, "error changing password", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Password change failed", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User changed their password")
+	auditRequest(c.config, r, AuditPasswordChange, user, "")
+}
+
+// DeleteAccount deletes the logged in user along with all of their
+// projects. The username must be repeated in the confirm query
+// parameter.
+func (c *Controller) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := GetAuthedUser(r.Context())
+	if user == "" {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "Not logged in")
+		return
+	}
+
+	if r.URL.Query().Get("confirm") != user {
+		http.Error(w, "confirm must match your username", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Account deletion not confirmed")
+		return
+	}
+
+	if err := DeleteUser(c.config, user); err != nil {
+		http.Error(w, "error deleting account", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting account", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User deleted their account")
+	auditRequest(c.config, r, AuditAccountDelete, user, "")
+}
+
+// ListTrash lists the logged in user's deleted projects and files
+func (c *Controller) ListTrash(w http.ResponseWriter, r *http.Request) {
+	user := GetAuthedUser(r.Context())
+	if user == "" {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	entries, err := ListTrash(c.config, user)
+	if err != nil {
+		http.Error(w, "Failed to list trash", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to list trash", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
+	}
+}
+
+// RestoreTrash puts a deleted project or file back
+func (c *Controller) RestoreTrash(w http.ResponseWriter, r *http.Request) {
+	user := GetAuthedUser(r.Context())
+	if user == "" {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "trashId"))
+	if err != nil {
+		http.Error(w, "Invalid trash id", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := RestoreTrash(c.config, user, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrTrashNotFound):
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		case errors.Is(err, ErrTrashConflict):
+			httpError(w, ErrTrashConflict.Error(), ErrorCodeTrashConflict, http.StatusConflict)
+		default:
+			http.Error(w, "Failed to restore from trash", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Unable to restore from trash", "err", err)
+		return
+	}
+
+	auditRequest(c.config, r, AuditTrashRestore, trashAuditTarget(user, entry), "")
+}
+
+// PurgeTrash permanently deletes one entry from the logged in user's
+// trash
+func (c *Controller) PurgeTrash(w http.ResponseWriter, r *http.Request) {
+	user := GetAuthedUser(r.Context())
+	if user == "" {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
 		return
 	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "trashId"))
+	if err != nil {
+		http.Error(w, "Invalid trash id", http.StatusBadRequest)
+		return
+	}
+
+	entry, err := PurgeTrash(c.config, user, id)
+	if err != nil {
+		if errors.Is(err, ErrTrashNotFound) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to purge trash", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Unable to purge trash", "err", err)
+		return
+	}
+
+	auditRequest(c.config, r, AuditTrashPurge, trashAuditTarget(user, entry), "")
+}
+
+// PurgeAllTrash empties the logged in user's trash
+func (c *Controller) PurgeAllTrash(w http.ResponseWriter, r *http.Request) {
+	user := GetAuthedUser(r.Context())
+	if user == "" {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	purged, err := PurgeAllTrash(c.config, user)
+	if err != nil {
+		http.Error(w, "Failed to purge trash", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to purge trash", "err", err)
+	}
+
+	// Entries purged before a failure are gone, so record them anyway
+	if purged > 0 {
+		auditRequest(c.config, r, AuditTrashPurge, user, fmt.Sprintf("all, %d entries", purged))
+	}
+}
+
+func trashAuditTarget(user string, entry TrashEntry) string {
+	if entry.Kind == TrashKindProject {
+		return fmt.Sprintf("%s/%s", user, entry.Project)
+	}
+	return fmt.Sprintf("%s/%s/%s", user, entry.Project, entry.Path)
 }
 
 func (c *Controller) ListProjects(w http.ResponseWriter, r *http.Request) {
@@ -91,7 +465,7 @@ func (c *Controller) ListProjects(w http.ResponseWriter, r *http.Request) {
 	infos, err := c.config.database.ListUserProjects(user)
 	if err != nil {
 		http.Error(w, "404 page not found", http.StatusNotFound)
-		log.Printf("GET %s: %s", r.URL.Path, err)
+		slog.WarnContext(r.Context(), "Unable to list projects", "err", err)
 		return
 	}
 
@@ -113,7 +487,7 @@ func (c *Controller) ListProjects(w http.ResponseWriter, r *http.Request) {
 	err = json.NewEncoder(w).Encode(userInfo)
 	if err != nil {
 		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
-		log.Printf("GET %s: %s", r.URL.Path, err)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
 		return
 	}
 }
@@ -122,7 +496,7 @@ func (c *Controller) CreateProject(w http.ResponseWriter, r *http.Request) {
 	user := chi.URLParam(r, "user")
 	if !IsUserAuthed(r.Context(), user) {
 		http.Error(w, "forbidden", http.StatusForbidden)
-		log.Printf("%s %s: %s", r.Method, r.URL.Path, "forbidden")
+		slog.WarnContext(r.Context(), "Forbidden")
 		return
 	}
 
@@ -134,11 +508,12 @@ func (c *Controller) CreateProject(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := NewProject(c.config, user, project); err != nil {
 		http.Error(w, "Failed to create new project", http.StatusInternalServerError)
-		log.Printf("POST /%s: %s", user, err)
+		slog.ErrorContext(r.Context(), "Failed to create new project", "err", err)
 		return
 	}
 
-	log.Printf("New project: %s/%s", user, project)
+	slog.InfoContext(r.Context(), "New project", "name", project)
+	auditRequest(c.config, r, AuditProjectCreate, fmt.Sprintf("%s/%s", user, project), "")
 }
 
 func (c *Controller) ProjectInfo(w http.ResponseWriter, r *http.Request) {
@@ -151,7 +526,7 @@ func (c *Controller) ProjectInfo(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "404 page not found", http.StatusNotFound)
 		} else {
 			http.Error(w, "Failed to retrieve project information", http.StatusInternalServerError)
-			log.Printf("GET /%s/%s: %s", user, project, err)
+			slog.ErrorContext(r.Context(), "Failed to retrieve project information", "err", err)
 		}
 		return
 	}
@@ -160,7 +535,7 @@ func (c *Controller) ProjectInfo(w http.ResponseWriter, r *http.Request) {
 	err = json.NewEncoder(w).Encode(projectInfo)
 	if err != nil {
 		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
-		log.Printf("GET /%s/%s: %s", user, project, err)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
 		return
 	}
 }
@@ -171,11 +546,40 @@ func (c *Controller) DeleteProject(w http.ResponseWriter, r *http.Request) {
 
 	if err := DeleteProject(c.config, user, project); err != nil {
 		http.Error(w, "Unable to delete project", http.StatusInternalServerError)
-		log.Printf("DELETE %s: %s", r.URL.Path, err)
+		slog.ErrorContext(r.Context(), "Unable to delete project", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Deleted project")
+	auditRequest(c.config, r, AuditProjectDelete, fmt.Sprintf("%s/%s", user, project), "")
+}
+
+// SetProjectVisibility makes a project public or private
+func (c *Controller) SetProjectVisibility(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	project := chi.URLParam(r, "project")
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Unable to parse form", "err", err)
+		return
+	}
+
+	public, err := strconv.ParseBool(r.FormValue("public"))
+	if err != nil {
+		http.Error(w, "public must be true or false", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Public must be true or false", "err", err)
+		return
+	}
+
+	if err := c.config.database.SetProjectPublic(user, project, public); err != nil {
+		http.Error(w, "Unable to set project visibility", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Unable to set project visibility", "err", err)
 		return
 	}
 
-	log.Printf("Deleted project: %s/%s", user, project)
+	slog.InfoContext(r.Context(), "Set project visibility", "public", public)
+	auditRequest(c.config, r, AuditProjectVisibility, fmt.Sprintf("%s/%s", user, project), fmt.Sprintf("public=%v", public))
 }
 
 func (c *Controller) BuildProject(w http.ResponseWriter, r *http.Request) {
@@ -184,7 +588,7 @@ func (c *Controller) BuildProject(w http.ResponseWriter, r *http.Request) {
 
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Unable to process request", http.StatusBadRequest)
-		log.Printf("POST %s: %s", r.URL.Path, err)
+		slog.WarnContext(r.Context(), "Unable to process request", "err", err)
 		return
 	}
 
@@ -207,29 +611,37 @@ func (c *Controller) BuildProject(w http.ResponseWriter, r *http.Request) {
 		Force: r.Form.Has("force"),
 	}
 
-	requestId := middleware.GetReqID(r.Context())
-
-	log.Printf("[%s] Build started: %s/%s %+v", requestId, user, project, options)
+	slog.InfoContext(r.Context(), "Build started", "options", options)
 
 	stdout, err := BuildProject(r.Context(), c.config, user, project, options)
 	if err != nil {
 		// If the error was the child process, return the output
 		var execErr *exec.ExitError
-		if errors.As(err, &execErr) {
-			http.Error(w, stdout, http.StatusUnprocessableEntity)
+		if errors.Is(err, ErrBuildCancelled) {
+			httpError(w, "Build cancelled", ErrorCodeBuildCancelled, http.StatusConflict)
+		} else if errors.As(err, &execErr) {
+			httpError(w, stdout, ErrorCodeBuildFailed, http.StatusUnprocessableEntity)
 		} else if errors.Is(err, ErrBuildInProgress) {
-			http.Error(w, "Build in progress", http.StatusConflict)
+			httpError(w, "Build in progress", ErrorCodeBuildInProgress, http.StatusConflict)
+		} else if errors.Is(err, ErrServerShuttingDown) {
+			w.Header().Set("Retry-After", "30")
+			httpError(w, "Server is shutting down", ErrorCodeShuttingDown, http.StatusServiceUnavailable)
 		} else {
 			http.Error(w, "Unable to build project", http.StatusInternalServerError)
 		}
-		log.Printf("POST %s: %s", r.URL.Path, err)
+		slog.WarnContext(r.Context(), "Build failed", "err", err)
 		return
 	}
 
-	log.Printf("[%s] Build finished: %s/%s", requestId, user, project)
+	slog.InfoContext(r.Context(), "Build finished")
+
+	if IsAPIRequest(r.Context()) {
+		writeJSON(w, r, BuildResult{ Output: stdout })
+		return
+	}
 
 	if _, err := fmt.Fprintln(w, stdout); err != nil {
-		log.Printf("POST %s: %s", r.URL.Path, err)
+		slog.WarnContext(r.Context(), "Unable to write build output", "err", err)
 	}
 }
 
@@ -240,7 +652,7 @@ func (c *Controller) ListSrcFiles(w http.ResponseWriter, r *http.Request) {
 	files, err := c.config.database.ListProjectFiles(user, project, "src")
 	if err != nil {
 		http.Error(w, "Failed to list project files", http.StatusInternalServerError)
-		log.Printf("GET %s: %s", r.URL.Path, err)
+		slog.ErrorContext(r.Context(), "Failed to list project files", "err", err)
 		return
 	}
 
@@ -248,7 +660,7 @@ func (c *Controller) ListSrcFiles(w http.ResponseWriter, r *http.Request) {
 	err = json.NewEncoder(w).Encode(files)
 	if err != nil {
 		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
-		log.Printf("GET %s: %s", r.URL.Path, err)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
 	}
 }
 
@@ -256,50 +668,86 @@ func (c *Controller) CreateSrcFile(w http.ResponseWriter, r *http.Request) {
 	user := chi.URLParam(r, "user")
 	project := chi.URLParam(r, "project")
 
-	if err := r.ParseMultipartForm(int64(c.config.MaxFileSize)); err != nil {
-		http.Error(w, "Unable to parse form", http.StatusBadRequest)
-		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+	// The rest of the form is small, it's only the path field
+	r.Body = http.MaxBytesReader(w, r.Body, int64(c.config.MaxFileSize) + 1024 * 1024)
+
+	expected, err := ParseExpectedFile(r.Header)
+	if err != nil {
+		http.Error(w, "Invalid file size or sha256sum header", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid file size or sha256sum header", "err", err)
 		return
 	}
 
-	file, fileHeader, err := r.FormFile("file")
+	form, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Unable to read form file", http.StatusBadRequest)
-		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Unable to parse form", "err", err)
 		return
 	}
-	_ = fileHeader
 
-	path := r.FormValue("path")
-	if path == "" {
-		http.Error(w, "Unable to read path", http.StatusBadRequest)
-		log.Printf("%s %s: %s", r.Method, r.URL.Path, "no file path")
+	precondition := ParseFilePrecondition(r.Header)
+	_, err = ReceiveProjectFile(c.config, user, project, form, expected, precondition, GetAuthToken(r.Context()))
+	var maxBytesError *http.MaxBytesError
+	if errors.Is(err, ErrFileTooLarge) || errors.As(err, &maxBytesError) {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		slog.WarnContext(r.Context(), "File too large", "err", err)
 		return
 	}
-
-	if err := CreateProjectFile(c.config, user, project, path, file); err != nil {
+	if errors.Is(err, ErrPreconditionFailed) {
+		http.Error(w, "File has changed on the server", http.StatusPreconditionFailed)
+		slog.WarnContext(r.Context(), "File has changed on the server", "err", err)
+		return
+	}
+	if errors.Is(err, ErrUploadMismatch) {
+		// The file was corrupted or changed while it was sent, the client
+		// should send it again
+		httpError(w, "Uploaded file does not match its size or sha256sum", ErrorCodeUploadMismatch, http.StatusUnprocessableEntity)
+		slog.WarnContext(r.Context(), "Uploaded file does not match its size or sha256sum", "err", err)
+		return
+	}
+	if errors.Is(err, ErrUploadIncomplete) {
+		http.Error(w, "Unable to read path or file", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Unable to read path or file", "err", err)
+		return
+	}
+	if err != nil {
 		http.Error(w, "Unable to create file", http.StatusInternalServerError)
-		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		slog.ErrorContext(r.Context(), "Unable to create file", "err", err)
 		return
 	}
 }
 
 func (c *Controller) ReadSrcFile(w http.ResponseWriter, r *http.Request) {
+	c.serveProjectFile(w, r, "src")
+}
+
+// serveProjectFile serves a file from a project subdir. Its sum from
+// the file list is used as the ETag, unless the file has changed since
+// it was listed.
+func (c *Controller) serveProjectFile(w http.ResponseWriter, r *http.Request, subdir string) {
 	user := chi.URLParam(r, "user")
 	project := chi.URLParam(r, "project")
 	path := chi.URLParam(r, "*")
 
-	file, err := ReadProjectFile(c.config, user, project, "src", path)
+	file, err := ReadProjectFile(c.config, user, project, subdir, path)
 	if err != nil {
 		http.Error(w, "Invalid file path", http.StatusBadRequest)
-		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		slog.WarnContext(r.Context(), "Invalid file path", "err", err)
 		return
 	}
 	defer file.Close()
 
-	if _, err := io.Copy(w, file); err != nil {
-		log.Printf("%s %s copy: %s", r.Method, r.URL.Path, err)
+	// The cached sum is only used as the ETag while the file is the
+	// same size and hasn't been modified since it was hashed, because
+	// a rewrite that keeps the size would otherwise keep the old ETag
+	var digest string
+	if info, err := c.config.database.GetProjectFileInfo(user, project, subdir, path); err == nil {
+		if stat, err := file.Stat(); err == nil && uint64(stat.Size()) == info.Size && stat.ModTime().UnixNano() == info.modTime {
+			digest = info.Sha256Sum
+		}
 	}
+
+	serveFile(w, r, path, file, digest, false)
 }
 
 func (c *Controller) DeleteSrcFile(w http.ResponseWriter, r *http.Request) {
@@ -307,83 +755,596 @@ func (c *Controller) DeleteSrcFile(w http.ResponseWriter, r *http.Request) {
 	project := chi.URLParam(r, "project")
 	path := chi.URLParam(r, "*")
 
-	if err := DeleteProjectFile(c.config, user, project, "src", path); err != nil {
-		http.Error(w, "Failed to delete file", http.StatusBadRequest)
-		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+	precondition := ParseFilePrecondition(r.Header)
+	if err := DeleteProjectFile(c.config, user, project, "src", path, precondition); err != nil {
+		if errors.Is(err, ErrPreconditionFailed) {
+			http.Error(w, "File has changed on the server", http.StatusPreconditionFailed)
+		} else {
+			http.Error(w, "Failed to delete file", http.StatusBadRequest)
+		}
+		slog.WarnContext(r.Context(), "Failed to delete file", "err", err)
 		return
 	}
+
+	auditRequest(c.config, r, AuditFileDelete, fmt.Sprintf("%s/%s/%s", user, project, path), "")
 }
 
-func (c *Controller) ListAuxFiles(w http.ResponseWriter, r *http.Request) {
+// MoveSrcFile moves or renames a src file or directory
+func (c *Controller) MoveSrcFile(w http.ResponseWriter, r *http.Request) {
 	user := chi.URLParam(r, "user")
 	project := chi.URLParam(r, "project")
+	from := r.PostFormValue("from")
+	to := r.PostFormValue("to")
 
-	files, err := c.config.database.ListProjectFiles(user, project, "aux")
-	if err != nil {
-		http.Error(w, "Failed to list project files", http.StatusInternalServerError)
-		log.Printf("GET %s: %s", r.URL.Path, err)
+	if from == "" || to == "" {
+		http.Error(w, "Missing from or to path", http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(files)
-	if err != nil {
-		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
-		log.Printf("GET %s: %s", r.URL.Path, err)
+	precondition := ParseFilePrecondition(r.Header)
+	if err := MoveProjectFile(c.config, user, project, from, to, precondition, GetAuthToken(r.Context())); err != nil {
+		if errors.Is(err, ErrPreconditionFailed) {
+			http.Error(w, "File has changed on the server", http.StatusPreconditionFailed)
+		} else if errors.Is(err, ErrFileNotFound) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		} else if errors.Is(err, ErrFileExists) {
+			httpError(w, "Destination already exists", ErrorCodeFileExists, http.StatusConflict)
+		} else {
+			http.Error(w, "Failed to move file", http.StatusBadRequest)
+		}
+		slog.WarnContext(r.Context(), "Unable to move file", "err", err)
+		return
 	}
+
+	auditRequest(c.config, r, AuditFileMove, fmt.Sprintf("%s/%s/%s", user, project, from), to)
 }
 
-func (c *Controller) ReadAuxFile(w http.ResponseWriter, r *http.Request) {
+// ListFileRevisions lists every revision of a src file
+func (c *Controller) ListFileRevisions(w http.ResponseWriter, r *http.Request) {
 	user := chi.URLParam(r, "user")
 	project := chi.URLParam(r, "project")
 	path := chi.URLParam(r, "*")
 
-	file, err := ReadProjectFile(c.config, user, project, "aux", path)
+	revisions, err := ListFileRevisions(c.config, user, project, path)
 	if err != nil {
-		http.Error(w, "Invalid file path", http.StatusBadRequest)
-		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		http.Error(w, "Failed to list file revisions", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to list file revisions", "err", err)
 		return
 	}
-	defer file.Close()
 
-	if _, err := io.Copy(w, file); err != nil {
-		log.Printf("%s %s copy: %s", r.Method, r.URL.Path, err)
+	if len(revisions) == 0 {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	// Token descriptions name the owner's machines, which readers of a
+	// public project have no business knowing
+	if !IsUserAuthed(r.Context(), user) {
+		for index := range revisions {
+			revisions[index].TokenID = nil
+			revisions[index].TokenDescription = ""
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(revisions); err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
 	}
 }
 
-func (c *Controller) ListOutFiles(w http.ResponseWriter, r *http.Request) {
+// ReadFileRevision returns the contents of one revision of a src file
+func (c *Controller) ReadFileRevision(w http.ResponseWriter, r *http.Request) {
 	user := chi.URLParam(r, "user")
 	project := chi.URLParam(r, "project")
+	path := chi.URLParam(r, "*")
 
-	files, err := c.config.database.ListProjectFiles(user, project, "out")
+	rev, err := strconv.Atoi(chi.URLParam(r, "rev"))
 	if err != nil {
-		http.Error(w, "Failed to list project files", http.StatusInternalServerError)
-		log.Printf("GET %s: %s", r.URL.Path, err)
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	blob, revision, err := OpenFileRevision(c.config, user, project, path, rev)
+	if err != nil {
+		if errors.Is(err, ErrRevisionNotFound) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read revision", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Unable to read revision", "err", err)
+		return
+	}
+	defer blob.Close()
+
+	serveContent(w, r, path, revision.CreatedAt, blob, revision.Sha256Sum, true)
+}
+
+// DiffFileRevisions returns a unified diff between two revisions of a
+// text src file
+func (c *Controller) DiffFileRevisions(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	project := chi.URLParam(r, "project")
+	path := chi.URLParam(r, "*")
+
+	from, fromErr := strconv.Atoi(chi.URLParam(r, "from"))
+	to, toErr := strconv.Atoi(chi.URLParam(r, "to"))
+	if fromErr != nil || toErr != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	diff, err := DiffFileRevisions(c.config, user, project, path, from, to)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRevisionNotFound):
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		case errors.Is(err, ErrRevisionNotText):
+			httpError(w, ErrRevisionNotText.Error(), ErrorCodeNotText, http.StatusUnprocessableEntity)
+		case errors.Is(err, ErrDiffTooLarge):
+			http.Error(w, ErrDiffTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		default:
+			http.Error(w, "Failed to diff revisions", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Unable to diff revisions", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	fmt.Fprint(w, diff)
+}
+
+// RestoreFileRevision makes an earlier revision of a src file the
+// current one
+func (c *Controller) RestoreFileRevision(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	project := chi.URLParam(r, "project")
+	path := chi.URLParam(r, "*")
+
+	rev, err := strconv.Atoi(chi.URLParam(r, "rev"))
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	if err := RestoreFileRevision(c.config, user, project, path, rev, GetAuthToken(r.Context())); err != nil {
+		if errors.Is(err, ErrRevisionNotFound) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to restore revision", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Unable to restore revision", "err", err)
+		return
+	}
+
+	auditRequest(c.config, r, AuditFileRestore, fmt.Sprintf("%s/%s/%s", user, project, path), fmt.Sprintf("revision %d", rev))
+}
+
+func (c *Controller) ListAuxFiles(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	project := chi.URLParam(r, "project")
+
+	files, err := c.config.database.ListProjectFiles(user, project, "aux")
+	if err != nil {
+		http.Error(w, "Failed to list project files", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to list project files", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(files)
 	if err != nil {
 		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
-		log.Printf("GET %s: %s", r.URL.Path, err)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
+	}
+}
+
+func (c *Controller) ReadAuxFile(w http.ResponseWriter, r *http.Request) {
+	c.serveProjectFile(w, r, "aux")
+}
+
+func (c *Controller) ListOutFiles(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	project := chi.URLParam(r, "project")
+
+	files, err := c.config.database.ListProjectFiles(user, project, "out")
+	if err != nil {
+		http.Error(w, "Failed to list project files", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to list project files", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(files)
+	if err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
 	}
 }
 
 func (c *Controller) ReadOutFile(w http.ResponseWriter, r *http.Request) {
+	c.serveProjectFile(w, r, "out")
+}
+
+// ListBuilds returns the most recent builds of a project, newest first
+func (c *Controller) ListBuilds(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	project := chi.URLParam(r, "project")
+
+	limit := 50
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	builds, err := ListProjectBuilds(c.config, user, project, limit)
+	if err != nil {
+		http.Error(w, "Failed to list builds", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to list builds", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(builds); err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
+	}
+}
+
+// BuildInfo returns a build of a project with its output and the
+// output files kept from it
+func (c *Controller) BuildInfo(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	project := chi.URLParam(r, "project")
+
+	buildId, err := strconv.Atoi(chi.URLParam(r, "buildId"))
+	if err != nil {
+		http.Error(w, "Invalid build id", http.StatusBadRequest)
+		return
+	}
+
+	build, err := GetProjectBuild(c.config, user, project, buildId)
+	if err != nil {
+		if errors.Is(err, ErrBuildNotFound) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to get build", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Unable to get build", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(build); err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
+	}
+}
+
+// ListBuildOutFiles returns the output files kept from a build
+func (c *Controller) ListBuildOutFiles(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	project := chi.URLParam(r, "project")
+
+	buildId, err := strconv.Atoi(chi.URLParam(r, "buildId"))
+	if err != nil {
+		http.Error(w, "Invalid build id", http.StatusBadRequest)
+		return
+	}
+
+	build, err := GetProjectBuild(c.config, user, project, buildId)
+	if err != nil {
+		if errors.Is(err, ErrBuildNotFound) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to get build", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Unable to get build", "err", err)
+		return
+	}
+
+	artifacts := build.Artifacts
+	if artifacts == nil {
+		artifacts = []BuildArtifact{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(artifacts); err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
+	}
+}
+
+// ReadBuildOutFile returns an output file kept from a build
+func (c *Controller) ReadBuildOutFile(w http.ResponseWriter, r *http.Request) {
 	user := chi.URLParam(r, "user")
 	project := chi.URLParam(r, "project")
 	path := chi.URLParam(r, "*")
 
-	file, err := ReadProjectFile(c.config, user, project, "out", path)
+	buildId, err := strconv.Atoi(chi.URLParam(r, "buildId"))
 	if err != nil {
-		http.Error(w, "Invalid file path", http.StatusBadRequest)
-		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		http.Error(w, "Invalid build id", http.StatusBadRequest)
+		return
+	}
+
+	file, artifact, err := OpenBuildArtifact(c.config, user, project, buildId, path)
+	if err != nil {
+		if errors.Is(err, ErrBuildArtifactNotFound) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read build output file", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Unable to read build output file", "err", err)
 		return
 	}
 	defer file.Close()
 
-	if _, err := io.Copy(w, file); err != nil {
-		log.Printf("%s %s copy: %s", r.Method, r.URL.Path, err)
+	serveFile(w, r, path, file, artifact.Sha256Sum, true)
+}
+
+// ReadBuildSrcFile returns a src file as it was when a build was run
+func (c *Controller) ReadBuildSrcFile(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	project := chi.URLParam(r, "project")
+	path := chi.URLParam(r, "*")
+
+	buildId, err := strconv.Atoi(chi.URLParam(r, "buildId"))
+	if err != nil {
+		http.Error(w, "Invalid build id", http.StatusBadRequest)
+		return
 	}
+
+	file, info, err := OpenBuildSource(c.config, user, project, buildId, path)
+	if err != nil {
+		if errors.Is(err, ErrBuildNotFound) || errors.Is(err, ErrBuildSourceNotFound) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to read build source file", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Unable to read build source file", "err", err)
+		return
+	}
+	defer file.Close()
+
+	serveFile(w, r, path, file, info.Sha256Sum, true)
+}
+
+func (c *Controller) AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	accounts, err := ListUsers(c.config)
+	if err != nil {
+		http.Error(w, "Failed to list users", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to list users", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(accounts)
+	if err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
+	}
+}
+
+func (c *Controller) AdminCreateUser(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Unable to parse form", "err", err)
+		return
+	}
+
+	user := r.FormValue("username")
+	password := r.FormValue("password")
+	if user == "" {
+		http.Error(w, "Missing username", http.StatusBadRequest)
+		return
+	}
+
+	if password != "" {
+		if err := ValidatePassword(c.config, user, password); err != nil {
+			httpError(w, err.Error(), ErrorCodeWeakPassword, http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Weak password", "err", err)
+			return
+		}
+	}
+
+	if err := CreateUser(c.config, user); err != nil {
+		if errors.Is(err, ErrForbiddenUsername) || errors.Is(err, ErrInvalidUsername) {
+			httpError(w, err.Error(), ErrorCodeInvalidUsername, http.StatusBadRequest)
+		} else {
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Unable to create user", "err", err)
+		return
+	}
+
+	if password != "" {
+		if err := SetUserPassword(c.config, user, password); err != nil {
+			http.Error(w, "Failed to set user password", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed to set user password", "err", err)
+			return
+		}
+	}
+
+	if r.Form.Has("admin") {
+		if err := SetUserAdmin(c.config, user, true); err != nil {
+			http.Error(w, "Failed to make user an admin", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed to make user an admin", "err", err)
+			return
+		}
+	}
+
+	slog.InfoContext(r.Context(), "Admin created user", "username", user)
+	auditRequest(c.config, r, AuditAdminUserCreate, user, fmt.Sprintf("admin=%v", r.Form.Has("admin")))
+}
+
+func (c *Controller) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+
+	if _, err := c.config.database.GetUserId(user); err != nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "User not found", "err", err)
+		return
+	}
+
+	if err := DeleteUser(c.config, user); err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to delete user", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Admin deleted user", "username", user)
+	auditRequest(c.config, r, AuditAdminUserDelete, user, "")
+}
+
+func (c *Controller) AdminDisableUser(w http.ResponseWriter, r *http.Request) {
+	c.adminSetUserDisabled(w, r, true)
+}
+
+func (c *Controller) AdminEnableUser(w http.ResponseWriter, r *http.Request) {
+	c.adminSetUserDisabled(w, r, false)
+}
+
+func (c *Controller) adminSetUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user := chi.URLParam(r, "user")
+
+	if err := SetUserDisabled(c.config, user, disabled); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		}
+		slog.WarnContext(r.Context(), "Unable to update user", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Admin set user disabled", "username", user, "disabled", disabled)
+	if disabled {
+		auditRequest(c.config, r, AuditAdminUserDisable, user, "")
+	} else {
+		auditRequest(c.config, r, AuditAdminUserEnable, user, "")
+	}
+}
+
+func (c *Controller) AdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Unable to parse form", "err", err)
+		return
+	}
+
+	password := r.FormValue("password")
+	if password == "" {
+		http.Error(w, "Missing password", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := c.config.database.GetUserId(user); err != nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "User not found", "err", err)
+		return
+	}
+
+	if err := ValidatePassword(c.config, user, password); err != nil {
+		httpError(w, err.Error(), ErrorCodeWeakPassword, http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Weak password", "err", err)
+		return
+	}
+
+	if err := SetUserPassword(c.config, user, password); err != nil {
+		http.Error(w, "Failed to set user password", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to set user password", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Admin reset password", "username", user)
+	auditRequest(c.config, r, AuditAdminPasswordReset, user, "")
+}
+
+func (c *Controller) AdminListTokens(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+
+	tokens, err := ListUserTokens(c.config, user)
+	if err != nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Unable to list tokens", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(tokens)
+	if err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
+	}
+}
+
+func (c *Controller) AdminRevokeAllTokens(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+
+	if err := DeleteAllUserTokens(c.config, user); err != nil {
+		http.Error(w, "error deleting tokens", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting tokens", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Admin revoked all tokens", "username", user)
+	auditRequest(c.config, r, AuditAdminTokenDelete, user, "all")
+}
+
+func (c *Controller) AdminRevokeToken(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	tokenId, err := strconv.Atoi(chi.URLParam(r, "tokenId"))
+	if err != nil {
+		http.Error(w, "Invalid token id", http.StatusBadRequest)
+		return
+	}
+
+	if err := DeleteUserTokenById(c.config, user, tokenId); err != nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Token not found", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Admin revoked token", "username", user, "tokenId", tokenId)
+	auditRequest(c.config, r, AuditAdminTokenDelete, user, fmt.Sprintf("id=%d", tokenId))
+}
+
+func (c *Controller) AdminListProjects(w http.ResponseWriter, r *http.Request) {
+	userInfos, err := c.config.database.ListAllProjects()
+	if err != nil {
+		http.Error(w, "Failed to list projects", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to list projects", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(userInfos)
+	if err != nil {
+		http.Error(w, "Failed to serialize json", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
+	}
+}
+
+func (c *Controller) AdminCancelBuild(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	project := chi.URLParam(r, "project")
+
+	if err := CancelProjectBuild(c.config, user, project); err != nil {
+		if errors.Is(err, ErrNoBuildRunning) {
+			httpError(w, "No build running", ErrorCodeNoBuildRunning, http.StatusConflict)
+		} else {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+		}
+		slog.WarnContext(r.Context(), "Unable to cancel build", "err", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Admin cancelled build")
+	auditRequest(c.config, r, AuditAdminBuildCancel, fmt.Sprintf("%s/%s", user, project), "")
 }
@@ -4,7 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -66,12 +66,13 @@ func (db *Database) Migrate() error {
 	}
 
 	for index, migration := range migrations[lowestMigration:] {
-		log.Printf("Running database migration %d", index)
+		version := lowestMigration + index + 1
+		slog.Info("Running database migration", "version", version)
 		if _, err := db.conn.Exec(migration); err != nil {
 			return fmt.Errorf("Migrate applying migration: %w", err)
 		}
 
-		if _, err := db.conn.Exec("UPDATE schema_migration SET version = ?", index + 1); err != nil {
+		if _, err := db.conn.Exec("UPDATE schema_migration SET version = ?", version); err != nil {
 			return fmt.Errorf("Migrate: applying migration: %w", err)
 		}
 	}
@@ -87,11 +88,14 @@ type ProjectInfo struct {
 }
 
 type BuildInfo struct {
+	ID int `json:"id"`
 	BuildStart time.Time `json:"buildStart"`
 	BuildTime float64 `json:"buildTime"`
 	Status string     `json:"status"`
 	Options ProjectBuildOptions `json:"options"`
 	BuildOut string    `json:"buildOut"`
+	Artifacts []BuildArtifact `json:"artifacts,omitempty"` // Output files kept from the build, if it finished and hasn't been pruned
+	Manifest []FileInfo `json:"manifest,omitempty"` // Src files the build was run with
 }
 
 func (db *Database) ListUserProjects(user string) ([]ProjectInfo, error) {
@@ -139,7 +143,6 @@ ORDER BY
 		var unparsedOptions string
 		var createdAt string
 		var buildStart string
-		var buildId int
 		if err := rows.Scan(
 			&projectInfo.Name,
 			&projectInfo.Public,
@@ -148,7 +151,7 @@ ORDER BY
 			&projectInfo.LatestBuild.BuildTime,
 			&projectInfo.LatestBuild.Status,
 			&unparsedOptions,
-			&buildId,
+			&projectInfo.LatestBuild.ID,
 		); err != nil {
 			return nil, fmt.Errorf("ListUserProjects scan: %w", err)
 		}
@@ -173,6 +176,39 @@ ORDER BY
 	return infos, nil
 }
 
+// ListAllProjects returns the projects of every user on the server
+func (db *Database) ListAllProjects() ([]UserInfo, error) {
+	rows, err := db.conn.Query("SELECT name FROM users ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("ListAllProjects query: %w", err)
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			return nil, fmt.Errorf("ListAllProjects scan: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("ListAllProjects rows error: %w", rows.Err())
+	}
+
+	var userInfos []UserInfo
+	for _, user := range users {
+		projects, err := db.ListUserProjects(user)
+		if err != nil {
+			return nil, fmt.Errorf("ListAllProjects: %w", err)
+		}
+		userInfos = append(userInfos, UserInfo{ Name: user, Projects: projects })
+	}
+
+	return userInfos, nil
+}
+
 func (db *Database) GetProjectInfo(user string, project string) (ProjectInfo, error) {
 	projectId, err := db.GetProjectId(user, project)
 	if err != nil {
@@ -188,7 +224,8 @@ SELECT
   COALESCE(b.build_time, 0),
   COALESCE(b.status, ''),
   COALESCE(b.options, '{}'),
-  COALESCE(b.build_out, '')
+  COALESCE(b.build_out, ''),
+  COALESCE(b.id, 0)
 FROM
   projects p
 LEFT JOIN
@@ -219,6 +256,7 @@ LIMIT 1
 		&projectInfo.LatestBuild.Status,
 		&unparsedOptions,
 		&projectInfo.LatestBuild.BuildOut,
+		&projectInfo.LatestBuild.ID,
 	); err != nil {
 		return ProjectInfo{}, fmt.Errorf("GetProjectInfo scan: %w", err)
 	}
@@ -272,6 +310,27 @@ func (db *Database) ListProjectFiles(user string, projectName string, subdir str
 	return fileInfo, nil
 }
 
+// GetProjectFileInfo returns the cached size, sum and modification
+// time of a file in the subdir of a project directory
+func (db *Database) GetProjectFileInfo(user, projectName, subdir, path string) (FileInfo, error) {
+	projectId, err := db.GetProjectId(user, projectName)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("GetProjectFileInfo: %w", err)
+	}
+
+	info := FileInfo{ Path: path }
+	if err := db.conn.QueryRow(
+		"SELECT size, sha256sum, COALESCE(mod_time, 0) FROM files WHERE project_id = ? AND subdir = ? AND path = ?",
+		projectId,
+		subdir,
+		path,
+	).Scan(&info.Size, &info.Sha256Sum, &info.modTime); err != nil {
+		return FileInfo{}, fmt.Errorf("GetProjectFileInfo scan: %w", err)
+	}
+
+	return info, nil
+}
+
 // GetProjectId returns the id of a project under a user
 func (db *Database) GetProjectId(user string, project string) (int, error) {
 	row := db.conn.QueryRow(
@@ -308,17 +367,11 @@ func (db *Database) GetUserId(user string) (int, error) {
 
 // SetProjectPublic sets a project's public flag
 func (db *Database) SetProjectPublic(user, project string, public bool) error {
-	var pubStr string
-	if public {
-		pubStr = "true"
-	} else {
-		pubStr = "false"
-	}
 	projectId, err := db.GetProjectId(user, project)
 	if err != nil {
 		return fmt.Errorf("Database.SetProjectPublic get project id: %w", err)
 	}
-	if _, err := db.conn.Exec("UPDATE projects SET public = ? WHERE id = ?", pubStr, projectId); err != nil {
+	if _, err := db.conn.Exec("UPDATE projects SET public = ? WHERE id = ?", public, projectId); err != nil {
 		return fmt.Errorf("Database.SetProjectPublic db exec: %w", err)
 	}
 	return nil
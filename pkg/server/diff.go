@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Largest texts that are diffed. Diffing takes time proportional to
+// the number of lines times the number of differences, so both are
+// capped to keep anyone who can read a project from tying up the server.
+const (
+	diffMaxBytes = 1024 * 1024
+	diffMaxLines = 5000
+)
+
+var ErrDiffTooLarge = errors.New("file is too large to diff")
+
+// CheckDiffSize returns ErrDiffTooLarge if text is larger than the
+// texts diffLines is allowed to compare
+func CheckDiffSize(text []byte) error {
+	if len(text) > diffMaxBytes || bytes.Count(text, []byte("\n")) > diffMaxLines {
+		return ErrDiffTooLarge
+	}
+	return nil
+}
+
+// IsText returns true if contents look like text that can be diffed
+func IsText(contents []byte) bool {
+	return utf8.Valid(contents) && bytes.IndexByte(contents, 0) == -1
+}
+
+// diffLine is a single line of a line-based diff. op is ' ' for a line
+// both sides have, '-' for a removed line, and '+' for an added one.
+type diffLine struct {
+	op byte
+	text string
+}
+
+// diffLines finds the shortest edit script turning a into b using
+// Myers' algorithm, splitting the problem at the middle snake of each
+// edit script so it only needs linear space
+func diffLines(a, b []string) []diffLine {
+	lines := make([]diffLine, 0, len(a) + len(b))
+	return appendDiffLines(lines, a, b)
+}
+
+func appendDiffLines(lines []diffLine, a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for _, text := range a[:prefix] {
+		lines = append(lines, diffLine{ op: ' ', text: text })
+	}
+	a, b = a[prefix:], b[prefix:]
+
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a) - 1 - suffix] == b[len(b) - 1 - suffix] {
+		suffix++
+	}
+	common := a[len(a) - suffix:]
+	a, b = a[:len(a) - suffix], b[:len(b) - suffix]
+
+	switch {
+	case len(a) == 0:
+		for _, text := range b {
+			lines = append(lines, diffLine{ op: '+', text: text })
+		}
+	case len(b) == 0:
+		for _, text := range a {
+			lines = append(lines, diffLine{ op: '-', text: text })
+		}
+	default:
+		x, y, u, v := middleSnake(a, b)
+		lines = appendDiffLines(lines, a[:x], b[:y])
+		for _, text := range a[x:u] {
+			lines = append(lines, diffLine{ op: ' ', text: text })
+		}
+		lines = appendDiffLines(lines, a[u:], b[v:])
+	}
+
+	for _, text := range common {
+		lines = append(lines, diffLine{ op: ' ', text: text })
+	}
+
+	return lines
+}
+
+// middleSnake returns the snake from (x, y) to (u, v) in the middle of
+// the shortest edit script turning a into b, by searching from both
+// ends at once until the two searches overlap. a and b must differ in
+// their first and last lines, so the halves around the snake are both
+// smaller than the whole.
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	odd := delta % 2 != 0
+	max := (n + m + 1) / 2
+	offset := max + 1
+
+	// forward[k] is the furthest reaching x on diagonal k = x - y from
+	// the start, and backward[k] how far back from the end diagonal
+	// k = (n - x) - (m - y) reaches
+	forward := make([]int, 2 * max + 3)
+	backward := make([]int, 2 * max + 3)
+
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset + k - 1] < forward[offset + k + 1]) {
+				x = forward[offset + k + 1]
+			} else {
+				x = forward[offset + k - 1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset + k] = x
+
+			if odd && delta - k >= -(d - 1) && delta - k <= d - 1 && x + backward[offset + delta - k] >= n {
+				return startX, startY, x, y
+			}
+		}
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset + k - 1] < backward[offset + k + 1]) {
+				x = backward[offset + k + 1]
+			} else {
+				x = backward[offset + k - 1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && a[n - x - 1] == b[m - y - 1] {
+				x++
+				y++
+			}
+			backward[offset + k] = x
+
+			if !odd && delta - k >= -d && delta - k <= d && x + forward[offset + delta - k] >= n {
+				return n - x, m - y, n - startX, m - startY
+			}
+		}
+	}
+
+	// The searches always meet by the time each has gone half way
+	panic("middleSnake: searches didn't overlap")
+}
+
+// splitLines splits text into lines without their line endings
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// UnifiedDiff returns a unified diff between two texts with the given
+// number of context lines, or an empty string if they're the same
+func UnifiedDiff(fromName, toName, from, to string, context int) string {
+	lines := diffLines(splitLines(from), splitLines(to))
+
+	// Line number on each side at the start of every diff line
+	fromLine := make([]int, len(lines) + 1)
+	toLine := make([]int, len(lines) + 1)
+	for index, line := range lines {
+		fromLine[index + 1] = fromLine[index]
+		toLine[index + 1] = toLine[index]
+		if line.op != '+' {
+			fromLine[index + 1]++
+		}
+		if line.op != '-' {
+			toLine[index + 1]++
+		}
+	}
+
+	var builder strings.Builder
+	previousEnd := 0
+
+	for index := 0; index < len(lines); {
+		for index < len(lines) && lines[index].op == ' ' {
+			index++
+		}
+		if index == len(lines) {
+			break
+		}
+
+		if builder.Len() == 0 {
+			fmt.Fprintf(&builder, "--- %s\n+++ %s\n", fromName, toName)
+		}
+
+		start := index - context
+		if start < previousEnd {
+			start = previousEnd
+		}
+
+		// Changes separated by less than two contexts share a hunk
+		end := index
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			run := 0
+			for end + run < len(lines) && lines[end + run].op == ' ' {
+				run++
+			}
+			if end + run == len(lines) || run > 2 * context {
+				break
+			}
+			end += run
+		}
+		end += context
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		fmt.Fprintf(&builder, "@@ -%s +%s @@\n",
+			hunkRange(fromLine[start], fromLine[end] - fromLine[start]),
+			hunkRange(toLine[start], toLine[end] - toLine[start]),
+		)
+		for _, line := range lines[start:end] {
+			builder.WriteByte(line.op)
+			builder.WriteString(line.text)
+			builder.WriteByte('\n')
+		}
+
+		previousEnd = end
+		index = end
+	}
+
+	return builder.String()
+}
+
+// hunkRange formats the start and length of one side of a hunk. An
+// empty range refers to the line before it.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start + 1, length)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lcsLength returns the length of the longest common subsequence of a
+// and b, which the shortest edit script keeps
+func lcsLength(a, b []string) int {
+	previous := make([]int, len(b) + 1)
+	current := make([]int, len(b) + 1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				current[j + 1] = previous[j] + 1
+			case previous[j + 1] > current[j]:
+				current[j + 1] = previous[j + 1]
+			default:
+				current[j + 1] = current[j]
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func TestDiffLines(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, random.Intn(30))
+		for index := range lines {
+			lines[index] = string(rune('a' + random.Intn(4)))
+		}
+		return lines
+	}
+
+	for iteration := 0; iteration < 2000; iteration++ {
+		a, b := randomLines(), randomLines()
+		lines := diffLines(a, b)
+
+		var from, to []string
+		kept := 0
+		for _, line := range lines {
+			if line.op != '+' {
+				from = append(from, line.text)
+			}
+			if line.op != '-' {
+				to = append(to, line.text)
+			}
+			if line.op == ' ' {
+				kept++
+			}
+		}
+
+		if strings.Join(from, "\n") != strings.Join(a, "\n") || strings.Join(to, "\n") != strings.Join(b, "\n") {
+			t.Fatalf("diff of %q and %q doesn't rebuild them: %v", a, b, lines)
+		}
+		if expected := lcsLength(a, b); kept != expected {
+			t.Fatalf("diff of %q and %q keeps %d lines, expected %d", a, b, kept, expected)
+		}
+	}
+}
+
+func TestDiffLinesLargeInput(t *testing.T) {
+	a := make([]string, diffMaxLines)
+	b := make([]string, diffMaxLines)
+	for index := range a {
+		a[index] = "a" + strings.Repeat("x", index % 7)
+		b[index] = "b" + strings.Repeat("y", index % 5)
+	}
+
+	start := time.Now()
+	lines := diffLines(a, b)
+	if len(lines) != 2 * diffMaxLines {
+		t.Fatalf("expected %d diff lines, got %d", 2 * diffMaxLines, len(lines))
+	}
+	if elapsed := time.Since(start); elapsed > 10 * time.Second {
+		t.Fatalf("diffing %d dissimilar lines took %s", diffMaxLines, elapsed)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package server
+
+import (
+	"errors"
+)
+
+// freeDiskSpace isn't supported on this platform
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("freeDiskSpace: not supported on this platform")
+}
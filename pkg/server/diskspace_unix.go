@@ -0,0 +1,18 @@
+//go:build unix
+
+package server
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// freeDiskSpace returns the bytes available to unprivileged users on
+// the filesystem a path is on
+func freeDiskSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("freeDiskSpace: %w", err)
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
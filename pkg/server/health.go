@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a single check may take
+const healthCheckTimeout = 5 * time.Second
+
+// How long the result of checking the TeX toolchain is reused for.
+// Readiness is checked often, and the toolchain doesn't change much.
+const toolchainCheckTTL = time.Minute
+
+// HealthCheck is the result of checking one thing the server needs
+type HealthCheck struct {
+	Name string `json:"name"`
+	OK bool `json:"ok"`
+	Detail string `json:"detail,omitempty"` // Why the check failed, or what it found
+	err error
+}
+
+// HealthReport is the result of all of the checks of a probe
+type HealthReport struct {
+	Status string `json:"status"` // ok if every check passed, otherwise fail
+	Checks []HealthCheck `json:"checks"`
+}
+
+// OK reports whether every check passed
+func (r HealthReport) OK() bool {
+	return r.Status == "ok"
+}
+
+func newHealthReport(checks []HealthCheck) HealthReport {
+	report := HealthReport{ Status: "ok", Checks: checks }
+	for _, check := range checks {
+		if !check.OK {
+			report.Status = "fail"
+		}
+	}
+	return report
+}
+
+func runHealthCheck(ctx context.Context, name string, check func(ctx context.Context) (string, error)) HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	detail, err := check(ctx)
+	if err != nil {
+		// A check that ran out of time fails with whatever stopping it
+		// caused, so keep why it was stopped
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+		return HealthCheck{ Name: name, OK: false, Detail: err.Error(), err: err }
+	}
+	return HealthCheck{ Name: name, OK: true, Detail: detail }
+}
+
+// CheckHealth checks that the server can serve requests: the database
+// can be queried, and the project directory can be written to and has
+// enough free space
+func CheckHealth(ctx context.Context, config Config) HealthReport {
+	return newHealthReport(healthChecks(ctx, config))
+}
+
+// CheckReadiness checks everything CheckHealth does, and that projects
+// can be built. The server isn't ready while it's stopping.
+func CheckReadiness(ctx context.Context, config Config) HealthReport {
+	checks := healthChecks(ctx, config)
+	checks = append(checks, checkToolchainCached(config)...)
+	if config.builds.Draining() {
+		checks = append(checks, HealthCheck{ Name: "builds", OK: false, Detail: "server is shutting down" })
+	}
+	return newHealthReport(checks)
+}
+
+func healthChecks(ctx context.Context, config Config) []HealthCheck {
+	return []HealthCheck{
+		runHealthCheck(ctx, "database", func(ctx context.Context) (string, error) {
+			return "", config.database.Check(ctx)
+		}),
+		runHealthCheck(ctx, "projectDir", func(ctx context.Context) (string, error) {
+			return "", checkWritable(config.ProjectDir)
+		}),
+		runHealthCheck(ctx, "diskSpace", func(ctx context.Context) (string, error) {
+			return checkDiskSpace(config.ProjectDir, config.MinFreeSpace)
+		}),
+	}
+}
+
+// Check queries the database, and checks that it's been migrated to the
+// schema the server expects
+func (db *Database) Check(ctx context.Context) error {
+	var version int
+	if err := db.conn.QueryRowContext(ctx, "SELECT version FROM schema_migration").Scan(&version); err != nil {
+		return fmt.Errorf("Database check: %w", err)
+	}
+	if version != len(migrations) {
+		return fmt.Errorf("Database check: schema version %d, expected %d", version, len(migrations))
+	}
+	return nil
+}
+
+// checkWritable creates and removes a file in a directory
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return fmt.Errorf("checkWritable: %w", err)
+	}
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return fmt.Errorf("checkWritable: %w", err)
+	}
+	return nil
+}
+
+// checkDiskSpace checks that a directory's filesystem has at least min
+// bytes free
+func checkDiskSpace(dir string, min uint64) (string, error) {
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		return "", fmt.Errorf("checkDiskSpace: %w", err)
+	}
+	if free < min {
+		return "", fmt.Errorf("checkDiskSpace: %d bytes free, %d required", free, min)
+	}
+	return fmt.Sprintf("%d bytes free", free), nil
+}
+
+// TeXTool is a program builds run
+type TeXTool struct {
+	Name string
+	Args []string // Arguments that make it print its version
+}
+
+// TeXTools returns the programs builds with a config can run: latexmk
+// and the engines it's allowed to use
+func TeXTools(config Config) []TeXTool {
+	tools := []TeXTool{
+		{ Name: "latexmk", Args: []string{"-v"} },
+		{ Name: "pdflatex", Args: []string{"--version"} },
+		{ Name: "xelatex", Args: []string{"--version"} },
+	}
+	if config.AllowLuaTex {
+		tools = append(tools, TeXTool{ Name: "lualatex", Args: []string{"--version"} })
+	}
+	return tools
+}
+
+// Version runs a tool and returns the first line it prints, which is
+// its version for every tool TeX Live installs
+func (t TeXTool) Version(ctx context.Context) (string, error) {
+	path, err := exec.LookPath(t.Name)
+	if err != nil {
+		return "", fmt.Errorf("TeXTool version: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, path, t.Args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("TeXTool version %s: %w", t.Name, err)
+	}
+
+	line, _, _ := strings.Cut(string(out), "\n")
+	line = strings.TrimSpace(line)
+	if line == "" {
+		line = path
+	}
+	return line, nil
+}
+
+// TeXLive prints the version of TeX Live it's part of
+var TeXLive = TeXTool{ Name: "tex", Args: []string{"--version"} }
+
+// CheckToolchain checks that every program builds may run can be run
+func CheckToolchain(ctx context.Context, config Config) []HealthCheck {
+	if config.BuildMode != BuildModeNative {
+		return []HealthCheck{
+			{ Name: "buildMode", OK: false, Detail: fmt.Sprintf("%s build mode not yet implemented", config.BuildMode) },
+		}
+	}
+
+	var checks []HealthCheck
+	for _, tool := range TeXTools(config) {
+		checks = append(checks, runHealthCheck(ctx, tool.Name, tool.Version))
+	}
+	return checks
+}
+
+var toolchainCache struct {
+	mutex sync.Mutex
+	checkedAt time.Time
+	checks []HealthCheck
+}
+
+// checkToolchainCached is CheckToolchain, reusing a recent result. The
+// result is shared by every probe, so it isn't tied to the request of
+// the one that happens to run it, and a check that timed out isn't
+// reused.
+func checkToolchainCached(config Config) []HealthCheck {
+	toolchainCache.mutex.Lock()
+	defer toolchainCache.mutex.Unlock()
+
+	if toolchainCache.checks != nil && time.Since(toolchainCache.checkedAt) <= toolchainCheckTTL {
+		return toolchainCache.checks
+	}
+
+	checks := CheckToolchain(context.Background(), config)
+	toolchainCache.checks = checks
+	toolchainCache.checkedAt = time.Now()
+	for _, check := range checks {
+		if errors.Is(check.err, context.DeadlineExceeded) || errors.Is(check.err, context.Canceled) {
+			toolchainCache.checks = nil
+			break
+		}
+	}
+	return checks
+}
+
+// serveHealthReport responds with a report, as service unavailable if
+// any of its checks failed. Details can name paths and say what went
+// wrong with the database, so only administrators get them, and
+// everyone else only sees which checks passed.
+func serveHealthReport(w http.ResponseWriter, r *http.Request, config Config, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.OK() {
+		for _, check := range report.Checks {
+			if !check.OK {
+				slog.WarnContext(r.Context(), "Health check failed", "check", check.Name, "err", check.Detail)
+			}
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	admin := false
+	if user := GetAuthedUser(r.Context()); user != "" {
+		admin, _ = IsUserAdmin(config, user)
+	}
+	if !admin {
+		checks := make([]HealthCheck, len(report.Checks))
+		for index, check := range report.Checks {
+			checks[index] = HealthCheck{ Name: check.Name, OK: check.OK }
+		}
+		report.Checks = checks
+	}
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to serialize json", "err", err)
+	}
+}
+
+// Health reports whether the server can serve requests
+func (c *Controller) Health(w http.ResponseWriter, r *http.Request) {
+	serveHealthReport(w, r, c.config, CheckHealth(r.Context(), c.config))
+}
+
+// Ready reports whether the server can serve requests and build
+// projects
+func (c *Controller) Ready(w http.ResponseWriter, r *http.Request) {
+	serveHealthReport(w, r, c.config, CheckReadiness(r.Context(), c.config))
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Every version of a project's src files is kept in the project's
+// .history directory, named by the sha256 sum of its contents so
+// identical versions are only stored once
+const historyDirName = ".history"
+
+// FileRevision is one version of a project src file
+type FileRevision struct {
+	Revision int `json:"revision"`
+	Sha256Sum string `json:"sha256sum"`
+	Size uint64 `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	TokenID *int `json:"tokenId,omitempty"` // Token used to upload the revision, if it still exists
+	TokenDescription string `json:"tokenDescription,omitempty"`
+}
+
+var ErrRevisionNotFound = errors.New("revision not found")
+var ErrRevisionNotText = errors.New("revision is not a text file")
+
+func historyPath(projectPath string) string {
+	return filepath.Join(projectPath, historyDirName)
+}
+
+// createRevisionBlob creates a temporary file in the project's history
+// directory for a new revision to be written to. It's moved into place
+// by storeRevisionBlob once its sum is known.
+func createRevisionBlob(projectPath string) (*os.File, error) {
+	if err := os.MkdirAll(historyPath(projectPath), 0700); err != nil {
+		return nil, fmt.Errorf("createRevisionBlob MkdirAll: %w", err)
+	}
+
+	blob, err := os.CreateTemp(historyPath(projectPath), "upload-")
+	if err != nil {
+		return nil, fmt.Errorf("createRevisionBlob: %w", err)
+	}
+
+	return blob, nil
+}
+
+// storeRevisionBlob moves a finished temporary blob to its permanent
+// name, unless a revision with the same contents is already stored
+func storeRevisionBlob(projectPath, tempPath, digest string) error {
+	blobPath := filepath.Join(historyPath(projectPath), digest)
+
+	if _, err := os.Stat(blobPath); err == nil {
+		return os.Remove(tempPath)
+	}
+
+	if err := os.Rename(tempPath, blobPath); err != nil {
+		return fmt.Errorf("storeRevisionBlob: %w", err)
+	}
+
+	return nil
+}
+
+// recordFileRevision adds a revision to a file's history, unless it's
+// the same as the latest one
+func recordFileRevision(config Config, projectId int, path, digest string, size int64, createdAt time.Time, token string) error {
+	var latest string
+	err := config.database.conn.QueryRow(
+		"SELECT sha256sum FROM file_revisions WHERE project_id = ? AND path = ? ORDER BY revision DESC LIMIT 1",
+		projectId,
+		path,
+	).Scan(&latest)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("recordFileRevision latest revision: %w", err)
+	}
+	if latest == digest {
+		return nil
+	}
+
+	var tokenId, tokenDescription any
+	if token != "" {
+		if info, err := GetTokenInfo(config, token); err == nil {
+			tokenId = info.ID
+			tokenDescription = info.Description
+		}
+	}
+
+	if _, err := config.database.conn.Exec(`
+INSERT INTO file_revisions (project_id, path, revision, sha256sum, size, created_at, token_id, token_description)
+SELECT ?, ?, COALESCE(MAX(revision), 0) + 1, ?, ?, ?, ?, ?
+FROM file_revisions
+WHERE project_id = ? AND path = ?`,
+		projectId,
+		path,
+		digest,
+		size,
+		createdAt.UTC().Format(SQLiteTime),
+		tokenId,
+		tokenDescription,
+		projectId,
+		path,
+	); err != nil {
+		return fmt.Errorf("recordFileRevision insert: %w", err)
+	}
+
+	return nil
+}
+
+// importUntrackedRevision records the current contents of a file as
+// its first revision, if it was uploaded before revision history
+// existed, so overwriting it doesn't lose them
+func importUntrackedRevision(config Config, projectId int, projectPath, path string) error {
+	var count int
+	if err := config.database.conn.QueryRow(
+		"SELECT COUNT(*) FROM file_revisions WHERE project_id = ? AND path = ?",
+		projectId,
+		path,
+	).Scan(&count); err != nil {
+		return fmt.Errorf("importUntrackedRevision count: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	file, err := os.Open(filepath.Join(projectPath, "src", path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("importUntrackedRevision open: %w", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("importUntrackedRevision stat: %w", err)
+	}
+	if !stat.Mode().IsRegular() {
+		return nil
+	}
+
+	blob, err := createRevisionBlob(projectPath)
+	if err != nil {
+		return fmt.Errorf("importUntrackedRevision: %w", err)
+	}
+	defer os.Remove(blob.Name())
+	defer blob.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(blob, hasher), file)
+	if err != nil {
+		return fmt.Errorf("importUntrackedRevision copy: %w", err)
+	}
+	if err := blob.Close(); err != nil {
+		return fmt.Errorf("importUntrackedRevision close blob: %w", err)
+	}
+
+	digest := fmt.Sprintf("%x", hasher.Sum(nil))
+	if err := storeRevisionBlob(projectPath, blob.Name(), digest); err != nil {
+		return fmt.Errorf("importUntrackedRevision: %w", err)
+	}
+
+	if err := recordFileRevision(config, projectId, path, digest, size, stat.ModTime(), ""); err != nil {
+		return fmt.Errorf("importUntrackedRevision: %w", err)
+	}
+
+	return nil
+}
+
+// ListFileRevisions returns the history of a project src file, oldest
+// first. Deleted files keep their history.
+func ListFileRevisions(config Config, user, projectName, path string) ([]FileRevision, error) {
+	projectId, err := config.database.GetProjectId(user, projectName)
+	if err != nil {
+		return nil, fmt.Errorf("ListFileRevisions: %w", err)
+	}
+
+	rows, err := config.database.conn.Query(
+		"SELECT revision, sha256sum, size, created_at, token_id, COALESCE(token_description, '') FROM file_revisions WHERE project_id = ? AND path = ? ORDER BY revision",
+		projectId,
+		path,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ListFileRevisions query: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := []FileRevision{}
+
+	for rows.Next() {
+		revision, err := scanFileRevision(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ListFileRevisions: %w", err)
+		}
+		revisions = append(revisions, revision)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("ListFileRevisions rows error: %w", rows.Err())
+	}
+
+	return revisions, nil
+}
+
+func scanFileRevision(scanner interface{ Scan(...any) error }) (FileRevision, error) {
+	var revision FileRevision
+	var createdAt string
+	var tokenId sql.NullInt64
+	if err := scanner.Scan(
+		&revision.Revision,
+		&revision.Sha256Sum,
+		&revision.Size,
+		&createdAt,
+		&tokenId,
+		&revision.TokenDescription,
+	); err != nil {
+		return FileRevision{}, fmt.Errorf("scan: %w", err)
+	}
+
+	if tokenId.Valid {
+		id := int(tokenId.Int64)
+		revision.TokenID = &id
+	}
+
+	var err error
+	revision.CreatedAt, err = time.Parse(SQLiteTime, createdAt)
+	if err != nil {
+		return FileRevision{}, fmt.Errorf("parse createdAt time: %w", err)
+	}
+
+	return revision, nil
+}
+
+// OpenFileRevision opens the contents of one revision of a project src
+// file
+func OpenFileRevision(config Config, user, projectName, path string, rev int) (*os.File, FileRevision, error) {
+	projectId, err := config.database.GetProjectId(user, projectName)
+	if err != nil {
+		return nil, FileRevision{}, fmt.Errorf("OpenFileRevision: %w", err)
+	}
+
+	revision, err := scanFileRevision(config.database.conn.QueryRow(
+		"SELECT revision, sha256sum, size, created_at, token_id, COALESCE(token_description, '') FROM file_revisions WHERE project_id = ? AND path = ? AND revision = ?",
+		projectId,
+		path,
+		rev,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, FileRevision{}, ErrRevisionNotFound
+	}
+	if err != nil {
+		return nil, FileRevision{}, fmt.Errorf("OpenFileRevision: %w", err)
+	}
+
+	projectPath := filepath.Join(config.ProjectDir, user, projectName)
+	blob, err := os.Open(filepath.Join(historyPath(projectPath), revision.Sha256Sum))
+	if err != nil {
+		return nil, FileRevision{}, fmt.Errorf("OpenFileRevision open blob: %w", err)
+	}
+
+	return blob, revision, nil
+}
+
+func readTextRevision(config Config, user, projectName, path string, rev int) (string, error) {
+	blob, _, err := OpenFileRevision(config, user, projectName, path, rev)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+
+	// Read one byte past the limit to tell if the revision is over it
+	contents, err := io.ReadAll(io.LimitReader(blob, diffMaxBytes + 1))
+	if err != nil {
+		return "", fmt.Errorf("read revision %d: %w", rev, err)
+	}
+
+	if err := CheckDiffSize(contents); err != nil {
+		return "", err
+	}
+
+	if !IsText(contents) {
+		return "", ErrRevisionNotText
+	}
+
+	return string(contents), nil
+}
+
+// DiffFileRevisions returns a unified diff between two revisions of a
+// text file
+func DiffFileRevisions(config Config, user, projectName, path string, from, to int) (string, error) {
+	fromText, err := readTextRevision(config, user, projectName, path, from)
+	if err != nil {
+		return "", fmt.Errorf("DiffFileRevisions: %w", err)
+	}
+
+	toText, err := readTextRevision(config, user, projectName, path, to)
+	if err != nil {
+		return "", fmt.Errorf("DiffFileRevisions: %w", err)
+	}
+
+	return UnifiedDiff(
+		fmt.Sprintf("%s@%d", path, from),
+		fmt.Sprintf("%s@%d", path, to),
+		fromText,
+		toText,
+		3,
+	), nil
+}
+
+// RestoreFileRevision replaces a project src file with the contents of
+// an earlier revision, which becomes the newest revision. The file is
+// recreated if it has been deleted.
+func RestoreFileRevision(config Config, user, projectName, path string, rev int, token string) error {
+	blob, revision, err := OpenFileRevision(config, user, projectName, path, rev)
+	if err != nil {
+		return fmt.Errorf("RestoreFileRevision: %w", err)
+	}
+	defer blob.Close()
+
+	expected := ExpectedFile{ Size: int64(revision.Size), Sha256Sum: revision.Sha256Sum }
+	if err := CreateProjectFile(config, user, projectName, path, blob, expected, FilePrecondition{}, token); err != nil {
+		return fmt.Errorf("RestoreFileRevision: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const InvitationCodeByteLength = 12
+
+type Invitation struct {
+	Code string `json:"code"`
+	MaxUses int `json:"maxUses"`
+	Uses int `json:"uses"`
+	Description string `json:"description"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+var ErrInvalidInvitation = errors.New("invalid or expired invitation code")
+var ErrRegistrationDisabled = errors.New("registration disabled")
+var ErrUserExists = errors.New("user already exists")
+
+// CreateInvitation generates a new invitation code that can be used
+// to register maxUses accounts. If validFor is zero the code never
+// expires. It returns the newly generated code.
+func CreateInvitation(config Config, maxUses int, validFor time.Duration, description string) (string, error) {
+	if maxUses < 1 {
+		return "", errors.New("CreateInvitation: invitation must have at least one use")
+	}
+
+	buffer := make([]byte, InvitationCodeByteLength)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", fmt.Errorf("CreateInvitation read random: %w", err)
+	}
+
+	code := fmt.Sprintf("%x", buffer)
+
+	var expiresAt any
+	if validFor > 0 {
+		expiresAt = time.Now().UTC().Add(validFor).Format(SQLiteTime)
+	}
+
+	if _, err := config.database.conn.Exec(
+		"INSERT INTO invitations (code, max_uses, description, expires_at) VALUES (?, ?, ?, ?)",
+		code,
+		maxUses,
+		description,
+		expiresAt,
+	); err != nil {
+		return "", fmt.Errorf("CreateInvitation insert db: %w", err)
+	}
+
+	return code, nil
+}
+
+// ListInvitations returns all invitation codes, including used and
+// expired ones
+func ListInvitations(config Config) ([]Invitation, error) {
+	rows, err := config.database.conn.Query("SELECT code, max_uses, uses, COALESCE(description, ''), created_at, expires_at FROM invitations ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("ListInvitations query: %w", err)
+	}
+	defer rows.Close()
+
+	var invitations []Invitation
+
+	for rows.Next() {
+		var invitation Invitation
+		var createdAt string
+		var expiresAt *string
+		if err := rows.Scan(
+			&invitation.Code,
+			&invitation.MaxUses,
+			&invitation.Uses,
+			&invitation.Description,
+			&createdAt,
+			&expiresAt,
+		); err != nil {
+			return nil, fmt.Errorf("ListInvitations scan: %w", err)
+		}
+
+		invitation.CreatedAt, err = time.Parse(SQLiteTime, createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("ListInvitations parse createdAt time: %w", err)
+		}
+
+		if expiresAt != nil {
+			expires, err := time.Parse(SQLiteTime, *expiresAt)
+			if err != nil {
+				return nil, fmt.Errorf("ListInvitations parse expiresAt time: %w", err)
+			}
+			invitation.ExpiresAt = &expires
+		}
+
+		invitations = append(invitations, invitation)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("ListInvitations rows error: %w", rows.Err())
+	}
+
+	return invitations, nil
+}
+
+// DeleteInvitation deletes an invitation code
+func DeleteInvitation(config Config, code string) error {
+	result, err := config.database.conn.Exec("DELETE FROM invitations WHERE code = ?", code)
+	if err != nil {
+		return fmt.Errorf("DeleteInvitation exec: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrInvalidInvitation
+	}
+
+	return nil
+}
+
+// useInvitation consumes one use of an invitation code. It returns
+// ErrInvalidInvitation if the code doesn't exist, is used up, or has
+// expired.
+func useInvitation(config Config, code string) error {
+	result, err := config.database.conn.Exec(`
+UPDATE invitations
+SET uses = uses + 1
+WHERE code = ?
+  AND uses < max_uses
+  AND (expires_at IS NULL OR expires_at > datetime('now'))`,
+		code,
+	)
+	if err != nil {
+		return fmt.Errorf("useInvitation exec: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("useInvitation rows affected: %w", err)
+	}
+
+	if affected == 0 {
+		return ErrInvalidInvitation
+	}
+
+	return nil
+}
+
+// releaseInvitation gives back a use of an invitation code consumed
+// by useInvitation
+func releaseInvitation(config Config, code string) error {
+	if _, err := config.database.conn.Exec("UPDATE invitations SET uses = uses - 1 WHERE code = ? AND uses > 0", code); err != nil {
+		return fmt.Errorf("releaseInvitation exec: %w", err)
+	}
+	return nil
+}
+
+// RegisterUser creates a new user with a password using an invitation
+// code. The username and password are validated before the code is
+// used, and the use is given back if the user can't be created.
+func RegisterUser(config Config, code, name, password string) error {
+	if !config.AllowRegistration {
+		return ErrRegistrationDisabled
+	}
+
+	if err := ValidateUsername(name); err != nil {
+		return err
+	}
+
+	if err := ValidatePassword(config, name, password); err != nil {
+		return err
+	}
+
+	if _, err := config.database.GetUserId(name); err == nil {
+		return ErrUserExists
+	}
+
+	if err := useInvitation(config, code); err != nil {
+		return err
+	}
+
+	if err := CreateUser(config, name); err != nil {
+		if releaseErr := releaseInvitation(config, code); releaseErr != nil {
+			return fmt.Errorf("RegisterUser create user: %w (%s)", err, releaseErr)
+		}
+		return fmt.Errorf("RegisterUser create user: %w", err)
+	}
+
+	if err := SetUserPassword(config, name, password); err != nil {
+		// Don't leave behind an account nobody can log in to
+		if deleteErr := DeleteUser(config, name); deleteErr != nil {
+			return fmt.Errorf("RegisterUser set password: %w (%s)", err, deleteErr)
+		}
+		return fmt.Errorf("RegisterUser set password: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Largest LDAP message read from the server. Replies to a bind or to a
+// search for one entry without attributes are tiny, and the length of
+// a message comes from the server, so don't let it make the client
+// allocate more than this.
+const ldapMaxMessageSize = 1024 * 1024
+
+func init() {
+	ber.MaxPacketLengthBytes = ldapMaxMessageSize
+}
+
+// LDAPAuthenticator verifies passwords by binding to an LDAP server as
+// the user. If GroupFilter is set, the user must also match it under
+// GroupBaseDN to be allowed in. Users that don't exist in the database
+// yet are created on their first successful login if AutoCreate is set.
+type LDAPAuthenticator struct {
+	Url string // ldap:// or ldaps:// URL of the server
+	BindDNTemplate string // DN to bind as, {user} is replaced by the username
+	GroupBaseDN string // Where to search for the group filter
+	GroupFilter string // Filter the user must match, {user} and {dn} are replaced
+	AutoCreate bool // Create users on their first successful login
+	Timeout time.Duration // Timeout for the whole exchange with the server
+}
+
+var ErrLDAPInvalidCredentials = errors.New("ldap: invalid credentials")
+var ErrLDAPNotInGroup = errors.New("ldap: user does not match group filter")
+
+func (a LDAPAuthenticator) Authenticate(config Config, name, password string) error {
+	// Usernames are restricted enough that they don't need escaping
+	// in a DN, and an empty password would be an anonymous bind
+	if err := ValidateUsername(name); err != nil {
+		return fmt.Errorf("LDAPAuthenticator: %w", err)
+	}
+	if password == "" {
+		return ErrLDAPInvalidCredentials
+	}
+
+	disabled, err := IsUserDisabled(config, name)
+	if err == nil && disabled {
+		return ErrUserDisabled
+	}
+	exists := err == nil
+
+	if !exists && !a.AutoCreate {
+		return fmt.Errorf("LDAPAuthenticator: %w", err)
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return fmt.Errorf("LDAPAuthenticator: %w", err)
+	}
+	defer conn.Close()
+
+	userDN := strings.ReplaceAll(a.BindDNTemplate, "{user}", name)
+	if err := conn.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return ErrLDAPInvalidCredentials
+		}
+		return fmt.Errorf("LDAPAuthenticator bind: %w", err)
+	}
+
+	if a.GroupFilter != "" {
+		filter := strings.NewReplacer(
+			"{user}", ldap.EscapeFilter(name),
+			"{dn}", ldap.EscapeFilter(userDN),
+		).Replace(a.GroupFilter)
+
+		// Only whether anything matches matters, so ask for one entry
+		// without any attributes
+		request := ldap.NewSearchRequest(
+			a.GroupBaseDN,
+			ldap.ScopeWholeSubtree,
+			ldap.NeverDerefAliases,
+			1,
+			0,
+			false,
+			filter,
+			[]string{ "1.1" },
+			nil,
+		)
+		result, err := conn.Search(request)
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return fmt.Errorf("LDAPAuthenticator search: %w", err)
+		}
+		if result == nil || len(result.Entries) == 0 {
+			return ErrLDAPNotInGroup
+		}
+	}
+
+	conn.Unbind()
+
+	if !exists {
+		if err := CreateUser(config, name); err != nil {
+			return fmt.Errorf("LDAPAuthenticator create user: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (a LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	timeout := a.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	conn, err := ldap.DialURL(a.Url, ldap.DialWithDialer(&net.Dialer{ Timeout: timeout }))
+	if err != nil {
+		return nil, fmt.Errorf("ldap dial: %w", err)
+	}
+	conn.SetTimeout(timeout)
+
+	return conn, nil
+}
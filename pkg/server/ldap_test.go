@@ -0,0 +1,225 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testLDAPBindDN = "uid={user},ou=people,dc=test"
+	testLDAPGroupFilter = "(&(objectClass=groupOfNames)(member={dn}))"
+)
+
+// testLDAPServer is an in-process stand-in for an LDAP server. It
+// answers simple binds with the passwords it knows, and searches with
+// whether the filter names one of its group members.
+type testLDAPServer struct {
+	listener net.Listener
+	passwords map[string]string // Password of each DN
+	members []string // DNs that are members of the group
+	reply []byte // Sent instead of a bind response, if set
+}
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &testLDAPServer{
+		listener: listener,
+		passwords: map[string]string{
+			"uid=alice,ou=people,dc=test": "alice password",
+			"uid=bob,ou=people,dc=test": "bob password",
+		},
+		members: []string{ "uid=alice,ou=people,dc=test" },
+	}
+	go server.serve()
+	return server
+}
+
+func (s *testLDAPServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *testLDAPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testLDAPServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageId := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			if s.reply != nil {
+				conn.Write(s.reply)
+				return
+			}
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := int64(ldap.LDAPResultSuccess)
+			if expected, ok := s.passwords[dn]; !ok || expected != password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			conn.Write(ldapMessage(messageId, ldapResult(ldap.ApplicationBindResponse, code)))
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+			for _, member := range s.members {
+				if strings.Contains(filter, "(member=" + ldap.EscapeFilter(member) + ")") {
+					entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+					entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "cn=users,ou=groups,dc=test", ""))
+					entry.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, ""))
+					conn.Write(ldapMessage(messageId, entry))
+				}
+			}
+			conn.Write(ldapMessage(messageId, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+		case ldap.ApplicationUnbindRequest:
+			return
+		default:
+			return
+		}
+	}
+}
+
+func ldapMessage(messageId int64, op *ber.Packet) []byte {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, ""))
+	packet.AppendChild(op)
+	return packet.Bytes()
+}
+
+func ldapResult(tag ber.Tag, code int64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return op
+}
+
+func newTestLDAPAuthenticator(server *testLDAPServer) LDAPAuthenticator {
+	return LDAPAuthenticator{
+		Url: server.url(),
+		BindDNTemplate: testLDAPBindDN,
+		GroupBaseDN: "ou=groups,dc=test",
+		GroupFilter: testLDAPGroupFilter,
+		AutoCreate: true,
+		Timeout: 5 * time.Second,
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	config := newTestConfig(t)
+	server := newTestLDAPServer(t)
+	authenticator := newTestLDAPAuthenticator(server)
+
+	if err := authenticator.Authenticate(config, "alice", "wrong password"); !errors.Is(err, ErrLDAPInvalidCredentials) {
+		t.Fatalf("expected ErrLDAPInvalidCredentials, got %v", err)
+	}
+	if _, err := config.database.GetUserId("alice"); err == nil {
+		t.Fatal("created a user that failed to log in")
+	}
+
+	if err := authenticator.Authenticate(config, "alice", "alice password"); err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if _, err := config.database.GetUserId("alice"); err != nil {
+		t.Fatalf("user wasn't created: %v", err)
+	}
+
+	// bob's password is right, but he isn't in the group
+	if err := authenticator.Authenticate(config, "bob", "bob password"); !errors.Is(err, ErrLDAPNotInGroup) {
+		t.Fatalf("expected ErrLDAPNotInGroup, got %v", err)
+	}
+
+	authenticator.GroupFilter = ""
+	authenticator.AutoCreate = false
+	if err := authenticator.Authenticate(config, "bob", "bob password"); err == nil {
+		t.Fatal("logged in a user that doesn't exist without AutoCreate")
+	}
+
+	if err := authenticator.Authenticate(config, "alice", ""); !errors.Is(err, ErrLDAPInvalidCredentials) {
+		t.Fatalf("expected an empty password to fail, got %v", err)
+	}
+}
+
+func TestLDAPFallsBackToLocalPasswords(t *testing.T) {
+	config := newTestConfig(t)
+	server := newTestLDAPServer(t)
+	config.AuthBackend = AuthBackendLDAP
+	config.authenticator = newTestLDAPAuthenticator(server)
+
+	// root isn't in the directory, but has a local password
+	if err := CreateUser(config, "root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserPassword(config, "root", "root password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompareUserPassword(config, "root", "root password"); err != nil {
+		t.Fatalf("local user couldn't log in: %v", err)
+	}
+	if err := CompareUserPassword(config, "root", "wrong password"); err == nil {
+		t.Fatal("local user logged in with the wrong password")
+	}
+
+	// Users without a local password still go to the directory
+	if err := CompareUserPassword(config, "alice", "alice password"); err != nil {
+		t.Fatalf("directory user couldn't log in: %v", err)
+	}
+	if err := ChangeUserPassword(config, "alice", "", "alice password", "a new long password"); !errors.Is(err, ErrPasswordManagedExternally) {
+		t.Fatalf("expected ErrPasswordManagedExternally, got %v", err)
+	}
+}
+
+func TestLDAPOversizedReply(t *testing.T) {
+	config := newTestConfig(t)
+	server := newTestLDAPServer(t)
+	// A message that claims to be 100 MB long, holding an octet string
+	// that claims the same
+	server.reply = []byte{
+		0x30, 0x84, 0x06, 0x00, 0x00, 0x00,
+		0x02, 0x01, 0x01,
+		0x04, 0x84, 0x05, 0xf5, 0xe1, 0x00,
+	}
+	authenticator := newTestLDAPAuthenticator(server)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err := authenticator.Authenticate(config, "alice", "alice password")
+	runtime.ReadMemStats(&after)
+
+	if err == nil {
+		t.Fatal("accepted an oversized reply")
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 10 * 1024 * 1024 {
+		t.Fatalf("allocated %d bytes for an oversized reply", allocated)
+	}
+}
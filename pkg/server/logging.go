@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Formats log lines can be written in
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const ContextLogFieldsKey = "logFields"
+
+// ParseLogLevel parses a log level name, like info or debug
+func ParseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("ParseLogLevel: %w", err)
+	}
+	return level, nil
+}
+
+// NewLogger returns a logger that writes to w at the level and in the
+// format of the config. Every line logged with the context of a
+// request includes the request's log fields.
+func NewLogger(config Config, w io.Writer) *slog.Logger {
+	options := &slog.HandlerOptions{ Level: config.LogLevel }
+
+	var handler slog.Handler
+	if config.LogFormat == LogFormatJSON {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+
+	return slog.New(contextHandler{ handler })
+}
+
+// logFields describe the request a line was logged for. They're filled
+// in as the request is handled, so lines logged once it's done, like
+// the one for the request itself, include everything known about it.
+type logFields struct {
+	mu sync.Mutex
+	requestId string
+	method string
+	path string
+	user string
+	project string
+	buildId int64
+}
+
+func (f *logFields) attrs() []slog.Attr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	attrs := []slog.Attr{
+		slog.String("request_id", f.requestId),
+		slog.String("method", f.method),
+		slog.String("path", f.path),
+	}
+	if f.user != "" {
+		attrs = append(attrs, slog.String("user", f.user))
+	}
+	if f.project != "" {
+		attrs = append(attrs, slog.String("project", f.project))
+	}
+	if f.buildId != 0 {
+		attrs = append(attrs, slog.Int64("build_id", f.buildId))
+	}
+	return attrs
+}
+
+func getLogFields(ctx context.Context) *logFields {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(ContextLogFieldsKey).(*logFields)
+	return fields
+}
+
+// setLogUser adds the authorized user to the log fields of a request
+func setLogUser(ctx context.Context, user string) {
+	if fields := getLogFields(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.user = user
+		fields.mu.Unlock()
+	}
+}
+
+// setLogProject adds the project a request is for to its log fields
+func setLogProject(ctx context.Context, user, project string) {
+	if fields := getLogFields(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.project = fmt.Sprintf("%s/%s", user, project)
+		fields.mu.Unlock()
+	}
+}
+
+// setLogBuildID adds the build a request started to its log fields
+func setLogBuildID(ctx context.Context, buildId int64) {
+	if fields := getLogFields(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.buildId = buildId
+		fields.mu.Unlock()
+	}
+}
+
+// contextHandler adds the log fields of a request to lines logged with
+// its context
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if fields := getLogFields(ctx); fields != nil {
+		record.AddAttrs(fields.attrs()...)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{ h.Handler.WithAttrs(attrs) }
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{ h.Handler.WithGroup(name) }
+}
+
+// RequestLogger adds log fields to the context of each request, and
+// logs each request once it's been handled. It has to come after
+// middleware.RequestID. Query strings aren't logged, they can hold
+// single sign-on codes.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := &logFields{
+			requestId: middleware.GetReqID(r.Context()),
+			method: r.Method,
+			path: r.URL.Path,
+		}
+		ctx := context.WithValue(r.Context(), ContextLogFieldsKey, fields)
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		defer func() {
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			level := slog.LevelInfo
+			if status >= 500 {
+				level = slog.LevelError
+			}
+
+			slog.LogAttrs(ctx, level, "Request",
+				slog.Int("status", status),
+				slog.Int("bytes", ww.BytesWritten()),
+				slog.Duration("duration", time.Since(start)),
+				slog.String("remote_ip", requestIP(r)),
+				slog.String("user_agent", r.UserAgent()),
+			)
+		}()
+
+		next.ServeHTTP(ww, r.WithContext(ctx))
+	})
+}
+
+// LogValue keeps secrets in the config out of the log
+func (c Config) LogValue() slog.Value {
+	secret := func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return "[redacted]"
+	}
+
+	return slog.GroupValue(
+		slog.Bool("allowLatexmkrc", c.AllowLatexmkrc),
+		slog.Bool("allowLuaTex", c.AllowLuaTex),
+		slog.Bool("allowRegistration", c.AllowRegistration),
+		slog.String("authBackend", c.AuthBackend),
+		slog.Duration("buildDrainTimeout", c.BuildDrainTimeout),
+		slog.String("buildMode", string(c.BuildMode)),
+		slog.Duration("buildRetentionAge", c.BuildRetentionAge),
+		slog.Int("buildRetentionCount", c.BuildRetentionCount),
+		slog.String("databasePath", c.DatabasePath),
+		slog.Bool("ldapAutoCreate", c.LDAPAutoCreate),
+		slog.String("ldapBindDN", c.LDAPBindDN),
+		slog.String("ldapGroupBaseDN", c.LDAPGroupBaseDN),
+		slog.String("ldapGroupFilter", c.LDAPGroupFilter),
+		slog.String("ldapUrl", c.LDAPUrl),
+		slog.String("listenAddress", c.ListenAddress),
+		slog.String("logFormat", c.LogFormat),
+		slog.String("logLevel", c.LogLevel.String()),
+		slog.Duration("maxBuildTime", c.MaxProjectBuildTime),
+		slog.Uint64("maxFileSize", uint64(c.MaxFileSize)),
+		slog.Uint64("minFreeSpace", c.MinFreeSpace),
+		slog.Int("minPasswordLength", c.MinPasswordLength),
+		slog.Bool("oidcAutoProvision", c.OIDCAutoProvision),
+		slog.String("oidcClientId", c.OIDCClientId),
+		slog.String("oidcClientSecret", secret(c.OIDCClientSecret)),
+		slog.String("oidcIssuer", c.OIDCIssuer),
+		slog.String("oidcRedirectUrl", c.OIDCRedirectUrl),
+		slog.String("oidcScopes", strings.Join(c.OIDCScopes, " ")),
+		slog.String("oidcUsernameClaim", c.OIDCUsernameClaim),
+		slog.String("projectsPath", c.ProjectDir),
+		slog.Duration("trashRetention", c.TrashRetention),
+	)
+}
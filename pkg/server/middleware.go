@@ -4,12 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 )
 
 const ContextAuthedUserKey = "authedUser"
@@ -21,7 +20,6 @@ const ContextAuthTokenKey = "authToken"
 func TokenAuthMiddleware(config Config) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			requestId := middleware.GetReqID(r.Context())
 			var authedUser string
 			var authToken string
 			authHeader := r.Header.Get("Authorization")
@@ -31,9 +29,11 @@ func TokenAuthMiddleware(config Config) func(http.Handler) http.Handler {
 					authToken = split[1]
 					user, err := GetUserFromToken(config, authToken)
 					if err != nil {
-						log.Printf("[%s] TokenAuthMiddleware bad auth token \"%s\": %s", requestId, authToken, err)
+						// The token itself is never logged
+						slog.WarnContext(r.Context(), "Bad auth token", "err", err)
 					} else {
 						authedUser = user
+						setLogUser(r.Context(), user)
 					}
 				}
 			}
@@ -82,14 +82,14 @@ func AuthProtectProjectMiddleware(config Config) func(http.Handler) http.Handler
 			user := chi.URLParam(r, "user")
 			project := chi.URLParam(r, "project")
 			authedUser := GetAuthedUser(r.Context())
-			requestId := middleware.GetReqID(r.Context())
+			setLogProject(r.Context(), user, project)
 			public, err := config.database.IsProjectPublic(user, project)
 			if err != nil {
 				if errors.Is(err, sql.ErrNoRows) {
 					http.Error(w, "404 page not found", http.StatusNotFound)
 					return
 				}
-				log.Printf("[%s] AuthProtectProjectMiddleware: %s", requestId, err)
+				slog.ErrorContext(r.Context(), "Unable to check project visibility", "err", err)
 				http.Error(w, "internal service error", http.StatusInternalServerError)
 				return
 			}
@@ -104,3 +104,29 @@ func AuthProtectProjectMiddleware(config Config) func(http.Handler) http.Handler
 		})
 	}
 }
+
+// AdminOnlyMiddleware only allows a request to pass if the user
+// authorized by TokenAuthMiddleware is an administrator
+func AdminOnlyMiddleware(config Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authedUser := GetAuthedUser(r.Context())
+			if authedUser == "" {
+				http.Error(w, "not logged in", http.StatusUnauthorized)
+				return
+			}
+			admin, err := IsUserAdmin(config, authedUser)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Unable to check if user is an admin", "err", err)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			if !admin {
+				slog.WarnContext(r.Context(), "User is not an admin")
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
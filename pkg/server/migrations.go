@@ -63,4 +63,121 @@ CREATE TABLE IF NOT EXISTS schema_migration (
 
 INSERT INTO schema_migration (version) VALUES (1);
 `,
+`
+ALTER TABLE users ADD COLUMN is_admin INTEGER NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT FALSE;
+`,
+`
+CREATE TABLE IF NOT EXISTS invitations (
+  id INTEGER NOT NULL PRIMARY KEY,
+  code TEXT NOT NULL UNIQUE,
+  max_uses INTEGER NOT NULL DEFAULT 1,
+  uses INTEGER NOT NULL DEFAULT 0,
+  description TEXT,
+  created_at TEXT NOT NULL DEFAULT (datetime('now', 'utc')),
+  expires_at TEXT
+);
+`,
+`
+CREATE TABLE IF NOT EXISTS audit_events (
+  id INTEGER NOT NULL PRIMARY KEY,
+  created_at TEXT NOT NULL DEFAULT (datetime('now')),
+  actor TEXT,
+  ip TEXT,
+  action TEXT NOT NULL,
+  target TEXT,
+  detail TEXT
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_created_at_index ON audit_events(created_at);
+CREATE INDEX IF NOT EXISTS audit_events_actor_index ON audit_events(actor);
+`,
+`
+CREATE TABLE IF NOT EXISTS trash (
+  id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  storage TEXT NOT NULL UNIQUE,
+  project_name TEXT NOT NULL,
+  subdir TEXT,
+  path TEXT,
+  public INTEGER NOT NULL DEFAULT FALSE,
+  deleted_at TEXT NOT NULL,
+  expires_at TEXT NOT NULL,
+
+  FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS trash_user_index ON trash(user_id);
+CREATE INDEX IF NOT EXISTS trash_expires_at_index ON trash(expires_at);
+`,
+`
+CREATE TABLE IF NOT EXISTS file_revisions (
+  id INTEGER NOT NULL PRIMARY KEY,
+  project_id INTEGER NOT NULL,
+  path TEXT NOT NULL,
+  revision INTEGER NOT NULL,
+  sha256sum TEXT NOT NULL,
+  size INTEGER NOT NULL,
+  created_at TEXT NOT NULL,
+  token_id INTEGER,
+  token_description TEXT,
+
+  FOREIGN KEY(project_id) REFERENCES projects(id) ON DELETE CASCADE,
+  FOREIGN KEY(token_id) REFERENCES tokens(id) ON DELETE SET NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS file_revisions_project_path_revision_index ON file_revisions(project_id, path, revision);
+`,
+`
+ALTER TABLE builds ADD COLUMN snapshot INTEGER NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS build_artifacts (
+  id INTEGER NOT NULL PRIMARY KEY,
+  build_id INTEGER NOT NULL,
+  path TEXT NOT NULL,
+  sha256sum TEXT NOT NULL,
+  size INTEGER NOT NULL,
+
+  FOREIGN KEY(build_id) REFERENCES builds(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS build_artifacts_build_path_index ON build_artifacts(build_id, path);
+`,
+`
+ALTER TABLE builds ADD COLUMN manifest TEXT;
+`,
+`
+CREATE TABLE IF NOT EXISTS user_identities (
+  id INTEGER NOT NULL PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  issuer TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  created_at TEXT NOT NULL DEFAULT (datetime('now', 'utc')),
+
+  FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_identities_issuer_subject_index ON user_identities(issuer, subject);
+`,
+`
+CREATE TABLE IF NOT EXISTS trash_file_revisions (
+  id INTEGER NOT NULL PRIMARY KEY,
+  trash_id INTEGER NOT NULL,
+  path TEXT NOT NULL,
+  revision INTEGER NOT NULL,
+  sha256sum TEXT NOT NULL,
+  size INTEGER NOT NULL,
+  created_at TEXT NOT NULL,
+  token_id INTEGER,
+  token_description TEXT,
+
+  FOREIGN KEY(trash_id) REFERENCES trash(id) ON DELETE CASCADE,
+  FOREIGN KEY(token_id) REFERENCES tokens(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS trash_file_revisions_trash_index ON trash_file_revisions(trash_id);
+`,
+`
+ALTER TABLE files ADD COLUMN mod_time INTEGER;
+`,
 }
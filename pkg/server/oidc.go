@@ -0,0 +1,634 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a user has to complete an SSO login in their browser, and
+// how long the client has to collect the resulting token
+const (
+	ssoPendingLifetime = 10 * time.Minute
+	ssoCompletedLifetime = 2 * time.Minute
+)
+
+// Most logins and links that can be waiting at once. Starting a login
+// doesn't need an account, so without a limit anyone could fill up
+// the server's memory.
+const ssoMaxPending = 1000
+
+var ErrSSODisabled = errors.New("single sign-on not configured")
+var ErrSSOInvalidState = errors.New("invalid or expired single sign-on state")
+var ErrSSOInvalidRedirect = errors.New("single sign-on redirect must be a loopback http address")
+var ErrSSOUnknownUser = errors.New("no user matches the single sign-on identity")
+var ErrSSOBusy = errors.New("too many single sign-on logins in progress, try again later")
+var ErrSSOAccountExists = errors.New("an account with this username already exists, log in to it and run remotex login --sso --link to link your identity")
+var ErrSSOIdentityLinked = errors.New("single sign-on identity is linked to another user")
+
+// OIDCProvider performs OpenID Connect authorization code logins
+// against an identity provider on behalf of CLI clients. The client
+// waits on a loopback address, the user logs in through their
+// browser, and the server hands the client a one time code it can
+// exchange for a bearer token.
+//
+// Identities are linked to users by their issuer and subject, which
+// the issuer never reassigns. The username claim is only used to name
+// new users, an existing user has to link an identity to their
+// account themselves.
+type OIDCProvider struct {
+	Issuer string // Issuer URL, used for discovery
+	ClientId string // Client ID registered with the issuer
+	ClientSecret string // Client secret registered with the issuer
+	RedirectUrl string // Public URL of this server's /sso/callback
+	Scopes []string // Scopes requested from the issuer
+	UsernameClaim string // Claim used as the username of new users
+	AutoProvision bool // Create users that don't exist yet on first login
+	HTTPClient *http.Client // Client used to talk to the issuer
+
+	mutex sync.Mutex
+	discovery *oidcDiscovery
+	pending map[string]ssoPending
+	completed map[string]ssoCompleted
+	links map[string]ssoLink
+}
+
+type oidcDiscovery struct {
+	Issuer string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	UserinfoEndpoint string `json:"userinfo_endpoint"`
+}
+
+// A login started by a client that hasn't come back from the issuer
+type ssoPending struct {
+	clientRedirect string
+	clientState string
+	description string
+	nonce string
+	linkUser string // User the identity is linked to, if the login is a link
+	expires time.Time
+}
+
+// A finished login waiting for the client to collect its token. The
+// token is only created once it's collected.
+type ssoCompleted struct {
+	user string
+	description string
+	expires time.Time
+}
+
+// A user waiting to link an identity to their account
+type ssoLink struct {
+	user string
+	expires time.Time
+}
+
+// SSOCallbackResult is where to send the browser once the issuer has
+// sent it back, and who logged in
+type SSOCallbackResult struct {
+	Redirect string
+	User string
+	Linked bool // The identity was linked to the user by this login
+}
+
+// SSOLink is returned to a logged in client that wants to link an
+// identity to its account
+type SSOLink struct {
+	Link string `json:"link"` // Passed to the login URL
+}
+
+// SSOToken is returned to the client once an SSO login is complete
+type SSOToken struct {
+	Username string `json:"username"`
+	Token string `json:"token"`
+}
+
+func NewOIDCProvider(issuer, clientId, clientSecret, redirectUrl, usernameClaim string, scopes []string, autoProvision bool) *OIDCProvider {
+	return &OIDCProvider{
+		Issuer: strings.TrimSuffix(issuer, "/"),
+		ClientId: clientId,
+		ClientSecret: clientSecret,
+		RedirectUrl: redirectUrl,
+		Scopes: scopes,
+		UsernameClaim: usernameClaim,
+		AutoProvision: autoProvision,
+		HTTPClient: &http.Client{ Timeout: 30 * time.Second },
+		pending: make(map[string]ssoPending),
+		completed: make(map[string]ssoCompleted),
+		links: make(map[string]ssoLink),
+	}
+}
+
+// discover fetches and caches the issuer's provider metadata
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mutex.Lock()
+	cached := p.discovery
+	p.mutex.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Issuer + "/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, fmt.Errorf("OIDCProvider.discover create request: %w", err)
+	}
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("OIDCProvider.discover do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDCProvider.discover unexpected status code %d", resp.StatusCode)
+	}
+
+	var discovery oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("OIDCProvider.discover decode: %w", err)
+	}
+
+	if discovery.Issuer != p.Issuer {
+		return nil, fmt.Errorf("OIDCProvider.discover issuer mismatch: %s", discovery.Issuer)
+	}
+
+	p.mutex.Lock()
+	p.discovery = &discovery
+	p.mutex.Unlock()
+
+	return &discovery, nil
+}
+
+// StartLink lets a logged in user link an identity to their account.
+// The link it returns is passed to AuthCodeURL, and the identity the
+// user logs in with is linked to them.
+func (p *OIDCProvider) StartLink(user string) (SSOLink, error) {
+	link, err := randomString()
+	if err != nil {
+		return SSOLink{}, fmt.Errorf("OIDCProvider.StartLink: %w", err)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.expire()
+	if len(p.links) >= ssoMaxPending {
+		return SSOLink{}, ErrSSOBusy
+	}
+	p.links[link] = ssoLink{ user: user, expires: time.Now().Add(ssoPendingLifetime) }
+
+	return SSOLink{ Link: link }, nil
+}
+
+// AuthCodeURL starts a login for a client waiting on clientRedirect,
+// and returns the issuer URL the user's browser should be sent to. If
+// link is set, it's a link returned by StartLink, and the identity is
+// linked to its user.
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, clientRedirect, clientState, description, link string) (string, error) {
+	if !isLoopbackRedirect(clientRedirect) {
+		return "", ErrSSOInvalidRedirect
+	}
+
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", fmt.Errorf("OIDCProvider.AuthCodeURL: %w", err)
+	}
+
+	state, err := randomString()
+	if err != nil {
+		return "", fmt.Errorf("OIDCProvider.AuthCodeURL state: %w", err)
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", fmt.Errorf("OIDCProvider.AuthCodeURL nonce: %w", err)
+	}
+
+	p.mutex.Lock()
+	p.expire()
+	if len(p.pending) >= ssoMaxPending {
+		p.mutex.Unlock()
+		return "", ErrSSOBusy
+	}
+	var linkUser string
+	if link != "" {
+		pendingLink, ok := p.links[link]
+		delete(p.links, link)
+		if !ok {
+			p.mutex.Unlock()
+			return "", ErrSSOInvalidState
+		}
+		linkUser = pendingLink.user
+	}
+	p.pending[state] = ssoPending{
+		clientRedirect: clientRedirect,
+		clientState: clientState,
+		description: description,
+		nonce: nonce,
+		linkUser: linkUser,
+		expires: time.Now().Add(ssoPendingLifetime),
+	}
+	p.mutex.Unlock()
+
+	authUrl, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("OIDCProvider.AuthCodeURL parse endpoint: %w", err)
+	}
+	query := authUrl.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientId)
+	query.Set("redirect_uri", p.RedirectUrl)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	authUrl.RawQuery = query.Encode()
+
+	return authUrl.String(), nil
+}
+
+// Callback finishes a login when the issuer redirects the user back to
+// the server. It exchanges the authorization code, finds the user the
+// identity is linked to, and returns the URL the user's browser should
+// be sent to so the client can collect a token.
+func (p *OIDCProvider) Callback(ctx context.Context, config Config, state, code string) (SSOCallbackResult, error) {
+	p.mutex.Lock()
+	pending, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mutex.Unlock()
+
+	if !ok || time.Now().After(pending.expires) {
+		return SSOCallbackResult{}, ErrSSOInvalidState
+	}
+
+	claims, err := p.exchange(ctx, code, pending.nonce)
+	if err != nil {
+		return SSOCallbackResult{}, fmt.Errorf("OIDCProvider.Callback: %w", err)
+	}
+
+	result, err := p.identityUser(config, claims, pending.linkUser)
+	if err != nil {
+		return SSOCallbackResult{}, fmt.Errorf("OIDCProvider.Callback: %w", err)
+	}
+
+	disabled, err := IsUserDisabled(config, result.User)
+	if err != nil {
+		return SSOCallbackResult{}, fmt.Errorf("OIDCProvider.Callback: %w", err)
+	}
+	if disabled {
+		return SSOCallbackResult{}, ErrUserDisabled
+	}
+
+	loginCode, err := randomString()
+	if err != nil {
+		return SSOCallbackResult{}, fmt.Errorf("OIDCProvider.Callback login code: %w", err)
+	}
+
+	p.mutex.Lock()
+	p.expire()
+	if len(p.completed) >= ssoMaxPending {
+		p.mutex.Unlock()
+		return SSOCallbackResult{}, ErrSSOBusy
+	}
+	p.completed[loginCode] = ssoCompleted{
+		user: result.User,
+		description: pending.description,
+		expires: time.Now().Add(ssoCompletedLifetime),
+	}
+	p.mutex.Unlock()
+
+	redirect, err := url.Parse(pending.clientRedirect)
+	if err != nil {
+		return SSOCallbackResult{}, fmt.Errorf("OIDCProvider.Callback parse client redirect: %w", err)
+	}
+	query := redirect.Query()
+	query.Set("code", loginCode)
+	query.Set("state", pending.clientState)
+	redirect.RawQuery = query.Encode()
+
+	result.Redirect = redirect.String()
+	return result, nil
+}
+
+// identityUser finds the user an identity is linked to. An identity
+// that isn't linked yet is linked to linkUser if it's set, or to a
+// new user named after the username claim if users are provisioned.
+// It's never linked to an existing user that didn't ask for it.
+func (p *OIDCProvider) identityUser(config Config, claims map[string]any, linkUser string) (SSOCallbackResult, error) {
+	issuer, _ := claims["iss"].(string)
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return SSOCallbackResult{}, errors.New("identityUser id token has no subject")
+	}
+
+	linked, err := GetIdentityUser(config, issuer, subject)
+	if err != nil {
+		return SSOCallbackResult{}, fmt.Errorf("identityUser: %w", err)
+	}
+	if linked != "" {
+		if linkUser != "" && linkUser != linked {
+			return SSOCallbackResult{}, ErrSSOIdentityLinked
+		}
+		return SSOCallbackResult{ User: linked }, nil
+	}
+
+	if linkUser != "" {
+		if err := LinkUserIdentity(config, linkUser, issuer, subject); err != nil {
+			return SSOCallbackResult{}, fmt.Errorf("identityUser: %w", err)
+		}
+		return SSOCallbackResult{ User: linkUser, Linked: true }, nil
+	}
+
+	claim, _ := claims[p.UsernameClaim].(string)
+	user := strings.ToLower(claim)
+	if err := ValidateUsername(user); err != nil {
+		return SSOCallbackResult{}, fmt.Errorf("identityUser claim %s \"%s\": %w", p.UsernameClaim, claim, err)
+	}
+
+	if _, err := config.database.GetUserId(user); err == nil {
+		return SSOCallbackResult{}, ErrSSOAccountExists
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return SSOCallbackResult{}, fmt.Errorf("identityUser: %w", err)
+	}
+
+	if !p.AutoProvision {
+		return SSOCallbackResult{}, ErrSSOUnknownUser
+	}
+	if err := CreateUser(config, user); err != nil {
+		return SSOCallbackResult{}, fmt.Errorf("identityUser provision user: %w", err)
+	}
+	if err := LinkUserIdentity(config, user, issuer, subject); err != nil {
+		return SSOCallbackResult{}, fmt.Errorf("identityUser: %w", err)
+	}
+
+	return SSOCallbackResult{ User: user, Linked: true }, nil
+}
+
+// CollectToken creates a token for the user of a completed login. Each
+// login code can only be used once.
+func (p *OIDCProvider) CollectToken(config Config, loginCode string) (SSOToken, error) {
+	p.mutex.Lock()
+	completed, ok := p.completed[loginCode]
+	delete(p.completed, loginCode)
+	p.mutex.Unlock()
+
+	if !ok || time.Now().After(completed.expires) {
+		return SSOToken{}, ErrSSOInvalidState
+	}
+
+	disabled, err := IsUserDisabled(config, completed.user)
+	if err != nil {
+		return SSOToken{}, fmt.Errorf("OIDCProvider.CollectToken: %w", err)
+	}
+	if disabled {
+		return SSOToken{}, ErrUserDisabled
+	}
+
+	token, err := CreateUserToken(config, completed.user, completed.description)
+	if err != nil {
+		return SSOToken{}, fmt.Errorf("OIDCProvider.CollectToken: %w", err)
+	}
+
+	return SSOToken{ Username: completed.user, Token: token }, nil
+}
+
+// GetIdentityUser returns the user an issuer's subject is linked to, or
+// an empty string if it isn't linked to anyone
+func GetIdentityUser(config Config, issuer, subject string) (string, error) {
+	var user string
+	err := config.database.conn.QueryRow(
+		"SELECT u.name FROM user_identities i JOIN users u ON u.id = i.user_id WHERE i.issuer = ? AND i.subject = ?",
+		issuer,
+		subject,
+	).Scan(&user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("GetIdentityUser: %w", err)
+	}
+
+	return user, nil
+}
+
+// LinkUserIdentity links an issuer's subject to a user, so logging in
+// as it logs in as them
+func LinkUserIdentity(config Config, user, issuer, subject string) error {
+	userId, err := config.database.GetUserId(user)
+	if err != nil {
+		return fmt.Errorf("LinkUserIdentity: %w", err)
+	}
+
+	if _, err := config.database.conn.Exec(
+		"INSERT INTO user_identities (user_id, issuer, subject) VALUES (?, ?, ?)",
+		userId,
+		issuer,
+		subject,
+	); err != nil {
+		return fmt.Errorf("LinkUserIdentity insert: %w", err)
+	}
+
+	return nil
+}
+
+// exchange trades an authorization code for tokens and returns the
+// claims of the ID token, merged with the userinfo claims if the
+// username claim isn't part of the ID token.
+//
+// The ID token comes directly from the token endpoint over TLS, so as
+// allowed by OpenID Connect Core 3.1.3.7 its signature isn't checked.
+// Its issuer, audience, expiry and nonce are.
+func (p *OIDCProvider) exchange(ctx context.Context, code, nonce string) (map[string]any, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectUrl)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("exchange create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientId), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("exchange do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("exchange unexpected status code %d: %s", resp.StatusCode, body)
+	}
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("exchange decode: %w", err)
+	}
+
+	claims, err := parseIDTokenClaims(tokens.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != discovery.Issuer {
+		return nil, fmt.Errorf("exchange id token issuer mismatch: %s", iss)
+	}
+
+	if !audienceContains(claims["aud"], p.ClientId) {
+		return nil, errors.New("exchange id token audience mismatch")
+	}
+
+	if exp, ok := claims["exp"].(float64); !ok || time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("exchange id token expired")
+	}
+
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, errors.New("exchange id token nonce mismatch")
+	}
+
+	if _, ok := claims[p.UsernameClaim]; ok || discovery.UserinfoEndpoint == "" {
+		return claims, nil
+	}
+
+	userinfo, err := p.userinfo(ctx, discovery.UserinfoEndpoint, tokens.AccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+
+	// The userinfo response is only trusted for the same subject
+	if userinfo["sub"] != claims["sub"] {
+		return nil, errors.New("exchange userinfo subject mismatch")
+	}
+
+	for key, value := range userinfo {
+		if _, ok := claims[key]; !ok {
+			claims[key] = value
+		}
+	}
+
+	return claims, nil
+}
+
+func (p *OIDCProvider) userinfo(ctx context.Context, endpoint, accessToken string) (map[string]any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("userinfo create request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("userinfo do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo unexpected status code %d", resp.StatusCode)
+	}
+
+	var claims map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("userinfo decode: %w", err)
+	}
+
+	return claims, nil
+}
+
+// expire removes stale logins. The caller must hold the mutex.
+func (p *OIDCProvider) expire() {
+	now := time.Now()
+	for state, pending := range p.pending {
+		if now.After(pending.expires) {
+			delete(p.pending, state)
+		}
+	}
+	for code, completed := range p.completed {
+		if now.After(completed.expires) {
+			delete(p.completed, code)
+		}
+	}
+	for link, pendingLink := range p.links {
+		if now.After(pendingLink.expires) {
+			delete(p.links, link)
+		}
+	}
+}
+
+// parseIDTokenClaims decodes the claims section of a JWT
+func parseIDTokenClaims(idToken string) (map[string]any, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("parseIDTokenClaims malformed id token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("parseIDTokenClaims decode payload: %w", err)
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("parseIDTokenClaims unmarshal: %w", err)
+	}
+
+	return claims, nil
+}
+
+// audienceContains checks the aud claim, which can be either a string
+// or a list of strings
+func audienceContains(aud any, clientId string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientId
+	case []any:
+		for _, entry := range aud {
+			if entry == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isLoopbackRedirect only allows redirecting the browser back to a
+// client listening on the same machine
+func isLoopbackRedirect(redirect string) bool {
+	parsed, err := url.Parse(redirect)
+	if err != nil || parsed.Scheme != "http" {
+		return false
+	}
+	if parsed.Hostname() == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(parsed.Hostname())
+	return ip != nil && ip.IsLoopback()
+}
+
+func randomString() (string, error) {
+	buffer := make([]byte, 24)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientId = "remotex"
+	testClientSecret = "s3cret"
+	testClientRedirect = "http://127.0.0.1:9/callback"
+)
+
+// mockIssuer is an OIDC issuer that hands out ID tokens with whatever
+// claims a test asks for
+type mockIssuer struct {
+	*httptest.Server
+	issuer string // Issuer it reports in its discovery document
+
+	mutex sync.Mutex
+	codes map[string]map[string]any
+	next int
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	issuer := &mockIssuer{ codes: make(map[string]map[string]any) }
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer: issuer.issuer,
+			AuthorizationEndpoint: issuer.URL + "/authorize",
+			TokenEndpoint: issuer.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientId, clientSecret, ok := r.BasicAuth()
+		if !ok || clientId != testClientId || clientSecret != testClientSecret {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("grant_type") != "authorization_code" {
+			http.Error(w, "invalid grant type", http.StatusBadRequest)
+			return
+		}
+
+		issuer.mutex.Lock()
+		claims, ok := issuer.codes[r.FormValue("code")]
+		delete(issuer.codes, r.FormValue("code"))
+		issuer.mutex.Unlock()
+		if !ok {
+			http.Error(w, "invalid code", http.StatusBadRequest)
+			return
+		}
+
+		payload, _ := json.Marshal(claims)
+		idToken := fmt.Sprintf("e30.%s.c2ln", base64.RawURLEncoding.EncodeToString(payload))
+		json.NewEncoder(w).Encode(map[string]string{ "access_token": "access", "id_token": idToken })
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	issuer.issuer = issuer.URL
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// code returns an authorization code for an ID token with claims, and
+// the standard claims of a valid token for nonce
+func (i *mockIssuer) code(nonce string, claims map[string]any) string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	idClaims := map[string]any{
+		"iss": i.URL,
+		"aud": testClientId,
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"nonce": nonce,
+	}
+	for key, value := range claims {
+		idClaims[key] = value
+	}
+
+	i.next++
+	code := fmt.Sprintf("code-%d", i.next)
+	i.codes[code] = idClaims
+	return code
+}
+
+func newTestOIDCProvider(issuer *mockIssuer) *OIDCProvider {
+	return NewOIDCProvider(issuer.URL, testClientId, testClientSecret, "http://remotex.test/sso/callback", "preferred_username", []string{"openid"}, true)
+}
+
+// startLogin starts a login, and returns its state and nonce from the
+// URL the browser is sent to
+func startLogin(t *testing.T, provider *OIDCProvider, link string) (string, string) {
+	t.Helper()
+
+	authUrl, err := provider.AuthCodeURL(context.Background(), testClientRedirect, "client-state", "test token", link)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	parsed, err := url.Parse(authUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != testClientId || query.Get("response_type") != "code" {
+		t.Fatalf("unexpected authorization URL %s", authUrl)
+	}
+	return query.Get("state"), query.Get("nonce")
+}
+
+// login logs in as the identity with claims, and returns the result of
+// the callback
+func login(t *testing.T, config Config, provider *OIDCProvider, issuer *mockIssuer, link string, claims map[string]any) (SSOCallbackResult, error) {
+	t.Helper()
+
+	state, nonce := startLogin(t, provider, link)
+	return provider.Callback(context.Background(), config, state, issuer.code(nonce, claims))
+}
+
+// collect collects the token of a login and checks it's for user
+func collect(t *testing.T, config Config, provider *OIDCProvider, result SSOCallbackResult, user string) {
+	t.Helper()
+
+	redirect, err := url.Parse(result.Redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirect.Query().Get("state") != "client-state" {
+		t.Fatalf("redirect %s doesn't carry the client's state", result.Redirect)
+	}
+
+	token, err := provider.CollectToken(config, redirect.Query().Get("code"))
+	if err != nil {
+		t.Fatalf("CollectToken: %v", err)
+	}
+	if token.Username != user {
+		t.Fatalf("token for %s, expected %s", token.Username, user)
+	}
+	tokenUser, err := GetUserFromToken(config, token.Token)
+	if err != nil || tokenUser != user {
+		t.Fatalf("token belongs to %q (%v), expected %s", tokenUser, err, user)
+	}
+
+	if _, err := provider.CollectToken(config, redirect.Query().Get("code")); !errors.Is(err, ErrSSOInvalidState) {
+		t.Fatalf("collected a login code twice: %v", err)
+	}
+}
+
+func TestOIDCLoginProvisionsAndLinksBySubject(t *testing.T) {
+	config := newTestConfig(t)
+	issuer := newMockIssuer(t)
+	provider := newTestOIDCProvider(issuer)
+
+	result, err := login(t, config, provider, issuer, "", map[string]any{ "sub": "1", "preferred_username": "Carol" })
+	if err != nil {
+		t.Fatalf("Callback: %v", err)
+	}
+	if result.User != "carol" || !result.Linked {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	collect(t, config, provider, result, "carol")
+
+	// Changing the claim doesn't change who the identity logs in as
+	result, err = login(t, config, provider, issuer, "", map[string]any{ "sub": "1", "preferred_username": "dave" })
+	if err != nil {
+		t.Fatalf("Callback: %v", err)
+	}
+	if result.User != "carol" || result.Linked {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	collect(t, config, provider, result, "carol")
+}
+
+func TestOIDCLoginDoesNotClaimExistingUsers(t *testing.T) {
+	config := newTestConfig(t)
+	issuer := newMockIssuer(t)
+	provider := newTestOIDCProvider(issuer)
+
+	if err := CreateUser(config, "root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserPassword(config, "root", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserAdmin(config, "root", true); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := login(t, config, provider, issuer, "", map[string]any{ "sub": "2", "preferred_username": "Root" })
+	if !errors.Is(err, ErrSSOAccountExists) {
+		t.Fatalf("expected ErrSSOAccountExists, got %v", err)
+	}
+	linked, err := GetIdentityUser(config, issuer.URL, "2")
+	if err != nil || linked != "" {
+		t.Fatalf("identity linked to %q (%v)", linked, err)
+	}
+}
+
+func TestOIDCLink(t *testing.T) {
+	config := newTestConfig(t)
+	issuer := newMockIssuer(t)
+	provider := newTestOIDCProvider(issuer)
+
+	for _, user := range []string{"alice", "bob"} {
+		if err := CreateUser(config, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	link, err := provider.StartLink("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := login(t, config, provider, issuer, link.Link, map[string]any{ "sub": "3", "preferred_username": "someone" })
+	if err != nil {
+		t.Fatalf("Callback: %v", err)
+	}
+	if result.User != "alice" || !result.Linked {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	collect(t, config, provider, result, "alice")
+
+	// A link can only be used once
+	if _, err := provider.AuthCodeURL(context.Background(), testClientRedirect, "client-state", "test token", link.Link); !errors.Is(err, ErrSSOInvalidState) {
+		t.Fatalf("used a link twice: %v", err)
+	}
+
+	// An identity can't be linked to a second user
+	link, err = provider.StartLink("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := login(t, config, provider, issuer, link.Link, map[string]any{ "sub": "3" }); !errors.Is(err, ErrSSOIdentityLinked) {
+		t.Fatalf("expected ErrSSOIdentityLinked, got %v", err)
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	config := newTestConfig(t)
+	issuer := newMockIssuer(t)
+	provider := newTestOIDCProvider(issuer)
+
+	_, nonce := startLogin(t, provider, "")
+	code := issuer.code(nonce, map[string]any{ "sub": "4", "preferred_username": "erin" })
+	if _, err := provider.Callback(context.Background(), config, "not-the-state", code); !errors.Is(err, ErrSSOInvalidState) {
+		t.Fatalf("expected ErrSSOInvalidState, got %v", err)
+	}
+
+	// The ID token has to be for the login's nonce
+	state, _ := startLogin(t, provider, "")
+	code = issuer.code("not-the-nonce", map[string]any{ "sub": "4", "preferred_username": "erin" })
+	if _, err := provider.Callback(context.Background(), config, state, code); err == nil {
+		t.Fatal("accepted an ID token with the wrong nonce")
+	}
+
+	// A state can only be used once
+	state, nonce = startLogin(t, provider, "")
+	if _, err := provider.Callback(context.Background(), config, state, issuer.code(nonce, map[string]any{ "sub": "4", "preferred_username": "erin" })); err != nil {
+		t.Fatalf("Callback: %v", err)
+	}
+	if _, err := provider.Callback(context.Background(), config, state, issuer.code(nonce, map[string]any{ "sub": "4" })); !errors.Is(err, ErrSSOInvalidState) {
+		t.Fatalf("expected ErrSSOInvalidState, got %v", err)
+	}
+}
+
+func TestOIDCExpiry(t *testing.T) {
+	config := newTestConfig(t)
+	issuer := newMockIssuer(t)
+	provider := newTestOIDCProvider(issuer)
+
+	state, nonce := startLogin(t, provider, "")
+	provider.mutex.Lock()
+	pending := provider.pending[state]
+	pending.expires = time.Now().Add(-time.Second)
+	provider.pending[state] = pending
+	provider.mutex.Unlock()
+
+	code := issuer.code(nonce, map[string]any{ "sub": "5", "preferred_username": "frank" })
+	if _, err := provider.Callback(context.Background(), config, state, code); !errors.Is(err, ErrSSOInvalidState) {
+		t.Fatalf("expected ErrSSOInvalidState, got %v", err)
+	}
+
+	// An expired ID token is refused
+	state, nonce = startLogin(t, provider, "")
+	code = issuer.code(nonce, map[string]any{ "sub": "5", "preferred_username": "frank", "exp": time.Now().Add(-time.Minute).Unix() })
+	if _, err := provider.Callback(context.Background(), config, state, code); err == nil {
+		t.Fatal("accepted an expired ID token")
+	}
+
+	// A login that isn't collected in time doesn't create a token
+	result, err := login(t, config, provider, issuer, "", map[string]any{ "sub": "5", "preferred_username": "frank" })
+	if err != nil {
+		t.Fatalf("Callback: %v", err)
+	}
+	redirect, _ := url.Parse(result.Redirect)
+	loginCode := redirect.Query().Get("code")
+	provider.mutex.Lock()
+	completed := provider.completed[loginCode]
+	completed.expires = time.Now().Add(-time.Second)
+	provider.completed[loginCode] = completed
+	provider.mutex.Unlock()
+
+	if _, err := provider.CollectToken(config, loginCode); !errors.Is(err, ErrSSOInvalidState) {
+		t.Fatalf("expected ErrSSOInvalidState, got %v", err)
+	}
+	tokens, err := ListUserTokens(config, "frank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("expired login created %d tokens", len(tokens))
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.issuer = "https://elsewhere.test"
+	provider := newTestOIDCProvider(issuer)
+
+	if _, err := provider.AuthCodeURL(context.Background(), testClientRedirect, "client-state", "test token", ""); err == nil {
+		t.Fatal("accepted a discovery document for another issuer")
+	}
+}
+
+func TestOIDCPendingLimit(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := newTestOIDCProvider(issuer)
+
+	for range ssoMaxPending {
+		startLogin(t, provider, "")
+	}
+	if _, err := provider.AuthCodeURL(context.Background(), testClientRedirect, "client-state", "test token", ""); !errors.Is(err, ErrSSOBusy) {
+		t.Fatalf("expected ErrSSOBusy, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Clients on different machines can change the same src file. Each
+// says what it expects the file to be before changing it, with the
+// file's sum as an ETag in If-Match, or If-None-Match: * for a file it
+// thinks doesn't exist yet. If the file has changed since then the
+// request fails instead of overwriting the other change. Changes to a
+// project's src files hold its lock from checking the precondition
+// until the change is recorded, so two of them can't both pass.
+
+var ErrPreconditionFailed = errors.New("file has changed on the server")
+
+// FilePrecondition is what a src file is expected to be before it's
+// changed. The zero value matches anything.
+type FilePrecondition struct {
+	Sha256Sums []string // The file must exist with one of these sums, "*" for any
+	Absent bool // The file must not exist
+}
+
+// IfFileMatches expects a file to exist with a sum
+func IfFileMatches(sha256sum string) FilePrecondition {
+	return FilePrecondition{ Sha256Sums: []string{ sha256sum } }
+}
+
+// IfFileAbsent expects a file not to exist
+func IfFileAbsent() FilePrecondition {
+	return FilePrecondition{ Absent: true }
+}
+
+// ParseFilePrecondition reads a precondition from If-Match and
+// If-None-Match headers. Only * is understood for If-None-Match.
+func ParseFilePrecondition(header http.Header) FilePrecondition {
+	var precondition FilePrecondition
+
+	for _, value := range header.Values("If-Match") {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			tag = strings.TrimPrefix(tag, "W/")
+			tag = strings.Trim(tag, "\"")
+			if tag != "" {
+				precondition.Sha256Sums = append(precondition.Sha256Sums, tag)
+			}
+		}
+	}
+
+	if strings.TrimSpace(header.Get("If-None-Match")) == "*" {
+		precondition.Absent = true
+	}
+
+	return precondition
+}
+
+// SetHeader adds the precondition to a request's headers
+func (p FilePrecondition) SetHeader(header http.Header) {
+	for _, sum := range p.Sha256Sums {
+		if sum == "*" {
+			header.Add("If-Match", "*")
+		} else {
+			header.Add("If-Match", fmt.Sprintf("\"%s\"", sum))
+		}
+	}
+	if p.Absent {
+		header.Set("If-None-Match", "*")
+	}
+}
+
+// CheckFilePrecondition returns ErrPreconditionFailed if a src file
+// doesn't match what's expected of it
+func CheckFilePrecondition(config Config, user, projectName, path string, precondition FilePrecondition) error {
+	if len(precondition.Sha256Sums) == 0 && !precondition.Absent {
+		return nil
+	}
+
+	exists := true
+	info, err := config.database.GetProjectFileInfo(user, projectName, "src", path)
+	if errors.Is(err, sql.ErrNoRows) {
+		exists = false
+	} else if err != nil {
+		return fmt.Errorf("CheckFilePrecondition: %w", err)
+	}
+
+	if precondition.Absent && exists {
+		return fmt.Errorf("%w: %s already exists", ErrPreconditionFailed, path)
+	}
+
+	if len(precondition.Sha256Sums) == 0 {
+		return nil
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s doesn't exist", ErrPreconditionFailed, path)
+	}
+	for _, sum := range precondition.Sha256Sums {
+		if sum == "*" || strings.EqualFold(sum, info.Sha256Sum) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s has sha256sum %s", ErrPreconditionFailed, path, info.Sha256Sum)
+}
+
+// ProjectLocks serializes changes to the src files of each project
+type ProjectLocks struct {
+	mutex sync.Mutex
+	locks map[int]*projectLock
+}
+
+type projectLock struct {
+	mutex sync.Mutex
+	users int // Holders of the lock and those waiting for it
+}
+
+func NewProjectLocks() *ProjectLocks {
+	return &ProjectLocks{ locks: make(map[int]*projectLock) }
+}
+
+// Lock waits for a project's lock, and returns the function that
+// releases it
+func (l *ProjectLocks) Lock(projectId int) func() {
+	l.mutex.Lock()
+	lock, ok := l.locks[projectId]
+	if !ok {
+		lock = &projectLock{}
+		l.locks[projectId] = lock
+	}
+	lock.users++
+	l.mutex.Unlock()
+
+	lock.mutex.Lock()
+
+	return func() {
+		lock.mutex.Unlock()
+
+		l.mutex.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(l.locks, projectId)
+		}
+		l.mutex.Unlock()
+	}
+}
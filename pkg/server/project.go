@@ -9,7 +9,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,8 +17,6 @@ import (
 	"time"
 )
 
-// TODO Add a way for clients to manage project settings (ie. public)
-
 // NewProject creates a new project belonging to owner with name, and
 // creates the appropriate subdirectories
 func NewProject(config Config, user string, name string) error {
@@ -50,6 +48,7 @@ type FileInfo struct {
 	Path string       `json:"path"`
 	Size uint64       `json:"size"`
 	Sha256Sum string  `json:"sha256sum"`
+	modTime int64 // Modification time of the file when it was hashed, in nanoseconds
 }
 
 // ScanProjectFiles deletes the db file list from a project's subdir
@@ -76,7 +75,7 @@ func ScanProjectFiles(config Config, user string, projectName string, subdir str
 
 	err = filepath.Walk(filesPath, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
-			log.Printf("ScanProjectFiles of \"%s\", path \"%s\": %s", filesPath, path, err)
+			slog.Warn("Unable to scan project file", "dir", filesPath, "path", path, "err", err)
 			return nil
 		}
 		if info.IsDir() {
@@ -90,12 +89,13 @@ func ScanProjectFiles(config Config, user string, projectName string, subdir str
 		partialPath := strings.TrimPrefix(path, removePrefix)
 
 		if _, err := tx.Exec(
-			"INSERT INTO files (project_id, subdir, path, size, sha256sum) VALUES (?, ?, ?, ?, ?)",
+			"INSERT INTO files (project_id, subdir, path, size, sha256sum, mod_time) VALUES (?, ?, ?, ?, ?, ?)",
 			projectId,
 			subdir,
 			partialPath,
 			size,
 			digest,
+			info.ModTime().UnixNano(),
 		); err != nil {
 			return fmt.Errorf("ScanProjectFiles insert row: %w", err)
 		}
@@ -163,6 +163,9 @@ type ProjectBuildOptions struct {
 }
 
 var ErrBuildInProgress = errors.New("build in progress")
+var ErrBuildCancelled = errors.New("build cancelled")
+var ErrNoBuildRunning = errors.New("no build running")
+var ErrServerShuttingDown = errors.New("server shutting down")
 
 // BuildProject builds a project using latexmk using the options
 // provided. It retuens the stdout of latexmk.
@@ -177,12 +180,20 @@ func BuildProject(ctx context.Context, config Config, user string, projectName s
 		return "", fmt.Errorf("BuildProject: %w", err)
 	}
 
+	// Builds are cancelled with a cause, so the status they're marked
+	// with can say why
+	buildCtx, cancelBuild := context.WithCancelCause(ctx)
+	defer cancelBuild(nil)
+	timeoutCtx, cancel := context.WithTimeout(buildCtx, config.MaxProjectBuildTime)
+	defer cancel() // Don't leak the context
+
 	// If there is currently a build running for this project, return
-	// an error instead of running two parallel builds
-	row := config.database.conn.QueryRowContext(ctx, "SELECT status FROM builds WHERE project_id = ? ORDER BY id DESC LIMIT 1", projectId)
-	if row.Err() != nil && !errors.Is(row.Err(), sql.ErrNoRows) {
-		return "", ErrBuildInProgress
+	// an error instead of running two parallel builds. No new builds
+	// are started while the server is stopping.
+	if err := config.builds.Start(projectId, cancelBuild); err != nil {
+		return "", err
 	}
+	defer config.builds.Finish(projectId)
 
 	if options.CleanBuild {
 		if err := ClearProjectDir(config, user, projectName, "aux"); err != nil {
@@ -198,7 +209,19 @@ func BuildProject(ctx context.Context, config Config, user string, projectName s
 	if err != nil {
 		return "", fmt.Errorf("BuildProject marshall: %w", err)
 	}
-	result, err := config.database.conn.Exec("INSERT INTO builds (project_id, status, options) VALUES (?, ?, ?)", projectId, "running", opts)
+
+	manifest, err := stageBuildSources(config, projectId, projectPath)
+	defer os.RemoveAll(stagingPath(projectPath))
+	if err != nil {
+		return "", fmt.Errorf("BuildProject: %w", err)
+	}
+
+	unparsedManifest, err := json.Marshal(manifest)
+	if err != nil {
+		return "", fmt.Errorf("BuildProject marshall manifest: %w", err)
+	}
+
+	result, err := config.database.conn.Exec("INSERT INTO builds (project_id, status, options, manifest) VALUES (?, ?, ?, ?)", projectId, "running", opts, unparsedManifest)
 	if err != nil {
 		return "", fmt.Errorf("BuildProject db insert build: %w", err)
 	}
@@ -207,16 +230,16 @@ func BuildProject(ctx context.Context, config Config, user string, projectName s
 	if err != nil {
 		return "", fmt.Errorf("BuildProject get buildId: %w", err)
 	}
+	setLogBuildID(ctx, buildId)
 
 	beginTime := time.Now()
-	timeoutCtx, cancel := context.WithTimeout(ctx, config.MaxProjectBuildTime)
 
 	// If error is type *ExitError, the cmdOut should be populated
 	// with an error message
 	buildOut, buildErr := RunBuild(timeoutCtx, BuildOptions{
 		AuxDir: auxPath,
 		OutDir: outPath,
-		SrcDir: srcPath,
+		SrcDir: stagingPath(projectPath),
 		// SharedDir: "", // TODO Make shared dir work
 		Document: options.Document,
 		Engine: options.Engine,
@@ -228,8 +251,10 @@ func BuildProject(ctx context.Context, config Config, user string, projectName s
 		AllowLuaTex: config.AllowLuaTex,
 	})
 	buildTime := time.Since(beginTime)
-	cancel() // Don't leak the context
+	cancelled := errors.Is(timeoutCtx.Err(), context.Canceled)
 
+	// Paths in the output refer to src, not where it was staged
+	buildOut = strings.ReplaceAll(buildOut, stagingPath(projectPath), srcPath)
 	buildOut = strings.ReplaceAll(buildOut, projectPath, "")
 
 	// If there is an issue with the build, but it's only with the
@@ -238,7 +263,22 @@ func BuildProject(ctx context.Context, config Config, user string, projectName s
 	// directories and update the files
 	if buildErr != nil {
 		var execErr *exec.ExitError
-		if errors.As(buildErr, &execErr) {
+		if cancelled {
+			// The build was cancelled while running
+			status := "cancelled"
+			if errors.Is(context.Cause(buildCtx), ErrServerShuttingDown) {
+				status = "cancelled (shutdown)"
+			}
+			if _, err := config.database.conn.Exec(
+				"UPDATE builds SET status = ?, build_time = ?, build_out = ? WHERE id = ?",
+				status,
+				buildTime.Seconds(),
+				buildOut,
+				buildId,
+			); err != nil {
+				return buildOut, fmt.Errorf("BuildProject updating db cancelled build: %w", err)
+			}
+		} else if errors.As(buildErr, &execErr) {
 			// It's a latexmk error
 			if _, err := config.database.conn.Exec(
 				"UPDATE builds SET status = ?, build_time = ?, build_out = ? WHERE id = ?",
@@ -280,11 +320,23 @@ func BuildProject(ctx context.Context, config Config, user string, projectName s
 		return buildOut, fmt.Errorf("BuildProject scan out: %w", err)
 	}
 
-	if err := ScanProjectFiles(config, user, projectName, "src"); err != nil {
-		return buildOut, fmt.Errorf("BuildProject scan src: %w", err)
+	// Keep a copy of the output of finished builds. Failing to do so
+	// doesn't fail the build, its output is still in the out directory.
+	if buildErr == nil {
+		if err := snapshotBuild(config, projectPath, int(buildId)); err != nil {
+			slog.ErrorContext(ctx, "Unable to snapshot build", "err", err)
+		} else if _, err := pruneBuildSnapshots(config, "b.project_id = ?", projectId); err != nil {
+			slog.ErrorContext(ctx, "Unable to prune build snapshots", "err", err)
+		}
 	}
 
 	// Finally return the build error if we have one
+	if cancelled {
+		if errors.Is(context.Cause(buildCtx), ErrServerShuttingDown) {
+			return buildOut, fmt.Errorf("BuildProject: %w", ErrServerShuttingDown)
+		}
+		return buildOut, fmt.Errorf("BuildProject: %w", ErrBuildCancelled)
+	}
 	if buildErr != nil {
 		return buildOut, fmt.Errorf("BuildProject failed build: %w", buildErr)
 	}
@@ -292,8 +344,39 @@ func BuildProject(ctx context.Context, config Config, user string, projectName s
 	return buildOut, nil
 }
 
-// DeleteProject deletes a project's root directiry and removes it
-// from the database
+// CancelProjectBuild cancels the currently running build of a project
+func CancelProjectBuild(config Config, user string, projectName string) error {
+	projectId, err := config.database.GetProjectId(user, projectName)
+	if err != nil {
+		return fmt.Errorf("CancelProjectBuild: %w", err)
+	}
+
+	if !config.builds.Cancel(projectId) {
+		return ErrNoBuildRunning
+	}
+
+	return nil
+}
+
+// MarkInterruptedBuilds marks builds left running by a server that
+// was killed before they finished as failed. It returns how many
+// builds were marked, and must only be run before the server starts
+// building.
+func MarkInterruptedBuilds(config Config) (int64, error) {
+	result, err := config.database.conn.Exec("UPDATE builds SET status = 'failed (interrupted)' WHERE status = 'running'")
+	if err != nil {
+		return 0, fmt.Errorf("MarkInterruptedBuilds: %w", err)
+	}
+
+	marked, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("MarkInterruptedBuilds rows affected: %w", err)
+	}
+	return marked, nil
+}
+
+// DeleteProject moves a project to its owner's trash. A running build
+// of the project is cancelled.
 func DeleteProject(config Config, user string, projectName string) error {
 	projectPath := filepath.Join(config.ProjectDir, user, projectName)
 
@@ -302,20 +385,37 @@ func DeleteProject(config Config, user string, projectName string) error {
 		return fmt.Errorf("DeleteProject get projec id: %w", err)
 	}
 
-	if err := os.RemoveAll(projectPath); err != nil {
+	public, err := config.database.IsProjectPublic(user, projectName)
+	if err != nil {
 		return fmt.Errorf("DeleteProject: %w", err)
 	}
 
-	if _, err := config.database.conn.Exec("DELETE FROM projects WHERE id = ?", projectId); err != nil {
-		return fmt.Errorf("DeleteProject delete db project: %w", err)
+	config.builds.Cancel(projectId)
+
+	entry := TrashEntry{ Kind: TrashKindProject, Project: projectName, public: public }
+	if err := moveToTrash(config, user, entry, projectPath, func(tx *sql.Tx, trashId int64) error {
+		// The history is in the project directory, so keep its rows
+		// with the trash entry for when the project is restored
+		if _, err := tx.Exec(`
+INSERT INTO trash_file_revisions (trash_id, path, revision, sha256sum, size, created_at, token_id, token_description)
+SELECT ?, path, revision, sha256sum, size, created_at, token_id, token_description FROM file_revisions WHERE project_id = ?`,
+			trashId,
+			projectId,
+		); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM projects WHERE id = ?", projectId)
+		return err
+	}); err != nil {
+		return fmt.Errorf("DeleteProject: %w", err)
 	}
 
 	return nil
 }
 
-// ReadProjectFile opens a file from a  project and returns an
-// io.ReadderCloser for it. Caller is responsible for closing the ReaderCloser
-func ReadProjectFile(config Config, user, projectName, subdir, path string) (io.ReadCloser, error) {
+// ReadProjectFile opens a file from a  project and returns it. Caller
+// is responsible for closing the file
+func ReadProjectFile(config Config, user, projectName, subdir, path string) (*os.File, error) {
 	if strings.Contains(path, "../") {
 		return nil, errors.New("path contains parent directory traversal")
 	}
@@ -341,10 +441,11 @@ func ReadProjectFile(config Config, user, projectName, subdir, path string) (io.
 }
 
 // DeleteProjectFile deletes a file within a project and removes it
-// from the file list in the database. If it is the only file inside
-// of a directory, it also deletes the containing directory, and
-// continues all the way up until it reaches the project subdir.
-func DeleteProjectFile(config Config, user, projectName, subdir, path string) error {
+// from the file list in the database, if the src file matches
+// precondition. If it is the only file inside of a directory, it also
+// deletes the containing directory, and continues all the way up until
+// it reaches the project subdir.
+func DeleteProjectFile(config Config, user, projectName, subdir, path string, precondition FilePrecondition) error {
 	projectPath := filepath.Join(config.ProjectDir, user, projectName)
 	filePath := filepath.Join(projectPath, subdir, path)
 
@@ -353,6 +454,13 @@ func DeleteProjectFile(config Config, user, projectName, subdir, path string) er
 		return fmt.Errorf("DeleteProjectFile get project id: %w", err)
 	}
 
+	unlock := config.fileLocks.Lock(projectId)
+	defer unlock()
+
+	if err := CheckFilePrecondition(config, user, projectName, path, precondition); err != nil {
+		return fmt.Errorf("DeleteProjectFile: %w", err)
+	}
+
 	if path == "" || path == "." || path == "./" || path == ".." {
 		return errors.New("path is just the top level directory")
 	}
@@ -366,39 +474,47 @@ func DeleteProjectFile(config Config, user, projectName, subdir, path string) er
 		return fmt.Errorf("DeleteProjectFile stat: %w", err)
 	}
 
-	if stat.IsDir() {
-		if err := os.RemoveAll(filePath); err != nil {
-			return fmt.Errorf("DeleteProjectFile RemoveAll: %w", err)
+	// Deleted files and directories go to the trash
+	entry := TrashEntry{ Kind: TrashKindFile, Project: projectName, Subdir: subdir, Path: filepath.Clean(path) }
+	deleteRows := func(tx *sql.Tx, trashId int64) error {
+		if stat.IsDir() {
+			// Matched by prefix, since paths can contain anything GLOB
+			// would treat as a wildcard
+			_, err := tx.Exec("DELETE FROM files WHERE project_id = ? AND subdir = ? AND substr(path, 1, length(?)) = ?",
+				projectId,
+				subdir,
+				entry.Path + "/",
+				entry.Path + "/",
+			)
+			return err
 		}
-		if _, err := config.database.conn.Exec("DELETE FROM files WHERE project_id = ? ANd subdir = ? AND path GLOB ?",
-			projectId,
-			subdir,
-			fmt.Sprintf("%s/*", path),
-		); err != nil {
-			return fmt.Errorf("DeleteProjectFile remove dir from db: %w", err)
-		}
-	} else {
-		if err := os.Remove(filePath); err != nil {
-			return fmt.Errorf("DeleteProjectFile Remove: %w", err)
-		}
-		if _, err := config.database.conn.Exec(
+		_, err := tx.Exec(
 			"DELETE FROM files WHERE project_id = ? AND subdir = ? AND path = ?",
 			projectId,
 			subdir,
-			path,
-		); err != nil {
-			return fmt.Errorf("DeleteProjectFile remove file from db: %w", err)
-		}
+			entry.Path,
+		)
+		return err
 	}
 
-	// Traverse dirs upward and delete any empty dirs until we get to
-	// the top of the subdir, or we find a non-empty dir
-	dirPath := filepath.Dir(filePath)
-	topDirPath := filepath.Join(projectPath, subdir)
+	if err := moveToTrash(config, user, entry, filePath, deleteRows); err != nil {
+		return fmt.Errorf("DeleteProjectFile: %w", err)
+	}
+
+	if err := RemoveEmptyDirs(filepath.Dir(filePath), filepath.Join(projectPath, subdir)); err != nil {
+		return fmt.Errorf("DeleteProjectFile: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveEmptyDirs traverses dirs upward from dirPath and deletes any
+// empty dirs until it gets to topDirPath, or finds a non-empty dir.
+func RemoveEmptyDirs(dirPath, topDirPath string) error {
 	for dirPath != topDirPath {
 		empty, err := IsDirEmpty(dirPath)
 		if err != nil {
-			return fmt.Errorf("DeleteProjectFile checking empty dir: %w", err)
+			return fmt.Errorf("RemoveEmptyDirs checking empty dir: %w", err)
 		}
 
 		if !empty {
@@ -406,7 +522,7 @@ func DeleteProjectFile(config Config, user, projectName, subdir, path string) er
 		}
 
 		if err := os.Remove(dirPath); err != nil {
-			return fmt.Errorf("DeleteProjectFile clearing empty dirs: %w", err)
+			return fmt.Errorf("RemoveEmptyDirs clearing empty dirs: %w", err)
 		}
 
 		dirPath = filepath.Dir(dirPath)
@@ -415,10 +531,166 @@ func DeleteProjectFile(config Config, user, projectName, subdir, path string) er
 	return nil
 }
 
-// CreateProjectFile creates a file inside a project subdir and
-// populates it with the contents of the io.Reader, then adds it to
-// the db file list.
-func CreateProjectFile(config Config, user, projectName, path string, reader io.Reader) error {
+var ErrFileNotFound = errors.New("file not found")
+var ErrFileExists = errors.New("file already exists")
+
+// MoveProjectFile moves or renames a src file or directory within a
+// project and updates the file list to match. The moved files keep
+// their contents, so they aren't uploaded again. Each moved file gets
+// a revision at its new path, and its history at the old path is
+// kept. Directories left empty by the move are removed. from must
+// match precondition.
+func MoveProjectFile(config Config, user, projectName, from, to string, precondition FilePrecondition, token string) error {
+	projectPath := filepath.Join(config.ProjectDir, user, projectName)
+	srcPath := filepath.Join(projectPath, "src")
+
+	projectId, err := config.database.GetProjectId(user, projectName)
+	if err != nil {
+		return fmt.Errorf("MoveProjectFile get project id: %w", err)
+	}
+
+	unlock := config.fileLocks.Lock(projectId)
+	defer unlock()
+
+	if err := CheckFilePrecondition(config, user, projectName, from, precondition); err != nil {
+		return fmt.Errorf("MoveProjectFile: %w", err)
+	}
+
+	for _, path := range []string{ from, to } {
+		if path == "" || path == "." || path == "./" || path == ".." {
+			return errors.New("path is just the top level directory")
+		}
+		if strings.Contains(path, "../") || strings.Contains(path, "./") {
+			return errors.New("path contains parent directory traversal")
+		}
+	}
+
+	from = filepath.ToSlash(filepath.Clean(from))
+	to = filepath.ToSlash(filepath.Clean(to))
+	if from == to {
+		return nil
+	}
+	if strings.HasPrefix(to, from + "/") {
+		return errors.New("MoveProjectFile can't move a directory inside of itself")
+	}
+
+	fromPath := filepath.Join(srcPath, filepath.FromSlash(from))
+	toPath := filepath.Join(srcPath, filepath.FromSlash(to))
+
+	stat, err := os.Lstat(fromPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("MoveProjectFile stat: %w", err)
+	}
+	if _, err := os.Lstat(toPath); err == nil {
+		return ErrFileExists
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("MoveProjectFile stat destination: %w", err)
+	}
+
+	// Files are listed before they're moved so each can get a revision
+	// at its new path. Paths in a directory are matched by their
+	// prefix, since they can contain anything GLOB or LIKE would treat
+	// as a wildcard.
+	var rows *sql.Rows
+	if stat.IsDir() {
+		rows, err = config.database.conn.Query(
+			"SELECT id, path, size, sha256sum FROM files WHERE project_id = ? AND subdir = ? AND substr(path, 1, length(?)) = ?",
+			projectId,
+			"src",
+			from + "/",
+			from + "/",
+		)
+	} else {
+		rows, err = config.database.conn.Query(
+			"SELECT id, path, size, sha256sum FROM files WHERE project_id = ? AND subdir = ? AND path = ?",
+			projectId,
+			"src",
+			from,
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("MoveProjectFile query: %w", err)
+	}
+
+	var moved []FileInfo
+	var movedIds []int
+	for rows.Next() {
+		var file FileInfo
+		var id int
+		if err := rows.Scan(&id, &file.Path, &file.Size, &file.Sha256Sum); err != nil {
+			rows.Close()
+			return fmt.Errorf("MoveProjectFile scan: %w", err)
+		}
+		moved = append(moved, file)
+		movedIds = append(movedIds, id)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return fmt.Errorf("MoveProjectFile rows error: %w", rows.Err())
+	}
+
+	// Make sure the contents of files from before history was kept are
+	// stored, the revisions at their new paths refer to them
+	for _, file := range moved {
+		if err := importUntrackedRevision(config, projectId, projectPath, file.Path); err != nil {
+			return fmt.Errorf("MoveProjectFile: %w", err)
+		}
+	}
+
+	tx, err := config.database.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("MoveProjectFile begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for index, file := range moved {
+		if _, err := tx.Exec("UPDATE files SET path = ? WHERE id = ?", to + strings.TrimPrefix(file.Path, from), movedIds[index]); err != nil {
+			return fmt.Errorf("MoveProjectFile update files: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(toPath), 0700); err != nil {
+		return fmt.Errorf("MoveProjectFile MkdirAll: %w", err)
+	}
+
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return fmt.Errorf("MoveProjectFile rename: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		// Put it back, so the file list still matches
+		if err := os.Rename(toPath, fromPath); err != nil {
+			slog.Error("Unable to undo file move", "from", fromPath, "to", toPath, "err", err)
+		}
+		return fmt.Errorf("MoveProjectFile commit: %w", err)
+	}
+
+	now := time.Now()
+	for _, file := range moved {
+		movedPath := to + strings.TrimPrefix(file.Path, from)
+		if err := recordFileRevision(config, projectId, movedPath, file.Sha256Sum, int64(file.Size), now, token); err != nil {
+			return fmt.Errorf("MoveProjectFile: %w", err)
+		}
+	}
+
+	if err := RemoveEmptyDirs(filepath.Dir(fromPath), srcPath); err != nil {
+		return fmt.Errorf("MoveProjectFile: %w", err)
+	}
+
+	return nil
+}
+
+// CreateProjectFile creates or replaces a file inside a project's src
+// subdir, and adds its contents to the file's revision history. token
+// is the token used to upload the file, if any. The contents go to a
+// temporary file that only replaces the real one once it's complete
+// and matches expected, so an aborted or corrupted upload leaves the
+// old file in place. The file being replaced must match precondition
+// at that point.
+func CreateProjectFile(config Config, user, projectName, path string, reader io.Reader, expected ExpectedFile, precondition FilePrecondition, token string) error {
 	projectPath := filepath.Join(config.ProjectDir, user, projectName)
 	filePath := filepath.Join(projectPath, "src", path)
 	fileDir := filepath.Dir(filePath)
@@ -436,13 +708,27 @@ func CreateProjectFile(config Config, user, projectName, path string, reader io.
 		return fmt.Errorf("CreateProjectFile MkdirAll: %w", err)
 	}
 
-	file, err := os.Create(filePath)
+	if err := importUntrackedRevision(config, projectId, projectPath, path); err != nil {
+		return fmt.Errorf("CreateProjectFile: %w", err)
+	}
+
+	// Kept out of src so it's never mistaken for a project file
+	file, err := os.CreateTemp(projectPath, ".upload-*")
 	if err != nil {
 		return fmt.Errorf("CreateProjectFile create file: %w", err)
 	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	blob, err := createRevisionBlob(projectPath)
+	if err != nil {
+		return fmt.Errorf("CreateProjectFile: %w", err)
+	}
+	defer os.Remove(blob.Name())
+	defer blob.Close()
 
 	hasher := sha256.New()
-	multiWriter := io.MultiWriter(file, hasher)
+	multiWriter := io.MultiWriter(file, blob, hasher)
 
 	size, err := io.Copy(multiWriter, reader)
 	if err != nil {
@@ -451,17 +737,59 @@ func CreateProjectFile(config Config, user, projectName, path string, reader io.
 
 	digest := fmt.Sprintf("%x", hasher.Sum(nil))
 
-	if _, err := config.database.conn.Exec(
-		"INSERT INTO files (project_id, subdir, path, size, sha256sum) VALUES (?, ?, ?, ?, ?)",
+	if err := expected.check(size, digest); err != nil {
+		return fmt.Errorf("CreateProjectFile %s: %w", path, err)
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("CreateProjectFile sync file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("CreateProjectFile close file: %w", err)
+	}
+
+	if err := blob.Close(); err != nil {
+		return fmt.Errorf("CreateProjectFile close blob: %w", err)
+	}
+
+	if err := storeRevisionBlob(projectPath, blob.Name(), digest); err != nil {
+		return fmt.Errorf("CreateProjectFile: %w", err)
+	}
+
+	// The file may have changed while the upload was read
+	unlock := config.fileLocks.Lock(projectId)
+	defer unlock()
+
+	if err := CheckFilePrecondition(config, user, projectName, path, precondition); err != nil {
+		return fmt.Errorf("CreateProjectFile: %w", err)
+	}
+
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return fmt.Errorf("CreateProjectFile rename file: %w", err)
+	}
+
+	stat, err := os.Lstat(filePath)
+	if err != nil {
+		return fmt.Errorf("CreateProjectFile stat: %w", err)
+	}
+
+	if _, err := config.database.conn.Exec(`
+INSERT INTO files (project_id, subdir, path, size, sha256sum, mod_time) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (project_id, subdir, path) DO UPDATE SET size = excluded.size, sha256sum = excluded.sha256sum, mod_time = excluded.mod_time`,
 		projectId,
 		"src",
 		path,
 		size,
 		digest,
+		stat.ModTime().UnixNano(),
 	); err != nil {
 		return fmt.Errorf("CreateProjectFile db insert: %w", err)
 	}
 
+	if err := recordFileRevision(config, projectId, path, digest, size, time.Now(), token); err != nil {
+		return fmt.Errorf("CreateProjectFile: %w", err)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMoveProjectFileDirectory(t *testing.T) {
+	config := newTestConfig(t)
+	if err := CreateUser(config, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewProject(config, "alice", "talk"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Multibyte names and names GLOB would treat as patterns
+	for _, path := range []string{ "präsentation/bild.png", "präsentation/sub/a.tex", "präsentationen/other.tex", "[ab]/x.tex", "a/y.tex" } {
+		if err := CreateProjectFile(config, "alice", "talk", path, strings.NewReader(path), UncheckedFile, FilePrecondition{}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MoveProjectFile(config, "alice", "talk", "präsentation", "talk", FilePrecondition{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := MoveProjectFile(config, "alice", "talk", "[ab]", "brackets", FilePrecondition{}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := config.database.ListProjectFiles("alice", "talk", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	sort.Strings(paths)
+
+	expected := []string{ "a/y.tex", "brackets/x.tex", "präsentationen/other.tex", "talk/bild.png", "talk/sub/a.tex" }
+	if strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected files %v after moving, got %v", expected, paths)
+	}
+}
+
+func TestDeleteProjectFileDirectory(t *testing.T) {
+	config := newTestConfig(t)
+	if err := CreateUser(config, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewProject(config, "alice", "talk"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{ "[ab]/x.tex", "a/y.tex", "b/z.tex", "*/w.tex", "c/v.tex" } {
+		if err := CreateProjectFile(config, "alice", "talk", path, strings.NewReader(path), UncheckedFile, FilePrecondition{}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, dir := range []string{ "[ab]", "*" } {
+		if err := DeleteProjectFile(config, "alice", "talk", "src", dir, FilePrecondition{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := config.database.ListProjectFiles("alice", "talk", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	sort.Strings(paths)
+
+	expected := []string{ "a/y.tex", "b/z.tex", "c/v.tex" }
+	if strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected files %v after deleting, got %v", expected, paths)
+	}
+}
+
+func TestCreateProjectFileCompareAndSwap(t *testing.T) {
+	config := newTestConfig(t)
+	if err := CreateUser(config, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewProject(config, "alice", "paper"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateProjectFile(config, "alice", "paper", "main.tex", strings.NewReader("base\n"), UncheckedFile, FilePrecondition{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	base := fmt.Sprintf("%x", sha256.Sum256([]byte("base\n")))
+
+	// Every writer expects the same base, so only one of them may win
+	var wg sync.WaitGroup
+	results := make(chan error, 8)
+	for writer := 0; writer < cap(results); writer++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			contents := strings.NewReader(fmt.Sprintf("writer %d\n", writer))
+			results <- CreateProjectFile(config, "alice", "paper", "main.tex", contents, UncheckedFile, IfFileMatches(base), "")
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for err := range results {
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, ErrPreconditionFailed) {
+			t.Fatal(err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("expected one write to succeed, %d did", succeeded)
+	}
+
+	if err := DeleteProjectFile(config, "alice", "paper", "src", "main.tex", IfFileMatches(base)); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("expected deleting a changed file to fail, got %v", err)
+	}
+	if err := MoveProjectFile(config, "alice", "paper", "main.tex", "paper.tex", IfFileMatches(base), ""); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("expected moving a changed file to fail, got %v", err)
+	}
+}
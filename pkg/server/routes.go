@@ -1,25 +1,104 @@
 package server
 
 import (
+	"net/http"
+
 	"github.com/go-chi/chi/v5"
 )
 
 func SetupRoutes(config Config, router *chi.Mux) {
-	// TODO Add route to list builds/get specific/latest build info
-	// Maybe /user/project/builds (list)
-	//       /user/project/builds/(id|latest) (build info)
 	// TODO Authenticate routes, check if public, etc.
 	controller := NewController(config)
 
 	router.Use(TokenAuthMiddleware(config))
 
+	// The versioned API, with JSON bodies and errors
+	router.Route(APIPrefix, func(rAPI chi.Router) {
+		rAPI.Use(APIMiddleware)
+		rAPI.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		})
+
+		// OpenAPI document describing the API
+		rAPI.Get("/openapi.yaml", OpenAPIYAML)
+		rAPI.Get("/openapi.json", OpenAPIJSON)
+
+		apiRoutes(config, &controller, rAPI)
+	})
+
+	// Whether the server can serve requests
+	router.Get("/healthz", controller.Health)
+	// Whether the server can serve requests and build projects
+	router.Get("/readyz", controller.Ready)
+
+	// The same routes at the root, for older clients
+	apiRoutes(config, &controller, router)
+}
+
+// apiRoutes adds the routes of the API to a router
+func apiRoutes(config Config, controller *Controller, router chi.Router) {
 	// Login
 	router.Post("/login", controller.Login)
+	// Single sign-on login through an OIDC issuer
+	router.Route("/sso", func(rSSO chi.Router) {
+		// Send the browser to the issuer
+		rSSO.Get("/login", controller.SSOLogin)
+		// The issuer sends the browser back here
+		rSSO.Get("/callback", controller.SSOCallback)
+		// Exchange a one time login code for a token
+		rSSO.Post("/token", controller.SSOToken)
+		// Link the identity of the next login to your account
+		rSSO.Post("/link", controller.SSOLink)
+	})
+	// Register a new user with an invitation code
+	router.Post("/register", controller.Register)
 	// Logout
 	router.Post("/logout", controller.Logout)
 	// Logout all user logins everywhere (destroy all tokens for user)
 	router.Post("/logout_all", controller.LogoutAll)
 
+	router.Route("/account", func(rAccount chi.Router) {
+		// Change your own password, logging out other sessions
+		rAccount.Post("/password", controller.ChangePassword)
+		// Delete your own account and all of your projects
+		rAccount.Delete("/", controller.DeleteAccount)
+		// List your deleted projects and files
+		rAccount.Get("/trash", controller.ListTrash)
+		// Permanently delete everything in your trash
+		rAccount.Delete("/trash", controller.PurgeAllTrash)
+		// Restore a deleted project or file
+		rAccount.Post("/trash/{trashId}/restore", controller.RestoreTrash)
+		// Permanently delete a project or file from your trash
+		rAccount.Delete("/trash/{trashId}", controller.PurgeTrash)
+	})
+
+	router.Route("/admin", func(rAdmin chi.Router) {
+		rAdmin.Use(AdminOnlyMiddleware(config))
+
+		// List all users
+		rAdmin.Get("/users", controller.AdminListUsers)
+		// Create a new user
+		rAdmin.Post("/users", controller.AdminCreateUser)
+		// Delete a user and all of their projects
+		rAdmin.Delete("/users/{user}", controller.AdminDeleteUser)
+		// Disable a user, preventing login and token use
+		rAdmin.Post("/users/{user}/disable", controller.AdminDisableUser)
+		// Re-enable a disabled user
+		rAdmin.Post("/users/{user}/enable", controller.AdminEnableUser)
+		// Reset a user's password
+		rAdmin.Post("/users/{user}/password", controller.AdminResetPassword)
+		// List a user's tokens
+		rAdmin.Get("/users/{user}/tokens", controller.AdminListTokens)
+		// Revoke all of a user's tokens
+		rAdmin.Delete("/users/{user}/tokens", controller.AdminRevokeAllTokens)
+		// Revoke one of a user's tokens
+		rAdmin.Delete("/users/{user}/tokens/{tokenId}", controller.AdminRevokeToken)
+		// List all projects of all users
+		rAdmin.Get("/projects", controller.AdminListProjects)
+		// Force-cancel a project's running build
+		rAdmin.Post("/projects/{user}/{project}/cancel", controller.AdminCancelBuild)
+	})
+
 	router.Route("/{user}", func(rUser chi.Router) {
 		// List projects
 		rUser.Get("/", controller.ListProjects)
@@ -34,8 +113,20 @@ func SetupRoutes(config Config, router *chi.Mux) {
 			rProject.Get("/", controller.ProjectInfo)
 			// Delete a project
 			rProject.Delete("/", controller.DeleteProject)
+			// Make a project public or private
+			rProject.Post("/visibility", controller.SetProjectVisibility)
 			// Run project build
 			rProject.Post("/build", controller.BuildProject)
+			// List the project's recent builds
+			rProject.Get("/builds", controller.ListBuilds)
+			// Get a build's information and output
+			rProject.Get("/builds/{buildId}", controller.BuildInfo)
+			// Get a list of the output files kept from a build
+			rProject.Get("/builds/{buildId}/out", controller.ListBuildOutFiles)
+			// Retrieve an output file kept from a build
+			rProject.Get("/builds/{buildId}/out/*", controller.ReadBuildOutFile)
+			// Retrieve a source file as it was when a build was run
+			rProject.Get("/builds/{buildId}/src/*", controller.ReadBuildSrcFile)
 			// Get list of project source files
 			rProject.Get("/src", controller.ListSrcFiles)
 			// Create or update project source file
@@ -44,6 +135,16 @@ func SetupRoutes(config Config, router *chi.Mux) {
 			rProject.Get("/src/*", controller.ReadSrcFile)
 			// Delete a project souce file
 			rProject.Delete("/src/*", controller.DeleteSrcFile)
+			// Move or rename a project source file or directory
+			rProject.Post("/move", controller.MoveSrcFile)
+			// List the revisions of a project source file
+			rProject.Get("/history/*", controller.ListFileRevisions)
+			// Retrieve an old revision of a project source file
+			rProject.Get("/revision/{rev}/*", controller.ReadFileRevision)
+			// Diff two revisions of a project source file
+			rProject.Get("/diff/{from}/{to}/*", controller.DiffFileRevisions)
+			// Make an old revision of a project source file current
+			rProject.Post("/restore/{rev}/*", controller.RestoreFileRevision)
 			// Get a list of project aux files (if created)
 			rProject.Get("/aux", controller.ListAuxFiles)
 			// Retrieve a project aux file with the specified hash
@@ -2,42 +2,94 @@ package server
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
+// How long builds cancelled because they didn't finish draining, and
+// the requests still being handled after that, have to finish
+const shutdownGrace = 5 * time.Second
+
 // RunServer starts a server using the given configuration and listens
+// until it receives SIGINT or SIGTERM. Running builds are given the
+// configured drain timeout to finish before they're cancelled.
 func RunServer(config Config) error {
+	// Builds left running were interrupted by a server that didn't stop
+	// cleanly, none of them are still going
+	interrupted, err := MarkInterruptedBuilds(config)
+	if err != nil {
+		return err
+	}
+	if interrupted > 0 {
+		slog.Warn("Marked interrupted builds as failed", "count", interrupted)
+	}
+
 	mux := chi.NewMux()
 	mux.Use(middleware.RequestID)
 	mux.Use(middleware.RealIP)
-	mux.Use(middleware.Logger)
+	mux.Use(RequestLogger)
+	// Answer HEAD requests with the GET routes, without a body
+	mux.Use(middleware.GetHead)
+	mux.Use(CompressMiddleware(config))
 	SetupRoutes(config, mux)
 	srv := http.Server{Addr: config.ListenAddress, Handler: mux}
+
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	var janitors sync.WaitGroup
+	janitors.Add(2)
+	go func() {
+		defer janitors.Done()
+		RunTrashJanitor(janitorCtx, config, time.Hour)
+	}()
+	go func() {
+		defer janitors.Done()
+		RunBuildSnapshotJanitor(janitorCtx, config, time.Hour)
+	}()
+
 	go func() {
 		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatal(err)
+			slog.Error("Unable to listen", "err", err)
+			os.Exit(1)
 		}
 	}()
 
 	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	<-stop
+	sig := <-stop
+	// A second signal kills the server without waiting for builds
+	signal.Stop(stop)
 
-	log.Println("Received SIGINT, stopping...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
-	defer cancel()
+	slog.Info("Received signal, stopping...", "signal", sig.String(), "buildDrainTimeout", config.BuildDrainTimeout)
 
-	// Close the database before returning the error
+	// Keep serving while the builds drain, so clients can still fetch
+	// their output and load balancers see the server isn't ready, but
+	// refuse new builds
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), config.BuildDrainTimeout)
+	defer cancelDrain()
+	cancelled, drainErr := config.builds.Drain(drainCtx, shutdownGrace)
+	if cancelled > 0 {
+		slog.Warn("Cancelled builds that didn't finish in time", "count", cancelled)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
 	srvErr := srv.Shutdown(ctx)
 
+	// Nothing may use the database once it's closed
+	stopJanitor()
+	janitors.Wait()
+
+	// Close the database before returning the error
 	if err := config.database.conn.Close(); err != nil {
 		return err
 	}
@@ -46,5 +98,9 @@ func RunServer(config Config) error {
 		return srvErr
 	}
 
+	if drainErr != nil {
+		return drainErr
+	}
+
 	return nil
 }
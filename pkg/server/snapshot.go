@@ -0,0 +1,464 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The output of every finished build is copied to the project's
+// .builds/<build id> directory, so it can still be downloaded after
+// later builds overwrite the out directory
+const buildSnapshotDirName = ".builds"
+
+// BuildArtifact is an output file kept from a build
+type BuildArtifact struct {
+	Path string `json:"path"`
+	Sha256Sum string `json:"sha256sum"`
+	Size uint64 `json:"size"`
+}
+
+var ErrBuildNotFound = errors.New("build not found")
+var ErrBuildArtifactNotFound = errors.New("build output file not found")
+
+// Files from the aux directory that are kept along with everything in
+// the out directory
+var snapshotAuxSuffixes = []string{".log", ".synctex", ".synctex.gz"}
+
+func buildSnapshotPath(projectPath string, buildId int) string {
+	return filepath.Join(projectPath, buildSnapshotDirName, strconv.Itoa(buildId))
+}
+
+// snapshotFiles returns the files a build snapshot is made of, keyed
+// by their path in the snapshot. Files in the out directory take
+// precedence over aux files with the same path.
+func snapshotFiles(projectPath string) (map[string]string, error) {
+	files := make(map[string]string)
+
+	for _, subdir := range []string{"aux", "out"} {
+		subdirPath := filepath.Join(projectPath, subdir)
+		err := filepath.WalkDir(subdirPath, func(path string, entry fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && path == subdirPath {
+				return filepath.SkipDir
+			}
+			if err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			if subdir == "aux" && !hasSnapshotAuxSuffix(entry.Name()) {
+				return nil
+			}
+
+			relPath, err := filepath.Rel(subdirPath, path)
+			if err != nil {
+				return err
+			}
+			files[filepath.ToSlash(relPath)] = path
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("snapshotFiles walk %s: %w", subdir, err)
+		}
+	}
+
+	return files, nil
+}
+
+func hasSnapshotAuxSuffix(name string) bool {
+	for _, suffix := range snapshotAuxSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyBuildArtifact copies an output file into a snapshot. Files are
+// copied rather than linked because latex rewrites its output in place.
+func copyBuildArtifact(source, destination string) (string, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(destination), 0700); err != nil {
+		return "", 0, fmt.Errorf("copyBuildArtifact MkdirAll: %w", err)
+	}
+
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return "", 0, fmt.Errorf("copyBuildArtifact open source: %w", err)
+	}
+	defer sourceFile.Close()
+
+	destinationFile, err := os.Create(destination)
+	if err != nil {
+		return "", 0, fmt.Errorf("copyBuildArtifact create destination: %w", err)
+	}
+	defer destinationFile.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(destinationFile, hasher), sourceFile)
+	if err != nil {
+		return "", 0, fmt.Errorf("copyBuildArtifact copy: %w", err)
+	}
+
+	if err := destinationFile.Close(); err != nil {
+		return "", 0, fmt.Errorf("copyBuildArtifact close destination: %w", err)
+	}
+
+	return fmt.Sprintf("%x", hasher.Sum(nil)), size, nil
+}
+
+// snapshotBuild copies the output of a finished build into its
+// snapshot directory and records the files it produced
+func snapshotBuild(config Config, projectPath string, buildId int) error {
+	files, err := snapshotFiles(projectPath)
+	if err != nil {
+		return fmt.Errorf("snapshotBuild: %w", err)
+	}
+
+	snapshotPath := buildSnapshotPath(projectPath, buildId)
+
+	var artifacts []BuildArtifact
+	for path, source := range files {
+		digest, size, err := copyBuildArtifact(source, filepath.Join(snapshotPath, filepath.FromSlash(path)))
+		if err != nil {
+			os.RemoveAll(snapshotPath)
+			return fmt.Errorf("snapshotBuild: %w", err)
+		}
+		artifacts = append(artifacts, BuildArtifact{ Path: path, Sha256Sum: digest, Size: uint64(size) })
+	}
+
+	if err := recordBuildArtifacts(config, buildId, artifacts); err != nil {
+		os.RemoveAll(snapshotPath)
+		return fmt.Errorf("snapshotBuild: %w", err)
+	}
+
+	return nil
+}
+
+func recordBuildArtifacts(config Config, buildId int, artifacts []BuildArtifact) error {
+	tx, err := config.database.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("recordBuildArtifacts begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, artifact := range artifacts {
+		if _, err := tx.Exec(
+			"INSERT INTO build_artifacts (build_id, path, sha256sum, size) VALUES (?, ?, ?, ?)",
+			buildId,
+			artifact.Path,
+			artifact.Sha256Sum,
+			artifact.Size,
+		); err != nil {
+			return fmt.Errorf("recordBuildArtifacts insert: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE builds SET snapshot = TRUE WHERE id = ?", buildId); err != nil {
+		return fmt.Errorf("recordBuildArtifacts update build: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("recordBuildArtifacts commit: %w", err)
+	}
+
+	return nil
+}
+
+// ListProjectBuilds returns the most recent builds of a project, newest
+// first, with the output files kept from each of them. Build output is
+// left out, GetProjectBuild returns it.
+func ListProjectBuilds(config Config, user, projectName string, limit int) ([]BuildInfo, error) {
+	projectId, err := config.database.GetProjectId(user, projectName)
+	if err != nil {
+		return nil, fmt.Errorf("ListProjectBuilds: %w", err)
+	}
+
+	rows, err := config.database.conn.Query(
+		"SELECT id, build_start, COALESCE(build_time, 0), COALESCE(status, ''), COALESCE(options, '{}'), '' FROM builds WHERE project_id = ? ORDER BY id DESC LIMIT ?",
+		projectId,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ListProjectBuilds query: %w", err)
+	}
+
+	builds := []BuildInfo{}
+
+	for rows.Next() {
+		build, err := scanBuildInfo(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("ListProjectBuilds: %w", err)
+		}
+		builds = append(builds, build)
+	}
+	rows.Close()
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("ListProjectBuilds rows error: %w", rows.Err())
+	}
+
+	for index := range builds {
+		builds[index].Artifacts, err = listBuildArtifacts(config, builds[index].ID)
+		if err != nil {
+			return nil, fmt.Errorf("ListProjectBuilds: %w", err)
+		}
+	}
+
+	return builds, nil
+}
+
+// GetProjectBuild returns a build of a project, with its output, the
+// output files kept from it and the src files it was run with
+func GetProjectBuild(config Config, user, projectName string, buildId int) (BuildInfo, error) {
+	projectId, err := config.database.GetProjectId(user, projectName)
+	if err != nil {
+		return BuildInfo{}, fmt.Errorf("GetProjectBuild: %w", err)
+	}
+
+	build, err := scanBuildInfo(config.database.conn.QueryRow(
+		"SELECT id, build_start, COALESCE(build_time, 0), COALESCE(status, ''), COALESCE(options, '{}'), COALESCE(build_out, '') FROM builds WHERE project_id = ? AND id = ?",
+		projectId,
+		buildId,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return BuildInfo{}, ErrBuildNotFound
+	}
+	if err != nil {
+		return BuildInfo{}, fmt.Errorf("GetProjectBuild: %w", err)
+	}
+
+	build.Artifacts, err = listBuildArtifacts(config, build.ID)
+	if err != nil {
+		return BuildInfo{}, fmt.Errorf("GetProjectBuild: %w", err)
+	}
+
+	build.Manifest, err = getBuildManifest(config, projectId, build.ID)
+	if err != nil {
+		return BuildInfo{}, fmt.Errorf("GetProjectBuild: %w", err)
+	}
+
+	return build, nil
+}
+
+func scanBuildInfo(scanner interface{ Scan(...any) error }) (BuildInfo, error) {
+	var build BuildInfo
+	var buildStart string
+	var unparsedOptions string
+	if err := scanner.Scan(
+		&build.ID,
+		&buildStart,
+		&build.BuildTime,
+		&build.Status,
+		&unparsedOptions,
+		&build.BuildOut,
+	); err != nil {
+		return BuildInfo{}, fmt.Errorf("scan: %w", err)
+	}
+
+	var err error
+	build.BuildStart, err = time.Parse(SQLiteTimeNano, buildStart)
+	if err != nil {
+		return BuildInfo{}, fmt.Errorf("parse buildStart time: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(unparsedOptions), &build.Options); err != nil {
+		return BuildInfo{}, fmt.Errorf("unmarshal build options: %w", err)
+	}
+
+	return build, nil
+}
+
+func listBuildArtifacts(config Config, buildId int) ([]BuildArtifact, error) {
+	rows, err := config.database.conn.Query("SELECT path, sha256sum, size FROM build_artifacts WHERE build_id = ? ORDER BY path", buildId)
+	if err != nil {
+		return nil, fmt.Errorf("listBuildArtifacts query: %w", err)
+	}
+	defer rows.Close()
+
+	var artifacts []BuildArtifact
+
+	for rows.Next() {
+		var artifact BuildArtifact
+		if err := rows.Scan(&artifact.Path, &artifact.Sha256Sum, &artifact.Size); err != nil {
+			return nil, fmt.Errorf("listBuildArtifacts scan: %w", err)
+		}
+		artifacts = append(artifacts, artifact)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("listBuildArtifacts rows error: %w", rows.Err())
+	}
+
+	return artifacts, nil
+}
+
+// OpenBuildArtifact opens an output file kept from a build. Caller is
+// responsible for closing it.
+func OpenBuildArtifact(config Config, user, projectName string, buildId int, path string) (*os.File, BuildArtifact, error) {
+	projectId, err := config.database.GetProjectId(user, projectName)
+	if err != nil {
+		return nil, BuildArtifact{}, fmt.Errorf("OpenBuildArtifact: %w", err)
+	}
+
+	// Only paths recorded for the build are served, so there is no
+	// way to reach outside of the snapshot
+	artifact := BuildArtifact{ Path: path }
+	err = config.database.conn.QueryRow(`
+SELECT a.sha256sum, a.size
+FROM build_artifacts a
+JOIN builds b ON b.id = a.build_id
+WHERE b.project_id = ? AND b.id = ? AND a.path = ?`,
+		projectId,
+		buildId,
+		path,
+	).Scan(&artifact.Sha256Sum, &artifact.Size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, BuildArtifact{}, ErrBuildArtifactNotFound
+	}
+	if err != nil {
+		return nil, BuildArtifact{}, fmt.Errorf("OpenBuildArtifact query: %w", err)
+	}
+
+	projectPath := filepath.Join(config.ProjectDir, user, projectName)
+	file, err := os.Open(filepath.Join(buildSnapshotPath(projectPath, buildId), filepath.FromSlash(path)))
+	if err != nil {
+		return nil, BuildArtifact{}, fmt.Errorf("OpenBuildArtifact open: %w", err)
+	}
+
+	return file, artifact, nil
+}
+
+// PruneBuildSnapshots removes the build snapshots of every project that
+// are past the configured retention count or age. It returns how many
+// were removed.
+func PruneBuildSnapshots(config Config) (int, error) {
+	return pruneBuildSnapshots(config, "")
+}
+
+// pruneBuildSnapshots removes the snapshots matching an extra condition
+// on the build b that are past the configured retention
+func pruneBuildSnapshots(config Config, condition string, args ...any) (int, error) {
+	var retention []string
+	var retentionArgs []any
+
+	if config.BuildRetentionCount > 0 {
+		retention = append(retention, "(SELECT COUNT(*) FROM builds newer WHERE newer.project_id = b.project_id AND newer.snapshot AND newer.id > b.id) >= ?")
+		retentionArgs = append(retentionArgs, config.BuildRetentionCount)
+	}
+	if config.BuildRetentionAge > 0 {
+		retention = append(retention, "b.build_start < ?")
+		retentionArgs = append(retentionArgs, time.Now().Add(-config.BuildRetentionAge).UTC().Format(SQLiteTime))
+	}
+	if len(retention) == 0 {
+		return 0, nil
+	}
+
+	stmt := `
+SELECT b.id, u.name, p.name
+FROM builds b
+JOIN projects p ON p.id = b.project_id
+JOIN users u ON u.id = p.user_id
+WHERE b.snapshot AND (` + strings.Join(retention, " OR ") + ")"
+	if condition != "" {
+		stmt += " AND " + condition
+	}
+
+	rows, err := config.database.conn.Query(stmt, append(retentionArgs, args...)...)
+	if err != nil {
+		return 0, fmt.Errorf("pruneBuildSnapshots query: %w", err)
+	}
+
+	type expiredSnapshot struct {
+		buildId int
+		user string
+		project string
+	}
+	var expired []expiredSnapshot
+
+	for rows.Next() {
+		var snapshot expiredSnapshot
+		if err := rows.Scan(&snapshot.buildId, &snapshot.user, &snapshot.project); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("pruneBuildSnapshots scan: %w", err)
+		}
+		expired = append(expired, snapshot)
+	}
+	rows.Close()
+
+	if rows.Err() != nil {
+		return 0, fmt.Errorf("pruneBuildSnapshots rows error: %w", rows.Err())
+	}
+
+	for index, snapshot := range expired {
+		if err := removeBuildSnapshot(config, snapshot.user, snapshot.project, snapshot.buildId); err != nil {
+			return index, fmt.Errorf("pruneBuildSnapshots: %w", err)
+		}
+	}
+
+	return len(expired), nil
+}
+
+// removeBuildSnapshot deletes the output files kept from a build. The
+// build itself stays in the project's build list.
+func removeBuildSnapshot(config Config, user, projectName string, buildId int) error {
+	tx, err := config.database.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("removeBuildSnapshot begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM build_artifacts WHERE build_id = ?", buildId); err != nil {
+		return fmt.Errorf("removeBuildSnapshot delete artifacts: %w", err)
+	}
+
+	if _, err := tx.Exec("UPDATE builds SET snapshot = FALSE WHERE id = ?", buildId); err != nil {
+		return fmt.Errorf("removeBuildSnapshot update build: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("removeBuildSnapshot commit: %w", err)
+	}
+
+	projectPath := filepath.Join(config.ProjectDir, user, projectName)
+	if err := os.RemoveAll(buildSnapshotPath(projectPath, buildId)); err != nil {
+		return fmt.Errorf("removeBuildSnapshot remove files: %w", err)
+	}
+
+	return nil
+}
+
+// RunBuildSnapshotJanitor prunes build snapshots past their retention
+// every interval until ctx is cancelled. Snapshots past the retention
+// count are also pruned after every build.
+func RunBuildSnapshotJanitor(ctx context.Context, config Config, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pruned, err := PruneBuildSnapshots(config)
+		if err != nil {
+			slog.Error("Build snapshot janitor failed", "err", err)
+		} else if pruned > 0 {
+			slog.Info("Build snapshot janitor pruned snapshots", "count", pruned)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
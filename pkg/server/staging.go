@@ -0,0 +1,232 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Builds don't run in the live src directory, which can change while
+// a client is pushing. The src files are staged into the project's
+// .staging directory from their history blobs, which never change, so
+// every build sees exactly the files in its manifest. They're copied
+// rather than linked so a build writing to its sources can't change
+// the history.
+const stagingDirName = ".staging"
+
+var ErrBuildSourceNotFound = errors.New("build source file not found")
+
+func stagingPath(projectPath string) string {
+	return filepath.Join(projectPath, stagingDirName)
+}
+
+// stageBuildSources fills the project's staging directory with the
+// current src files and returns the manifest of what was staged. Only
+// one build of a project runs at a time, so anything left in the
+// staging directory is from an earlier build and is removed.
+func stageBuildSources(config Config, projectId int, projectPath string) ([]FileInfo, error) {
+	// The file list is a single consistent view of src, uploads update
+	// it only after the file's blob has been stored
+	rows, err := config.database.conn.Query(
+		"SELECT path, size, sha256sum FROM files WHERE project_id = ? AND subdir = ? ORDER BY path",
+		projectId,
+		"src",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("stageBuildSources query: %w", err)
+	}
+
+	var files []FileInfo
+
+	for rows.Next() {
+		var file FileInfo
+		if err := rows.Scan(&file.Path, &file.Size, &file.Sha256Sum); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("stageBuildSources scan: %w", err)
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("stageBuildSources rows error: %w", rows.Err())
+	}
+
+	staging := stagingPath(projectPath)
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, fmt.Errorf("stageBuildSources clear staging: %w", err)
+	}
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return nil, fmt.Errorf("stageBuildSources create staging: %w", err)
+	}
+
+	manifest := []FileInfo{}
+
+	for _, file := range files {
+		if strings.Contains(file.Path, "../") {
+			continue
+		}
+
+		staged, err := stageSourceFile(projectPath, file)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted since the file list was read
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stageBuildSources %s: %w", file.Path, err)
+		}
+		manifest = append(manifest, staged)
+	}
+
+	return manifest, nil
+}
+
+// stageSourceFile copies a src file's history blob into the staging
+// directory. Files without a blob, like ones uploaded before history
+// was kept, are stored as a blob first.
+func stageSourceFile(projectPath string, file FileInfo) (FileInfo, error) {
+	destination := filepath.Join(stagingPath(projectPath), filepath.FromSlash(file.Path))
+	if err := os.MkdirAll(filepath.Dir(destination), 0700); err != nil {
+		return FileInfo{}, fmt.Errorf("stageSourceFile MkdirAll: %w", err)
+	}
+
+	blobPath := filepath.Join(historyPath(projectPath), file.Sha256Sum)
+	if _, err := os.Stat(blobPath); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return FileInfo{}, fmt.Errorf("stageSourceFile stat blob: %w", err)
+		}
+
+		file, err = storeSourceBlob(projectPath, file.Path)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		blobPath = filepath.Join(historyPath(projectPath), file.Sha256Sum)
+	}
+
+	if err := copyFile(blobPath, destination); err != nil {
+		return FileInfo{}, fmt.Errorf("stageSourceFile: %w", err)
+	}
+
+	return file, nil
+}
+
+// storeSourceBlob copies the current contents of a src file into the
+// project's history blobs and returns what was stored
+func storeSourceBlob(projectPath, path string) (FileInfo, error) {
+	source, err := os.Open(filepath.Join(projectPath, "src", filepath.FromSlash(path)))
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("storeSourceBlob open: %w", err)
+	}
+	defer source.Close()
+
+	blob, err := createRevisionBlob(projectPath)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("storeSourceBlob: %w", err)
+	}
+	defer os.Remove(blob.Name())
+	defer blob.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(blob, hasher), source)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("storeSourceBlob copy: %w", err)
+	}
+	if err := blob.Close(); err != nil {
+		return FileInfo{}, fmt.Errorf("storeSourceBlob close blob: %w", err)
+	}
+
+	digest := fmt.Sprintf("%x", hasher.Sum(nil))
+	if err := storeRevisionBlob(projectPath, blob.Name(), digest); err != nil {
+		return FileInfo{}, fmt.Errorf("storeSourceBlob: %w", err)
+	}
+
+	return FileInfo{ Path: path, Size: uint64(size), Sha256Sum: digest }, nil
+}
+
+func copyFile(source, destination string) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("copyFile open source: %w", err)
+	}
+	defer sourceFile.Close()
+
+	destinationFile, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("copyFile create destination: %w", err)
+	}
+	defer destinationFile.Close()
+
+	if _, err := io.Copy(destinationFile, sourceFile); err != nil {
+		return fmt.Errorf("copyFile copy: %w", err)
+	}
+
+	if err := destinationFile.Close(); err != nil {
+		return fmt.Errorf("copyFile close destination: %w", err)
+	}
+
+	return nil
+}
+
+// getBuildManifest returns the src files a build was run with
+func getBuildManifest(config Config, projectId, buildId int) ([]FileInfo, error) {
+	var unparsedManifest sql.NullString
+	err := config.database.conn.QueryRow(
+		"SELECT manifest FROM builds WHERE project_id = ? AND id = ?",
+		projectId,
+		buildId,
+	).Scan(&unparsedManifest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBuildNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getBuildManifest query: %w", err)
+	}
+
+	// Builds from before manifests were recorded
+	if !unparsedManifest.Valid {
+		return nil, nil
+	}
+
+	var manifest []FileInfo
+	if err := json.Unmarshal([]byte(unparsedManifest.String), &manifest); err != nil {
+		return nil, fmt.Errorf("getBuildManifest unmarshal: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// OpenBuildSource opens a src file as it was when a build was run.
+// Caller is responsible for closing it.
+func OpenBuildSource(config Config, user, projectName string, buildId int, path string) (*os.File, FileInfo, error) {
+	projectId, err := config.database.GetProjectId(user, projectName)
+	if err != nil {
+		return nil, FileInfo{}, fmt.Errorf("OpenBuildSource: %w", err)
+	}
+
+	manifest, err := getBuildManifest(config, projectId, buildId)
+	if err != nil {
+		return nil, FileInfo{}, fmt.Errorf("OpenBuildSource: %w", err)
+	}
+
+	for _, file := range manifest {
+		if file.Path != path {
+			continue
+		}
+
+		projectPath := filepath.Join(config.ProjectDir, user, projectName)
+		blob, err := os.Open(filepath.Join(historyPath(projectPath), file.Sha256Sum))
+		if err != nil {
+			return nil, FileInfo{}, fmt.Errorf("OpenBuildSource open blob: %w", err)
+		}
+		return blob, file, nil
+	}
+
+	return nil, FileInfo{}, ErrBuildSourceNotFound
+}
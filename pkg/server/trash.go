@@ -0,0 +1,471 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Deleted projects and files are moved to
+// <ProjectDir>/.trash/<user>/<storage>, where they stay until they're
+// restored, purged, or expire. Usernames must start with a letter, so
+// the trash can't collide with a user's directory.
+const trashDirName = ".trash"
+
+const (
+	TrashKindProject = "project"
+	TrashKindFile = "file"
+)
+
+// TrashEntry is a deleted project, or a deleted file or directory
+// inside of a project
+type TrashEntry struct {
+	ID int `json:"id"`
+	Kind string `json:"kind"`
+	Project string `json:"project"`
+	Subdir string `json:"subdir,omitempty"`
+	Path string `json:"path,omitempty"`
+	DeletedAt time.Time `json:"deletedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	public bool
+	storage string
+}
+
+var ErrTrashConflict = errors.New("restore would overwrite an existing project or file")
+var ErrTrashNotFound = errors.New("trash entry not found")
+
+// userTrashPath returns the directory holding a user's trash
+func userTrashPath(config Config, user string) string {
+	return filepath.Join(config.ProjectDir, trashDirName, user)
+}
+
+// moveToTrash moves source into the user's trash and records entry.
+// deleteRows removes the database rows of whatever was trashed in the
+// same transaction as the trash entry with id trashId is added. If
+// anything fails, source is moved back.
+func moveToTrash(config Config, user string, entry TrashEntry, source string, deleteRows func(tx *sql.Tx, trashId int64) error) error {
+	userId, err := config.database.GetUserId(user)
+	if err != nil {
+		return fmt.Errorf("moveToTrash: %w", err)
+	}
+
+	storageBytes := make([]byte, 16)
+	if _, err := rand.Read(storageBytes); err != nil {
+		return fmt.Errorf("moveToTrash read random: %w", err)
+	}
+	entry.storage = fmt.Sprintf("%x", storageBytes)
+
+	trashPath := userTrashPath(config, user)
+	if err := os.MkdirAll(trashPath, 0700); err != nil {
+		return fmt.Errorf("moveToTrash create trash dir: %w", err)
+	}
+
+	storagePath := filepath.Join(trashPath, entry.storage)
+	if err := os.Rename(source, storagePath); err != nil {
+		return fmt.Errorf("moveToTrash move: %w", err)
+	}
+
+	if err := recordTrashEntry(config, userId, entry, deleteRows); err != nil {
+		if restoreErr := os.Rename(storagePath, source); restoreErr != nil {
+			return fmt.Errorf("moveToTrash: %w (%s)", err, restoreErr)
+		}
+		return fmt.Errorf("moveToTrash: %w", err)
+	}
+
+	return nil
+}
+
+func recordTrashEntry(config Config, userId int, entry TrashEntry, deleteRows func(tx *sql.Tx, trashId int64) error) error {
+	now := time.Now().UTC()
+
+	var subdir, path any
+	if entry.Kind == TrashKindFile {
+		subdir = entry.Subdir
+		path = entry.Path
+	}
+
+	tx, err := config.database.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("recordTrashEntry begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO trash (user_id, storage, project_name, subdir, path, public, deleted_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		userId,
+		entry.storage,
+		entry.Project,
+		subdir,
+		path,
+		entry.public,
+		now.Format(SQLiteTime),
+		now.Add(config.TrashRetention).Format(SQLiteTime),
+	)
+	if err != nil {
+		return fmt.Errorf("recordTrashEntry insert: %w", err)
+	}
+
+	trashId, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("recordTrashEntry get id: %w", err)
+	}
+
+	if err := deleteRows(tx, trashId); err != nil {
+		return fmt.Errorf("recordTrashEntry delete rows: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("recordTrashEntry commit: %w", err)
+	}
+
+	return nil
+}
+
+const trashColumns = "t.id, t.storage, t.project_name, COALESCE(t.subdir, ''), COALESCE(t.path, ''), t.public, t.deleted_at, t.expires_at"
+
+func scanTrashEntry(scanner interface{ Scan(...any) error }) (TrashEntry, error) {
+	var entry TrashEntry
+	var deletedAt, expiresAt string
+	if err := scanner.Scan(
+		&entry.ID,
+		&entry.storage,
+		&entry.Project,
+		&entry.Subdir,
+		&entry.Path,
+		&entry.public,
+		&deletedAt,
+		&expiresAt,
+	); err != nil {
+		return TrashEntry{}, err
+	}
+
+	entry.Kind = TrashKindProject
+	if entry.Path != "" {
+		entry.Kind = TrashKindFile
+	}
+
+	var err error
+	if entry.DeletedAt, err = time.Parse(SQLiteTime, deletedAt); err != nil {
+		return TrashEntry{}, fmt.Errorf("parse deleted_at: %w", err)
+	}
+	if entry.ExpiresAt, err = time.Parse(SQLiteTime, expiresAt); err != nil {
+		return TrashEntry{}, fmt.Errorf("parse expires_at: %w", err)
+	}
+
+	return entry, nil
+}
+
+// ListTrash returns everything in a user's trash, most recently
+// deleted first
+func ListTrash(config Config, user string) ([]TrashEntry, error) {
+	rows, err := config.database.conn.Query(
+		"SELECT " + trashColumns + " FROM trash t JOIN users u ON u.id = t.user_id WHERE u.name = ? ORDER BY t.id DESC",
+		user,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ListTrash query: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []TrashEntry{}
+
+	for rows.Next() {
+		entry, err := scanTrashEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ListTrash scan: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("ListTrash rows error: %w", rows.Err())
+	}
+
+	return entries, nil
+}
+
+func getTrashEntry(config Config, user string, id int) (TrashEntry, error) {
+	row := config.database.conn.QueryRow(
+		"SELECT " + trashColumns + " FROM trash t JOIN users u ON u.id = t.user_id WHERE u.name = ? AND t.id = ?",
+		user,
+		id,
+	)
+
+	entry, err := scanTrashEntry(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TrashEntry{}, ErrTrashNotFound
+	}
+	if err != nil {
+		return TrashEntry{}, fmt.Errorf("getTrashEntry scan: %w", err)
+	}
+
+	return entry, nil
+}
+
+// RestoreTrash puts a deleted project or file back where it was. It
+// returns ErrTrashConflict if something has been created in its place
+// since, or if a file's project no longer exists.
+func RestoreTrash(config Config, user string, id int) (TrashEntry, error) {
+	entry, err := getTrashEntry(config, user, id)
+	if err != nil {
+		return TrashEntry{}, fmt.Errorf("RestoreTrash: %w", err)
+	}
+
+	storagePath := filepath.Join(userTrashPath(config, user), entry.storage)
+	projectPath := filepath.Join(config.ProjectDir, user, entry.Project)
+
+	if entry.Kind == TrashKindProject {
+		err = restoreTrashProject(config, user, entry, storagePath, projectPath)
+	} else {
+		err = restoreTrashFile(config, user, entry, storagePath, projectPath)
+	}
+	if err != nil {
+		return TrashEntry{}, fmt.Errorf("RestoreTrash: %w", err)
+	}
+
+	if _, err := config.database.conn.Exec("DELETE FROM trash WHERE id = ?", entry.ID); err != nil {
+		return TrashEntry{}, fmt.Errorf("RestoreTrash delete entry: %w", err)
+	}
+
+	return entry, nil
+}
+
+func restoreTrashProject(config Config, user string, entry TrashEntry, storagePath, projectPath string) error {
+	if _, err := config.database.GetProjectId(user, entry.Project); err == nil {
+		return ErrTrashConflict
+	}
+	if _, err := os.Lstat(projectPath); err == nil {
+		return ErrTrashConflict
+	}
+
+	userId, err := config.database.GetUserId(user)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(projectPath), 0700); err != nil {
+		return fmt.Errorf("create user dir: %w", err)
+	}
+
+	if err := os.Rename(storagePath, projectPath); err != nil {
+		return fmt.Errorf("move project: %w", err)
+	}
+
+	if err := insertRestoredProject(config, userId, entry); err != nil {
+		if restoreErr := os.Rename(projectPath, storagePath); restoreErr != nil {
+			return fmt.Errorf("%w (%s)", err, restoreErr)
+		}
+		return err
+	}
+
+	// The project's builds were deleted with it, so their snapshots
+	// can't be reached anymore
+	if err := os.RemoveAll(filepath.Join(projectPath, buildSnapshotDirName)); err != nil {
+		return fmt.Errorf("remove build snapshots: %w", err)
+	}
+
+	for _, subdir := range []string{"aux", "out", "src"} {
+		if err := ScanProjectFiles(config, user, entry.Project, subdir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertRestoredProject adds the projects row of a restored project,
+// and moves the file revisions kept with its trash entry back to it
+func insertRestoredProject(config Config, userId int, entry TrashEntry) error {
+	tx, err := config.database.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO projects (name, user_id, public) VALUES (?, ?, ?)", entry.Project, userId, entry.public)
+	if err != nil {
+		return fmt.Errorf("insert project: %w", err)
+	}
+
+	projectId, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("get project id: %w", err)
+	}
+
+	if _, err := tx.Exec(`
+INSERT INTO file_revisions (project_id, path, revision, sha256sum, size, created_at, token_id, token_description)
+SELECT ?, path, revision, sha256sum, size, created_at, token_id, token_description FROM trash_file_revisions WHERE trash_id = ?`,
+		projectId,
+		entry.ID,
+	); err != nil {
+		return fmt.Errorf("restore file revisions: %w", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM trash_file_revisions WHERE trash_id = ?", entry.ID); err != nil {
+		return fmt.Errorf("delete trashed file revisions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return nil
+}
+
+func restoreTrashFile(config Config, user string, entry TrashEntry, storagePath, projectPath string) error {
+	projectId, err := config.database.GetProjectId(user, entry.Project)
+	if err != nil {
+		return ErrTrashConflict
+	}
+
+	unlock := config.fileLocks.Lock(projectId)
+	defer unlock()
+
+	filePath := filepath.Join(projectPath, entry.Subdir, entry.Path)
+	if _, err := os.Lstat(filePath); err == nil {
+		return ErrTrashConflict
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return fmt.Errorf("create parent dirs: %w", err)
+	}
+
+	if err := os.Rename(storagePath, filePath); err != nil {
+		return fmt.Errorf("move file: %w", err)
+	}
+
+	return ScanProjectFiles(config, user, entry.Project, entry.Subdir)
+}
+
+// PurgeTrash permanently deletes an entry from a user's trash
+func PurgeTrash(config Config, user string, id int) (TrashEntry, error) {
+	entry, err := getTrashEntry(config, user, id)
+	if err != nil {
+		return TrashEntry{}, fmt.Errorf("PurgeTrash: %w", err)
+	}
+
+	if err := purgeTrashEntry(config, user, entry); err != nil {
+		return TrashEntry{}, fmt.Errorf("PurgeTrash: %w", err)
+	}
+
+	return entry, nil
+}
+
+// PurgeAllTrash permanently deletes everything in a user's trash, and
+// returns the number of entries deleted
+func PurgeAllTrash(config Config, user string) (int, error) {
+	entries, err := ListTrash(config, user)
+	if err != nil {
+		return 0, fmt.Errorf("PurgeAllTrash: %w", err)
+	}
+
+	for index, entry := range entries {
+		if err := purgeTrashEntry(config, user, entry); err != nil {
+			return index, fmt.Errorf("PurgeAllTrash: %w", err)
+		}
+	}
+
+	return len(entries), nil
+}
+
+// purgeTrashEntry deletes the entry's row first, so a failure to
+// remove its files only leaves behind an unreferenced directory
+func purgeTrashEntry(config Config, user string, entry TrashEntry) error {
+	if _, err := config.database.conn.Exec("DELETE FROM trash WHERE id = ?", entry.ID); err != nil {
+		return fmt.Errorf("delete entry: %w", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(userTrashPath(config, user), entry.storage)); err != nil {
+		return fmt.Errorf("remove files: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeExpiredTrash permanently deletes every user's trash entries
+// that are past their retention period, and returns the number of
+// entries deleted
+func PurgeExpiredTrash(config Config) (int, error) {
+	rows, err := config.database.conn.Query(
+		"SELECT u.name, " + trashColumns + " FROM trash t JOIN users u ON u.id = t.user_id WHERE t.expires_at <= ?",
+		time.Now().UTC().Format(SQLiteTime),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("PurgeExpiredTrash query: %w", err)
+	}
+
+	type expiredEntry struct {
+		user string
+		entry TrashEntry
+	}
+	var expired []expiredEntry
+
+	for rows.Next() {
+		var user string
+		entry, err := scanTrashEntry(scannerFunc(func(dest ...any) error {
+			return rows.Scan(append([]any{ &user }, dest...)...)
+		}))
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("PurgeExpiredTrash scan: %w", err)
+		}
+		expired = append(expired, expiredEntry{ user: user, entry: entry })
+	}
+	rows.Close()
+
+	if rows.Err() != nil {
+		return 0, fmt.Errorf("PurgeExpiredTrash rows error: %w", rows.Err())
+	}
+
+	for index, item := range expired {
+		if err := purgeTrashEntry(config, item.user, item.entry); err != nil {
+			return index, fmt.Errorf("PurgeExpiredTrash: %w", err)
+		}
+	}
+
+	return len(expired), nil
+}
+
+type scannerFunc func(dest ...any) error
+
+func (f scannerFunc) Scan(dest ...any) error {
+	return f(dest...)
+}
+
+// RunTrashJanitor purges expired trash every interval until ctx is
+// cancelled
+func RunTrashJanitor(ctx context.Context, config Config, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := PurgeExpiredTrash(config)
+		if err != nil {
+			slog.Error("Trash janitor failed", "err", err)
+		} else if purged > 0 {
+			slog.Info("Trash janitor purged expired entries", "count", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeUserTrash removes a deleted user's trash directory. Their
+// trash entries are removed from the database with the user.
+func removeUserTrash(config Config, user string) error {
+	if err := os.RemoveAll(userTrashPath(config, user)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removeUserTrash: %w", err)
+	}
+	return nil
+}
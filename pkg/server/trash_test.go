@@ -0,0 +1,49 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRestoredProjectKeepsHistory(t *testing.T) {
+	config := newTestConfig(t)
+	if err := CreateUser(config, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewProject(config, "alice", "paper"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, contents := range []string{ "first\n", "second\n" } {
+		if err := CreateProjectFile(config, "alice", "paper", "main.tex", strings.NewReader(contents), UncheckedFile, FilePrecondition{}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := DeleteProject(config, "alice", "paper"); err != nil {
+		t.Fatal(err)
+	}
+	trash, err := ListTrash(config, "alice")
+	if err != nil || len(trash) != 1 {
+		t.Fatalf("expected one trash entry, got %v (%v)", trash, err)
+	}
+	if _, err := RestoreTrash(config, "alice", trash[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := ListFileRevisions(config, "alice", "paper", "main.tex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("expected 2 revisions after restoring, got %d", len(revisions))
+	}
+
+	diff, err := DiffFileRevisions(config, "alice", "paper", "main.tex", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "-first\n+second\n") {
+		t.Fatalf("unexpected diff after restoring:\n%s", diff)
+	}
+}
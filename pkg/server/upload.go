@@ -0,0 +1,205 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Uploads are streamed from the request into the project as they
+// arrive, they're never held in memory. The size limit is enforced
+// while streaming, since compressed or chunked uploads don't say how
+// big they are up front.
+
+var ErrFileTooLarge = errors.New("file is larger than the maximum upload size")
+var ErrUploadIncomplete = errors.New("upload is missing its path or file")
+var ErrUploadMismatch = errors.New("uploaded file does not match its expected size or sha256sum")
+
+// Headers a client sends with an upload so the server can tell the file
+// arrived intact
+const (
+	FileSizeHeader = "X-File-Size"
+	FileSha256Header = "X-File-Sha256"
+)
+
+// ExpectedFile is what an uploaded file is checked against before it
+// replaces the existing file. A negative size or empty sum isn't
+// checked.
+type ExpectedFile struct {
+	Size int64
+	Sha256Sum string
+}
+
+// UncheckedFile accepts any upload, for clients that don't send what
+// to expect
+var UncheckedFile = ExpectedFile{ Size: -1 }
+
+// ParseExpectedFile reads what to expect of an upload from its headers
+func ParseExpectedFile(header http.Header) (ExpectedFile, error) {
+	expected := UncheckedFile
+
+	if value := header.Get(FileSizeHeader); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return ExpectedFile{}, fmt.Errorf("ParseExpectedFile invalid size \"%s\"", value)
+		}
+		expected.Size = size
+	}
+
+	if value := header.Get(FileSha256Header); value != "" {
+		digest := strings.ToLower(value)
+		if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+			return ExpectedFile{}, fmt.Errorf("ParseExpectedFile invalid sha256sum \"%s\"", value)
+		}
+		expected.Sha256Sum = digest
+	}
+
+	return expected, nil
+}
+
+func (e ExpectedFile) check(size int64, digest string) error {
+	if e.Size >= 0 && e.Size != size {
+		return fmt.Errorf("%w: got %d bytes, expected %d", ErrUploadMismatch, size, e.Size)
+	}
+	if e.Sha256Sum != "" && e.Sha256Sum != digest {
+		return fmt.Errorf("%w: got sha256sum %s, expected %s", ErrUploadMismatch, digest, e.Sha256Sum)
+	}
+	return nil
+}
+
+// maxUploadPathSize is the most that will be read from an upload's
+// path field
+const maxUploadPathSize = 4096
+
+// sizeLimitReader reads from reader, failing with ErrFileTooLarge
+// instead of reading more than limit bytes
+type sizeLimitReader struct {
+	reader io.Reader
+	remaining int64
+}
+
+func newSizeLimitReader(reader io.Reader, limit uint) *sizeLimitReader {
+	return &sizeLimitReader{ reader: reader, remaining: int64(limit) }
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	// Read one byte past the limit, to tell a file that's exactly the
+	// limit from one that's over it
+	if int64(len(p)) > l.remaining + 1 {
+		p = p[:l.remaining + 1]
+	}
+	n, err := l.reader.Read(p)
+	if int64(n) > l.remaining {
+		l.remaining = 0
+		return 0, ErrFileTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// ReceiveProjectFile reads a file upload form and stores the file in
+// the project's src directory, returning the file's path. The path
+// field is expected before the file so the file can be written to the
+// project as it's read. Forms with the file first are spooled to disk
+// until the path is known. The file is only stored if it matches
+// expected, and the file it replaces matches precondition.
+func ReceiveProjectFile(config Config, user, projectName string, form *multipart.Reader, expected ExpectedFile, precondition FilePrecondition, token string) (string, error) {
+	if _, err := config.database.GetProjectId(user, projectName); err != nil {
+		return "", fmt.Errorf("ReceiveProjectFile get project id: %w", err)
+	}
+
+	var path string
+	var spool *os.File
+	received := false
+
+	defer func() {
+		if spool != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+	}()
+
+	for {
+		part, err := form.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("ReceiveProjectFile next part: %w", err)
+		}
+
+		switch part.FormName() {
+		case "path":
+			value, err := io.ReadAll(io.LimitReader(part, maxUploadPathSize))
+			if err != nil {
+				return "", fmt.Errorf("ReceiveProjectFile read path: %w", err)
+			}
+			path = string(value)
+		case "file":
+			if received || spool != nil {
+				return "", errors.New("ReceiveProjectFile more than one file in upload")
+			}
+			reader := newSizeLimitReader(part, config.MaxFileSize)
+			if path == "" {
+				spool, err = spoolUpload(config, user, projectName, reader)
+				if err != nil {
+					return "", fmt.Errorf("ReceiveProjectFile: %w", err)
+				}
+				continue
+			}
+			// Checked before the file is read, so a conflicting upload
+			// isn't stored only to be thrown away
+			if err := CheckFilePrecondition(config, user, projectName, path, precondition); err != nil {
+				return "", fmt.Errorf("ReceiveProjectFile: %w", err)
+			}
+			if err := CreateProjectFile(config, user, projectName, path, reader, expected, precondition, token); err != nil {
+				return "", fmt.Errorf("ReceiveProjectFile: %w", err)
+			}
+			received = true
+		}
+	}
+
+	if path == "" || (!received && spool == nil) {
+		return "", ErrUploadIncomplete
+	}
+
+	if spool != nil {
+		if err := CheckFilePrecondition(config, user, projectName, path, precondition); err != nil {
+			return "", fmt.Errorf("ReceiveProjectFile: %w", err)
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return "", fmt.Errorf("ReceiveProjectFile seek spool: %w", err)
+		}
+		if err := CreateProjectFile(config, user, projectName, path, spool, expected, precondition, token); err != nil {
+			return "", fmt.Errorf("ReceiveProjectFile: %w", err)
+		}
+	}
+
+	return path, nil
+}
+
+// spoolUpload copies an upload into a temporary file in the project
+// directory. Caller is responsible for closing and removing it.
+func spoolUpload(config Config, user, projectName string, reader io.Reader) (*os.File, error) {
+	projectPath := filepath.Join(config.ProjectDir, user, projectName)
+	spool, err := os.CreateTemp(projectPath, ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("spoolUpload create: %w", err)
+	}
+
+	if _, err := io.Copy(spool, reader); err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, fmt.Errorf("spoolUpload copy: %w", err)
+	}
+
+	return spool, nil
+}
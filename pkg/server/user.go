@@ -2,10 +2,16 @@ package server
 
 import (
 	"crypto/rand"
+	"database/sql"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -13,21 +19,70 @@ import (
 // TODO Add a way for clients to manage tokens
 const BearerTokenByteLength = 32
 
-var ForbiddenUsernames = []string{ "login", "logout" }
+var ForbiddenUsernames = []string{ "account", "admin", "api", "cli", "healthz", "login", "logout", "logout_all", "readyz", "register", "sso" }
+
+// Usernames are lowercase, start with a letter, and are used directly
+// in URLs and directory names
+var usernameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
 
 type UserInfo struct {
 	Name string `json:"name"`
 	Projects []ProjectInfo `json:"projects"`
 }
 
-// CreateUser adds a user to the database and creates their directory
-func CreateUser(config Config, name string) error {
+// ValidateUsername checks that a username is well formed and not
+// forbidden
+func ValidateUsername(name string) error {
 	for _, forbidden := range ForbiddenUsernames {
 		if name == forbidden {
 			return ErrForbiddenUsername
 		}
 	}
 
+	if !usernameRegexp.MatchString(name) {
+		return ErrInvalidUsername
+	}
+
+	return nil
+}
+
+// ValidatePassword checks that a new password is strong enough. It
+// must be at least MinPasswordLength long, must not contain the
+// username, and must mix letters with numbers or symbols.
+func ValidatePassword(config Config, name, password string) error {
+	if len(password) < config.MinPasswordLength {
+		return fmt.Errorf("%w: must be at least %d characters", ErrWeakPassword, config.MinPasswordLength)
+	}
+
+	if name != "" && strings.Contains(strings.ToLower(password), strings.ToLower(name)) {
+		return fmt.Errorf("%w: must not contain the username", ErrWeakPassword)
+	}
+
+	var letters, others bool
+	for _, char := range password {
+		if unicode.IsLetter(char) {
+			letters = true
+		} else {
+			others = true
+		}
+	}
+
+	if !letters || !others {
+		return fmt.Errorf("%w: must contain letters and numbers or symbols", ErrWeakPassword)
+	}
+
+	return nil
+}
+
+var ErrInvalidUsername = errors.New("username must be 2-32 lowercase letters, numbers, '-' or '_', starting with a letter")
+var ErrWeakPassword = errors.New("password too weak")
+
+// CreateUser adds a user to the database and creates their directory
+func CreateUser(config Config, name string) error {
+	if err := ValidateUsername(name); err != nil {
+		return err
+	}
+
 	if _, err := config.database.conn.Exec("INSERT INTO users (name) VALUES (?)", name); err != nil {
 		return fmt.Errorf("CreateUser insert in db: %w", err)
 	}
@@ -42,15 +97,68 @@ func CreateUser(config Config, name string) error {
 
 var ErrForbiddenUsername = errors.New("forbidden username")
 
-// DeleteUser deletes a user from the database and recursively removes their directory
+// Prefix of user directories that are being deleted. Usernames must
+// start with a letter, so these can never collide with a real user.
+const deletedUserDirPrefix = ".deleted-"
+
+// DeleteUser deletes a user from the database and recursively removes
+// their directory. The directory is first moved aside, so if the
+// database can't be updated it's put back, and if it can't be fully
+// removed the leftovers are cleaned up by CleanDeletedUserDirs instead
+// of being picked up by a new user with the same name.
 func DeleteUser(config Config, name string) error {
+	if _, err := config.database.GetUserId(name); err != nil {
+		return fmt.Errorf("DeleteUser: %w", err)
+	}
+
+	userDir := filepath.Join(config.ProjectDir, name)
+	deletedDir := filepath.Join(config.ProjectDir, fmt.Sprintf("%s%s-%d", deletedUserDirPrefix, name, time.Now().UnixNano()))
+
+	moved := true
+	if err := os.Rename(userDir, deletedDir); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("DeleteUser move dir: %w", err)
+		}
+		moved = false
+	}
+
 	if _, err := config.database.conn.Exec("DELETE FROM users WHERE name = ?", name); err != nil {
+		if moved {
+			if restoreErr := os.Rename(deletedDir, userDir); restoreErr != nil {
+				return fmt.Errorf("DeleteUser delete from db: %w (%s)", err, restoreErr)
+			}
+		}
 		return fmt.Errorf("DeleteUser delete from db: %w", err)
 	}
 
-	userDir := filepath.Join(config.ProjectDir, name)
-	if err := os.RemoveAll(userDir); err != nil {
-		return fmt.Errorf("DeleteUser RemoveAll dir: %w", err)
+	if moved {
+		if err := os.RemoveAll(deletedDir); err != nil {
+			return fmt.Errorf("DeleteUser RemoveAll dir: %w", err)
+		}
+	}
+
+	if err := removeUserTrash(config, name); err != nil {
+		return fmt.Errorf("DeleteUser: %w", err)
+	}
+
+	return nil
+}
+
+// CleanDeletedUserDirs removes what's left of user directories that
+// DeleteUser couldn't completely remove
+func CleanDeletedUserDirs(config Config) error {
+	entries, err := os.ReadDir(config.ProjectDir)
+	if err != nil {
+		return fmt.Errorf("CleanDeletedUserDirs read dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), deletedUserDirPrefix) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(config.ProjectDir, entry.Name())); err != nil {
+			return fmt.Errorf("CleanDeletedUserDirs RemoveAll: %w", err)
+		}
 	}
 
 	return nil
@@ -69,24 +177,102 @@ func SetUserPassword(config Config, name, password string) error {
 	return nil
 }
 
+// CompareUserPassword checks a user's password using the configured
+// PasswordAuthenticator. Users with a password in the local database,
+// like admins given one with the passwd command, are checked against
+// it instead, so they can log in when the directory doesn't know them.
 func CompareUserPassword(config Config, name, password string) error {
-	// TODO Do constant time compare even if the user isn't in the DB.
-	//
-	// Theoretically attacker could tell if the user exusts or
-	// not because the request will return sooner since we don't
-	// compare the password, but it's not very important right now
+	authenticator := config.authenticator
+	if authenticator == nil {
+		authenticator = LocalAuthenticator{}
+	}
 
-	row := config.database.conn.QueryRow("SELECT password_digest FROM users WHERE name = ?", name)
-	if row.Err() != nil {
-		return fmt.Errorf("CompareUserPassword query: %w", row.Err())
+	if _, ok := authenticator.(LocalAuthenticator); !ok {
+		local, err := hasLocalPassword(config, name)
+		if err != nil {
+			return fmt.Errorf("CompareUserPassword: %w", err)
+		}
+		if local {
+			authenticator = LocalAuthenticator{}
+		}
+	}
+
+	return authenticator.Authenticate(config, name, password)
+}
+
+// hasLocalPassword reports whether a user has a password in the local
+// database. A user that doesn't exist doesn't.
+func hasLocalPassword(config Config, name string) (bool, error) {
+	var local bool
+	err := config.database.conn.QueryRow("SELECT COALESCE(password_digest, '') != '' FROM users WHERE name = ?", name).Scan(&local)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("hasLocalPassword: %w", err)
+	}
+
+	return local, nil
+}
+
+var ErrIncorrectPassword = errors.New("incorrect password")
+var ErrPasswordManagedExternally = errors.New("password is managed by an external directory")
+
+// ChangeUserPassword changes a user's own password after checking
+// their current one, and logs out every other session by deleting all
+// of their tokens except keepToken. With an external directory, only
+// users with a local password can change it.
+func ChangeUserPassword(config Config, name, keepToken, currentPassword, newPassword string) error {
+	if config.AuthBackend != "" && config.AuthBackend != AuthBackendLocal {
+		local, err := hasLocalPassword(config, name)
+		if err != nil {
+			return fmt.Errorf("ChangeUserPassword: %w", err)
+		}
+		if !local {
+			return ErrPasswordManagedExternally
+		}
+	}
+
+	if err := CompareUserPassword(config, name, currentPassword); err != nil {
+		if errors.Is(err, ErrUserDisabled) {
+			return err
+		}
+		return fmt.Errorf("ChangeUserPassword: %w (%s)", ErrIncorrectPassword, err)
+	}
+
+	if err := ValidatePassword(config, name, newPassword); err != nil {
+		return err
+	}
+
+	digest, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("ChangeUserPassword generate from password: %w", err)
+	}
+
+	tx, err := config.database.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("ChangeUserPassword begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET password_digest = ? WHERE name = ?", digest, name); err != nil {
+		return fmt.Errorf("ChangeUserPassword update db: %w", err)
+	}
+
+	stmt := `
+DELETE FROM
+  tokens
+WHERE token != ?
+  AND user_id = (SELECT id FROM users WHERE name = ?)`
+	if _, err := tx.Exec(stmt, keepToken, name); err != nil {
+		return fmt.Errorf("ChangeUserPassword delete tokens: %w", err)
 	}
 
-	var digest string
-	if err := row.Scan(&digest); err != nil {
-		return fmt.Errorf("CompareUserPassword scan: %w", err)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ChangeUserPassword commit: %w", err)
 	}
 
-	return bcrypt.CompareHashAndPassword([]byte(digest), []byte(password))
+	return nil
 }
 
 // CreateUserToken generates a new random token for a user and stores
@@ -155,7 +341,7 @@ WHERE id IN (
 
 // GetUserFromToken returns the user name that a token is associated with
 func GetUserFromToken(config Config, token string) (string, error) {
-	row := config.database.conn.QueryRow("SELECT u.name FROM users u JOIN tokens t ON u.id = t.user_id WHERE t.token = ? LIMIT 1", token)
+	row := config.database.conn.QueryRow("SELECT u.name FROM users u JOIN tokens t ON u.id = t.user_id WHERE t.token = ? AND NOT u.disabled LIMIT 1", token)
 	if row.Err() != nil {
 		return "", fmt.Errorf("GetUserIdFromToken query: %w", row.Err())
 	}
@@ -166,3 +352,176 @@ func GetUserFromToken(config Config, token string) (string, error) {
 
 	return user, nil
 }
+
+var ErrUserDisabled = errors.New("user disabled")
+
+// UserAccount describes a user account for administration
+type UserAccount struct {
+	Name string `json:"name"`
+	Admin bool `json:"admin"`
+	Disabled bool `json:"disabled"`
+}
+
+// ListUsers returns every user account on the server
+func ListUsers(config Config) ([]UserAccount, error) {
+	rows, err := config.database.conn.Query("SELECT name, is_admin, disabled FROM users ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("ListUsers query: %w", err)
+	}
+	defer rows.Close()
+
+	var accounts []UserAccount
+
+	for rows.Next() {
+		var account UserAccount
+		if err := rows.Scan(&account.Name, &account.Admin, &account.Disabled); err != nil {
+			return nil, fmt.Errorf("ListUsers scan: %w", err)
+		}
+		accounts = append(accounts, account)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("ListUsers rows error: %w", rows.Err())
+	}
+
+	return accounts, nil
+}
+
+// SetUserAdmin grants or removes a user's administrator role
+func SetUserAdmin(config Config, name string, admin bool) error {
+	result, err := config.database.conn.Exec("UPDATE users SET is_admin = ? WHERE name = ?", admin, name)
+	if err != nil {
+		return fmt.Errorf("SetUserAdmin update db: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("SetUserAdmin: %w", sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// IsUserAdmin returns true if a user has the administrator role
+func IsUserAdmin(config Config, name string) (bool, error) {
+	row := config.database.conn.QueryRow("SELECT is_admin FROM users WHERE name = ? AND NOT disabled", name)
+	if row.Err() != nil {
+		return false, fmt.Errorf("IsUserAdmin query: %w", row.Err())
+	}
+
+	var admin bool
+	if err := row.Scan(&admin); err != nil {
+		return false, fmt.Errorf("IsUserAdmin scan: %w", err)
+	}
+
+	return admin, nil
+}
+
+// SetUserDisabled disables or re-enables a user. Disabled users can't
+// login, and their existing tokens are no longer accepted.
+func SetUserDisabled(config Config, name string, disabled bool) error {
+	result, err := config.database.conn.Exec("UPDATE users SET disabled = ? WHERE name = ?", disabled, name)
+	if err != nil {
+		return fmt.Errorf("SetUserDisabled update db: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("SetUserDisabled: %w", sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// IsUserDisabled returns true if a user has been disabled
+func IsUserDisabled(config Config, name string) (bool, error) {
+	row := config.database.conn.QueryRow("SELECT disabled FROM users WHERE name = ?", name)
+	if row.Err() != nil {
+		return false, fmt.Errorf("IsUserDisabled query: %w", row.Err())
+	}
+
+	var disabled bool
+	if err := row.Scan(&disabled); err != nil {
+		return false, fmt.Errorf("IsUserDisabled scan: %w", err)
+	}
+
+	return disabled, nil
+}
+
+// TokenInfo describes a token without revealing the token itself
+type TokenInfo struct {
+	ID int `json:"id"`
+	Description string `json:"description"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ListUserTokens returns information about all of a user's tokens
+func ListUserTokens(config Config, user string) ([]TokenInfo, error) {
+	userId, err := config.database.GetUserId(user)
+	if err != nil {
+		return nil, fmt.Errorf("ListUserTokens: %w", err)
+	}
+
+	rows, err := config.database.conn.Query("SELECT id, COALESCE(description, ''), created_at FROM tokens WHERE user_id = ? ORDER BY id", userId)
+	if err != nil {
+		return nil, fmt.Errorf("ListUserTokens query: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []TokenInfo
+
+	for rows.Next() {
+		var info TokenInfo
+		var createdAt string
+		if err := rows.Scan(&info.ID, &info.Description, &createdAt); err != nil {
+			return nil, fmt.Errorf("ListUserTokens scan: %w", err)
+		}
+		info.CreatedAt, err = time.Parse(SQLiteTime, createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("ListUserTokens parse createdAt time: %w", err)
+		}
+		tokens = append(tokens, info)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("ListUserTokens rows error: %w", rows.Err())
+	}
+
+	return tokens, nil
+}
+
+// GetTokenInfo returns the id and description of a token
+func GetTokenInfo(config Config, token string) (TokenInfo, error) {
+	row := config.database.conn.QueryRow("SELECT id, COALESCE(description, ''), created_at FROM tokens WHERE token = ?", token)
+
+	var info TokenInfo
+	var createdAt string
+	if err := row.Scan(&info.ID, &info.Description, &createdAt); err != nil {
+		return TokenInfo{}, fmt.Errorf("GetTokenInfo scan: %w", err)
+	}
+
+	var err error
+	info.CreatedAt, err = time.Parse(SQLiteTime, createdAt)
+	if err != nil {
+		return TokenInfo{}, fmt.Errorf("GetTokenInfo parse time: %w", err)
+	}
+
+	return info, nil
+}
+
+// DeleteUserTokenById deletes one of a user's tokens using its id
+func DeleteUserTokenById(config Config, user string, tokenId int) error {
+	userId, err := config.database.GetUserId(user)
+	if err != nil {
+		return fmt.Errorf("DeleteUserTokenById: %w", err)
+	}
+
+	result, err := config.database.conn.Exec("DELETE FROM tokens WHERE id = ? AND user_id = ?", tokenId, userId)
+	if err != nil {
+		return fmt.Errorf("DeleteUserTokenById exec: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("DeleteUserTokenById: %w", sql.ErrNoRows)
+	}
+
+	return nil
+}